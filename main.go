@@ -2,10 +2,10 @@ package main
 
 import (
 	"os"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
-	"github.com/gopher-net/dknet"
 	"github.com/gopher-net/docker-ovs-plugin/ovs"
 )
 
@@ -19,12 +19,35 @@ func main() {
 		Name:  "debug, d",
 		Usage: "enable debugging",
 	}
+	var flagGCInterval = cli.IntFlag{
+		Name:  "gc-interval",
+		Value: 300,
+		Usage: "seconds between sweeps for orphaned veths and OVS ports, 0 only sweeps at startup",
+	}
+	var flagGCReportOnly = cli.BoolFlag{
+		Name:  "gc-report-only",
+		Usage: "log orphaned veths and OVS ports instead of removing them",
+	}
+	var flagScope = cli.StringFlag{
+		Name:  "scope",
+		Value: ovs.ScopeLocal,
+		Usage: "scope reported to docker, global for networks shared across a cluster",
+	}
+	var flagAdminSocket = cli.StringFlag{
+		Name:  "admin-socket",
+		Value: ovs.DefaultAdminSocket,
+		Usage: "unix socket to serve the admin API on, empty to disable it",
+	}
 	app := cli.NewApp()
 	app.Name = "don"
 	app.Usage = "Docker Open vSwitch Networking"
 	app.Version = version
 	app.Flags = []cli.Flag{
 		flagDebug,
+		flagGCInterval,
+		flagGCReportOnly,
+		flagAdminSocket,
+		flagScope,
 	}
 	app.Action = Run
 	app.Run(os.Args)
@@ -36,10 +59,23 @@ func Run(ctx *cli.Context) {
 		log.SetLevel(log.DebugLevel)
 	}
 
-	d, err := ovs.NewDriver()
+	config := ovs.Config{
+		GCInterval:   time.Duration(ctx.Int("gc-interval")) * time.Second,
+		GCReportOnly: ctx.Bool("gc-report-only"),
+		Scope:        ctx.String("scope"),
+	}
+	d, err := ovs.NewDriver(config)
 	if err != nil {
 		panic(err)
 	}
-	h := dknet.NewHandler(d)
-	h.ServeUnix("root", "ovs")
+	if path := ctx.String("admin-socket"); path != "" {
+		go func() {
+			if err := d.ServeAdmin(path); err != nil {
+				log.Errorf("Admin API stopped: %s", err)
+			}
+		}()
+	}
+	if err := d.ServePlugin("ovs", "root"); err != nil {
+		log.Fatalf("Plugin API stopped: %s", err)
+	}
 }
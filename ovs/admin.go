@@ -0,0 +1,103 @@
+package ovs
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The admin API changes networks after docker created them. It is served
+// over HTTP on a unix socket only root can connect to:
+//
+//	GET    /peerings                                 list the peered networks
+//	POST   /peerings {"Network": "a", "Peer": "b"}   peer two networks
+//	DELETE /peerings {"Network": "a", "Peer": "b"}   remove a peering
+//
+// Networks are given by ID, unique ID prefix or docker network name. Failed
+// requests are answered with {"Err": "..."}.
+
+const (
+	DefaultAdminSocket = "/run/docker-ovs-plugin/admin.sock"
+)
+
+// ServeAdmin serves the admin API on a unix socket until it fails
+func (d *Driver) ServeAdmin(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// A socket left behind by a previous run
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if err := os.Chmod(path, 0600); err != nil {
+		return err
+	}
+	log.Infof("Serving the admin API on %s", path)
+	return http.Serve(l, d.adminHandler())
+}
+
+func (d *Driver) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/peerings", d.handlePeerings)
+	return mux
+}
+
+func (d *Driver) handlePeerings(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		writeAdminJSON(w, http.StatusOK, d.peerings())
+		return
+	}
+	if r.Method != "POST" && r.Method != "DELETE" {
+		writeAdminJSON(w, http.StatusMethodNotAllowed, map[string]string{"Err": r.Method + " is not supported"})
+		return
+	}
+	var p peering
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeAdminJSON(w, http.StatusBadRequest, map[string]string{"Err": "invalid peering: " + err.Error()})
+		return
+	}
+	id, err := d.lookupNetwork(p.Network)
+	if err == nil {
+		p.Peer, err = d.lookupNetwork(p.Peer)
+	}
+	if err == nil {
+		if r.Method == "POST" {
+			err = d.connectNetworks(id, p.Peer)
+		} else {
+			err = d.disconnectNetworks(id, p.Peer)
+		}
+	}
+	if err != nil {
+		log.Errorf("Admin %s /peerings %+v failed: %s", r.Method, p, err)
+		writeAdminJSON(w, http.StatusBadRequest, map[string]string{"Err": err.Error()})
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]string{})
+}
+
+// lookupNetwork resolves a network reference, asking docker for the ID of a
+// network given by name
+func (d *Driver) lookupNetwork(ref string) (string, error) {
+	id, err := d.resolveNetwork(ref)
+	if err == nil || d.dockerer.client == nil || ref == "" {
+		return id, err
+	}
+	info, inspectErr := d.dockerer.client.InspectNetwork(ref)
+	if inspectErr != nil {
+		return "", err
+	}
+	return d.resolveNetwork(info.ID)
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
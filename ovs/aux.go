@@ -0,0 +1,227 @@
+package ovs
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gopher-net/dknet"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// auxHostKey names the auxiliary addresses added to the gateway
+	// interface of a network, as host or host-<anything>
+	auxHostKey = "host"
+	// auxDevicePrefix names the auxiliary addresses of devices on a network
+	// that get a static neighbor entry, with their MAC after the prefix
+	auxDevicePrefix = "device-"
+)
+
+// Device is a device on a network outside of docker, e.g. a router on a
+// flat network, with a static neighbor entry on the host
+type Device struct {
+	Address string
+	MAC     string
+}
+
+// getAuxAddresses returns the host addresses, in CIDR notation, and the
+// devices named by the auxiliary addresses IPAM reserved. Other auxiliary
+// addresses are only reserved.
+func getAuxAddresses(r *dknet.CreateNetworkRequest) ([]string, []Device, error) {
+	var hosts []string
+	var devices []Device
+	for _, data := range append(append([]*dknet.IPAMData{}, r.IPv4Data...), r.IPv6Data...) {
+		if data == nil {
+			continue
+		}
+		var keys []string
+		for key := range data.AuxAddresses {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			isHost := key == auxHostKey || strings.HasPrefix(key, auxHostKey+"-")
+			isDevice := key == strings.TrimSuffix(auxDevicePrefix, "-") || strings.HasPrefix(key, auxDevicePrefix)
+			if !isHost && !isDevice {
+				continue
+			}
+			value, _ := data.AuxAddresses[key].(string)
+			cidr, err := auxCIDR(value, data.Pool)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid auxiliary address %s: %s", key, err)
+			}
+			if isHost {
+				hosts = append(hosts, cidr)
+				continue
+			}
+			mac, err := net.ParseMAC(strings.TrimPrefix(key, auxDevicePrefix))
+			if err != nil {
+				return nil, nil, fmt.Errorf("auxiliary address %s needs the MAC of the device after %s", key, auxDevicePrefix)
+			}
+			ip, _, _ := net.ParseCIDR(cidr)
+			devices = append(devices, Device{Address: ip.String(), MAC: mac.String()})
+		}
+	}
+	return hosts, devices, nil
+}
+
+// auxCIDR returns an auxiliary address in CIDR notation, with the prefix
+// length of its pool if it has none
+func auxCIDR(value string, pool string) (string, error) {
+	if strings.Contains(value, "/") {
+		ip, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return "", err
+		}
+		ones, _ := ipNet.Mask.Size()
+		return fmt.Sprintf("%s/%d", ip, ones), nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return "", fmt.Errorf("%q is not an IP address", value)
+	}
+	ones := 128
+	if ip.To4() != nil {
+		ones = 32
+	}
+	if _, poolNet, err := net.ParseCIDR(pool); err == nil {
+		ones, _ = poolNet.Mask.Size()
+	}
+	return fmt.Sprintf("%s/%d", ip, ones), nil
+}
+
+func formatDevices(devices []Device) string {
+	pairs := make([]string, len(devices))
+	for i, dev := range devices {
+		pairs[i] = dev.Address + "=" + dev.MAC
+	}
+	return strings.Join(pairs, ",")
+}
+
+// parseDevices is the reverse of formatDevices
+func parseDevices(value string) ([]Device, error) {
+	var devices []Device
+	for _, pair := range strings.Split(value, ",") {
+		if pair == "" {
+			continue
+		}
+		parts := strings.Split(pair, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid device %s", pair)
+		}
+		devices = append(devices, Device{Address: parts[0], MAC: parts[1]})
+	}
+	return devices, nil
+}
+
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// deviceNeigh returns the static neighbor entry of a device
+func deviceNeigh(link netlink.Link, dev Device) (*netlink.Neigh, error) {
+	ip := net.ParseIP(dev.Address)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid device address %s", dev.Address)
+	}
+	mac, err := net.ParseMAC(dev.MAC)
+	if err != nil {
+		return nil, err
+	}
+	family := netlink.FAMILY_V6
+	if ip.To4() != nil {
+		family = netlink.FAMILY_V4
+	}
+	return &netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       family,
+		State:        netlink.NUD_PERMANENT,
+		IP:           ip,
+		HardwareAddr: mac,
+	}, nil
+}
+
+// addAuxAddresses adds the host addresses of a network to its gateway
+// interface and the neighbor entries of its devices there
+func (d *Driver) addAuxAddresses(iface string, ns *NetworkState) error {
+	if len(ns.HostAddresses) == 0 && len(ns.Devices) == 0 {
+		return nil
+	}
+	link, err := d.links.LinkByName(iface)
+	if err != nil {
+		return err
+	}
+	assigned, err := d.addrs.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	for _, cidr := range ns.HostAddresses {
+		addr, err := netlink.ParseAddr(cidr)
+		if err != nil {
+			return err
+		}
+		if hasAddr(assigned, addr) {
+			continue
+		}
+		if err := d.addrs.AddrAdd(link, addr); err != nil {
+			return fmt.Errorf("could not add host address %s to %s: %s", cidr, iface, err)
+		}
+		log.Infof("Added host address %s to [ %s ]", cidr, iface)
+	}
+	for _, dev := range ns.Devices {
+		neigh, err := deviceNeigh(link, dev)
+		if err != nil {
+			return err
+		}
+		if err := d.addrs.NeighSet(neigh); err != nil {
+			return fmt.Errorf("could not add a neighbor entry for %s on %s: %s", dev.Address, iface, err)
+		}
+		log.Infof("Added neighbor entry %s lladdr %s on [ %s ]", dev.Address, dev.MAC, iface)
+	}
+	return nil
+}
+
+// removeAuxAddresses reverses addAuxAddresses, carrying on past errors
+func (d *Driver) removeAuxAddresses(iface string, ns *NetworkState) {
+	if len(ns.HostAddresses) == 0 && len(ns.Devices) == 0 {
+		return
+	}
+	link, err := d.links.LinkByName(iface)
+	if err != nil {
+		log.Debugf("Gateway interface [ %s ] is already gone: %s", iface, err)
+		return
+	}
+	for _, cidr := range ns.HostAddresses {
+		addr, err := netlink.ParseAddr(cidr)
+		if err == nil {
+			err = d.addrs.AddrDel(link, addr)
+		}
+		if err != nil {
+			log.Debugf("Error removing host address %s from [ %s ]: %s", cidr, iface, err)
+		}
+	}
+	for _, dev := range ns.Devices {
+		neigh, err := deviceNeigh(link, dev)
+		if err == nil {
+			err = d.addrs.NeighDel(neigh)
+		}
+		if err != nil {
+			log.Debugf("Error removing the neighbor entry of %s from [ %s ]: %s", dev.Address, iface, err)
+		}
+	}
+}
+
+func hasAddr(addrs []netlink.Addr, addr *netlink.Addr) bool {
+	for _, a := range addrs {
+		if a.IPNet.String() == addr.IPNet.String() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package ovs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gopher-net/dknet"
+)
+
+func TestAuxAddresses(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	links := d.links.(*fakeLinker)
+
+	id, _ := testNetwork()
+	err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+		NetworkID: id,
+		Options:   map[string]interface{}{modeOption: modeFlat},
+		IPv4Data: []*dknet.IPAMData{{
+			Pool:    "10.1.0.0/24",
+			Gateway: "10.1.0.1/24",
+			AuxAddresses: map[string]interface{}{
+				"host":                     "10.1.0.2/24",
+				"device-02:00:0a:01:00:fe": "10.1.0.254",
+				"reserved":                 "10.1.0.3/24",
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, err := d.getNetwork(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ns.HostAddresses) != 1 || len(ns.Devices) != 1 || ns.Devices[0] != (Device{Address: "10.1.0.254", MAC: "02:00:0a:01:00:fe"}) {
+		t.Fatalf("unexpected auxiliary addresses %v and %v", ns.HostAddresses, ns.Devices)
+	}
+	// Flat networks get no gateway, only the host address
+	expectRecorded(t, &links.recorder,
+		"addr add ovsbr-01234 10.1.0.2/24",
+		"neigh set 10.1.0.254 dev ovsbr-01234 lladdr 02:00:0a:01:00:fe",
+		"up ovsbr-01234")
+
+	waitFor(t, "the bridge to be cached", func() bool {
+		_, _, ok := d.cache.bridgeByName(ns.BridgeName)
+		return ok
+	})
+	restored := d.networksFromCache()[id]
+	if restored == nil || strings.Join(restored.HostAddresses, ",") != "10.1.0.2/24" || formatDevices(restored.Devices) != formatDevices(ns.Devices) {
+		t.Fatalf("auxiliary addresses not restored from the cache: %+v", restored)
+	}
+
+	if err := d.DeleteNetwork(&dknet.DeleteNetworkRequest{NetworkID: id}); err != nil {
+		t.Fatal(err)
+	}
+	expectRecorded(t, &links.recorder,
+		"addr del ovsbr-01234 10.1.0.2/24",
+		"neigh del 10.1.0.254 dev ovsbr-01234")
+}
+
+func TestAuxAddressValidation(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	for _, aux := range []map[string]interface{}{
+		{"device": "10.1.0.254"},
+		{"device-router": "10.1.0.254"},
+		{"host": "10.1.0"},
+	} {
+		id, _ := testNetwork()
+		err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+			NetworkID: id,
+			IPv4Data:  []*dknet.IPAMData{{Pool: "10.1.0.0/24", Gateway: "10.1.0.1/24", AuxAddresses: aux}},
+		})
+		if err == nil {
+			t.Fatalf("expected auxiliary addresses %v to be rejected", aux)
+		}
+	}
+}
@@ -1,7 +1,202 @@
 package ovs
 
-import "github.com/samalba/dockerclient"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/samalba/dockerclient"
+)
 
 type dockerer struct {
 	client *dockerclient.DockerClient
 }
+
+// endpointIDs returns the IDs of every endpoint attached to a docker network
+func (dockerer *dockerer) endpointIDs() (map[string]bool, error) {
+	networks, err := dockerer.client.ListNetworks("")
+	if err != nil {
+		return nil, err
+	}
+	endpoints := make(map[string]bool)
+	for _, network := range networks {
+		for _, endpoint := range network.Containers {
+			endpoints[endpoint.EndpointID] = true
+		}
+	}
+	return endpoints, nil
+}
+
+// endpointContainers maps the ID of every endpoint attached to a docker
+// network to the ID of its container
+func (dockerer *dockerer) endpointContainers() (map[string]string, error) {
+	networks, err := dockerer.client.ListNetworks("")
+	if err != nil {
+		return nil, err
+	}
+	containers := make(map[string]string)
+	for _, network := range networks {
+		for containerID, endpoint := range network.Containers {
+			containers[endpoint.EndpointID] = containerID
+		}
+	}
+	return containers, nil
+}
+
+// containerName returns the name of a container without its leading slash
+func (dockerer *dockerer) containerName(id string) (string, error) {
+	info, err := dockerer.client.InspectContainer(id)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(info.Name, "/"), nil
+}
+
+// event is a docker event. The vendored dockerclient predates the Type,
+// Action and Actor fields of API 1.22, so events are decoded here.
+type event struct {
+	Status string
+	ID     string `json:"id"`
+	Type   string
+	Action string
+	Actor  eventActor
+}
+
+// eventActor is the object an event is about, e.g. the network of a network
+// event with the container it was connected to in Attributes
+type eventActor struct {
+	ID         string
+	Attributes map[string]string
+}
+
+// followEvents calls handle for each docker event until the stream is lost.
+// connected is called once the stream is open.
+func (dockerer *dockerer) followEvents(connected func(), handle func(*event)) error {
+	resp, err := dockerer.client.HTTPClient.Get(fmt.Sprintf("%s/%s/events", dockerer.client.URL, dockerclient.APIVersion))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("docker events request failed: %s", resp.Status)
+	}
+	connected()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var e event
+		if err := decoder.Decode(&e); err != nil {
+			return err
+		}
+		handle(&e)
+	}
+}
+
+// containerNetworks is what an inspected container tells about its networks.
+// The vendored dockerclient predates the per network settings of API 1.21,
+// so containers are decoded here.
+type containerNetworks struct {
+	Config struct {
+		Labels map[string]string
+	}
+	NetworkSettings struct {
+		Networks map[string]*endpointSettings
+	}
+}
+
+// endpointSettings are the settings of a container on a network, as
+// inspected and as given when connecting it
+type endpointSettings struct {
+	NetworkID  string              `json:",omitempty"`
+	Aliases    []string            `json:",omitempty"`
+	IPAMConfig *endpointIPAMConfig `json:",omitempty"`
+}
+
+// endpointIPAMConfig holds the addresses a container asks for on a network
+type endpointIPAMConfig struct {
+	IPv4Address string `json:",omitempty"`
+	IPv6Address string `json:",omitempty"`
+}
+
+// containerNetworks returns the labels and network settings of a container
+func (dockerer *dockerer) containerNetworks(id string) (*containerNetworks, error) {
+	resp, err := dockerer.client.HTTPClient.Get(fmt.Sprintf("%s/%s/containers/%s/json", dockerer.client.URL, dockerclient.APIVersion, id))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("inspecting container %s failed: %s", id, resp.Status)
+	}
+	c := &containerNetworks{}
+	if err := json.NewDecoder(resp.Body).Decode(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// labeledContainers returns the IDs of the containers, running or not, that
+// carry a label
+func (dockerer *dockerer) labeledContainers(label string) ([]string, error) {
+	containers, err := dockerer.client.ListContainers(true, false, url.QueryEscape(`{"label":["`+label+`"]}`))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, c := range containers {
+		ids = append(ids, c.Id)
+	}
+	return ids, nil
+}
+
+// networkSubnets returns the subnets of a docker network
+func (dockerer *dockerer) networkSubnets(id string) ([]string, error) {
+	network, err := dockerer.client.InspectNetwork(id)
+	if err != nil {
+		return nil, err
+	}
+	var subnets []string
+	for _, config := range network.IPAM.Config {
+		subnets = append(subnets, config.Subnet)
+	}
+	return subnets, nil
+}
+
+// reconnect disconnects a container from a network and connects it again
+// with new settings, so that docker asks the IPAM driver for the addresses
+// in them. The old settings are restored if the connect fails.
+func (dockerer *dockerer) reconnect(networkID string, containerID string, old *endpointSettings, settings *endpointSettings) error {
+	if err := dockerer.client.DisconnectNetwork(networkID, containerID); err != nil {
+		return err
+	}
+	err := dockerer.connect(networkID, containerID, settings)
+	if err == nil {
+		return nil
+	}
+	if undoErr := dockerer.connect(networkID, containerID, old); undoErr != nil {
+		return fmt.Errorf("%s, and could not connect it again as it was: %s", err, undoErr)
+	}
+	return err
+}
+
+// connect connects a container to a network with the given settings. The
+// vendored dockerclient cannot pass any.
+func (dockerer *dockerer) connect(networkID string, containerID string, settings *endpointSettings) error {
+	body, err := json.Marshal(map[string]interface{}{"Container": containerID, "EndpointConfig": settings})
+	if err != nil {
+		return err
+	}
+	resp, err := dockerer.client.HTTPClient.Post(fmt.Sprintf("%s/%s/networks/%s/connect", dockerer.client.URL, dockerclient.APIVersion, networkID), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("connecting container %s to network %s failed: %s %s", containerID, networkID, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
@@ -1,8 +1,13 @@
 package ovs
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -13,47 +18,184 @@ import (
 )
 
 const (
-	defaultRoute     = "0.0.0.0/0"
-	ovsPortPrefix    = "ovs-veth0-"
-	bridgePrefix     = "ovsbr-"
-	containerEthName = "eth"
+	defaultRoute      = "0.0.0.0/0"
+	ovsPortPrefix     = "ovs-veth0-"
+	gatewayPortPrefix = "ovs-gw-"
+	bridgePrefix      = "ovsbr-"
+	containerEthName  = "eth"
 
 	mtuOption           = "net.gopher.ovs.bridge.mtu"
 	modeOption          = "net.gopher.ovs.bridge.mode"
 	bridgeNameOption    = "net.gopher.ovs.bridge.name"
 	bindInterfaceOption = "net.gopher.ovs.bridge.bind_interface"
+	migrateOption       = "net.gopher.ovs.bridge.bind_interface.migrate"
+	vlanOption          = "net.gopher.ovs.bridge.vlan"
+	peersOption         = "net.gopher.ovs.bridge.overlay.peers"
+	vniOption           = "net.gopher.ovs.bridge.overlay.vni"
+	dstPortOption       = "net.gopher.ovs.bridge.overlay.dst_port"
+	tunnelTypeOption    = "net.gopher.ovs.bridge.overlay.tunnel_type"
+	tosOption           = "net.gopher.ovs.bridge.overlay.tos"
+	ttlOption           = "net.gopher.ovs.bridge.overlay.ttl"
+	csumOption          = "net.gopher.ovs.bridge.overlay.csum"
+	proxyARPOption      = "net.gopher.ovs.bridge.routed.proxy_arp_interface"
+	peerNetworkOption   = "net.gopher.ovs.bridge.peer_network"
+	macPrefixOption     = "net.gopher.ovs.bridge.mac_prefix"
+	staticRoutesOption  = "net.gopher.ovs.bridge.static_routes"
+	genericOption       = "com.docker.network.generic"
+	internalOption      = "com.docker.network.internal"
 
-	modeNAT  = "nat"
-	modeFlat = "flat"
+	externalIDNetwork       = "docker-network-id"
+	externalIDEndpoint      = "docker-endpoint-id"
+	externalIDMode          = "docker-ovs-mode"
+	externalIDGateway       = "docker-ovs-gateway"
+	externalIDGatewayIPv6   = "docker-ovs-gateway-ipv6"
+	externalIDSubnets       = "docker-ovs-subnets"
+	externalIDHostAddresses = "docker-ovs-host-addresses"
+	externalIDDevices       = "docker-ovs-devices"
+	externalIDMTU           = "docker-ovs-mtu"
+	externalIDBindInterface = "docker-ovs-bind-interface"
+	externalIDMigrate       = "docker-ovs-migrate"
+	externalIDVLAN          = "docker-ovs-vlan"
+	externalIDPeers         = "docker-ovs-peers"
+	externalIDVNI           = "docker-ovs-vni"
+	externalIDDstPort       = "docker-ovs-dst-port"
+	externalIDTunnelType    = "docker-ovs-tunnel-type"
+	externalIDTOS           = "docker-ovs-tos"
+	externalIDTTL           = "docker-ovs-ttl"
+	externalIDCsum          = "docker-ovs-csum"
+	externalIDProxyARP      = "docker-ovs-proxy-arp-interface"
+	externalIDPatchNetwork  = "docker-ovs-patch-network"
+	externalIDPatchPeer     = "docker-ovs-patch-peer"
+	externalIDMACPrefix     = "docker-ovs-mac-prefix"
+	externalIDStaticRoutes  = "docker-ovs-static-routes"
+	externalIDAddress       = "docker-ovs-address"
+	externalIDAddressIPv6   = "docker-ovs-address-ipv6"
+	externalIDContainer     = "docker-container-id"
+	externalIDContainerName = "docker-container-name"
+	// Uplink ports record the network that bound them to their bridge
+	externalIDUplinkNetwork  = "docker-ovs-uplink-network"
+	externalIDUplinkMigrated = "docker-ovs-uplink-migrated"
+
+	modeNAT      = "nat"
+	modeFlat     = "flat"
+	modeOverlay  = "overlay"
+	modeRouted   = "routed"
+	modeInternal = "internal"
 
 	defaultMTU  = 1500
 	defaultMode = modeNAT
+
+	ScopeLocal  = "local"
+	ScopeGlobal = "global"
+
+	minVLAN = 1
+	maxVLAN = 4094
 )
 
 var (
 	validModes = map[string]bool{
-		modeNAT:  true,
-		modeFlat: true,
+		modeNAT:      true,
+		modeFlat:     true,
+		modeOverlay:  true,
+		modeRouted:   true,
+		modeInternal: true,
 	}
 )
 
 type Driver struct {
 	dknet.Driver
 	dockerer
-	ovsdber
+	*ovsdber
+	links    linker
+	addrs    addresser
+	firewall firewaller
+	// firewall6 holds the ip6tables rules of dual-stack and IPv6 networks
+	firewall6 firewaller
+	sysctl    sysctler
+	// ipam hands out pools and addresses when the driver is used as
+	// the IPAM driver of a network as well
+	ipam *ipam
+	// lock guards the networks map. Each network has its own lock for
+	// the requests made against it.
+	lock     sync.RWMutex
 	networks map[string]*NetworkState
+	// uplinks holds the uplink binding of each bridge, also guarded by lock
+	uplinks map[string]uplinkBinding
+	// saveLock serializes saves of the state file
+	saveLock sync.Mutex
+	// trunkLock serializes updates of the trunks of uplink ports
+	trunkLock sync.Mutex
+	store     networkStore
+	gc        garbageCollector
+	scope     string
 	OvsdbNotifier
 }
 
+// Config holds the options the driver is started with
+type Config struct {
+	// GCInterval is how often orphaned veths and OVS ports are looked for,
+	// zero only reconciles once at startup
+	GCInterval time.Duration
+	// GCReportOnly logs orphaned veths and OVS ports instead of removing them
+	GCReportOnly bool
+	// Scope is local, or global for networks docker shares across a cluster
+	Scope string
+}
+
 // NetworkState is filled in at network creation time
 // it contains state that we wish to keep for each network
 type NetworkState struct {
-	BridgeName        string
-	MTU               int
-	Mode              string
-	Gateway           string
-	GatewayMask       string
+	BridgeName string
+	MTU        int
+	Mode       string
+	// Gateway and GatewayIPv6 are the gateways of the first IPv4 and IPv6
+	// pools of the network, either may be empty but not both
+	Gateway         string
+	GatewayMask     string
+	GatewayIPv6     string
+	GatewayIPv6Mask string
+	// Subnets are all the pools of the network, IPv4 first
+	Subnets []Subnet
+	// HostAddresses are auxiliary addresses added to the gateway interface
+	// next to the gateways, Devices the auxiliary addresses of devices with
+	// a static neighbor entry
+	HostAddresses     []string
+	Devices           []Device
 	FlatBindInterface string
+	// FlatMigrate moves the addresses and default route of FlatBindInterface
+	// to the bridge while it is bound
+	FlatMigrate bool
+	// VLAN is the access tag of the network's ports. Tagged networks may
+	// share a bridge, each has its own internal gateway port.
+	VLAN uint
+	// OverlayPeers are the addresses of the remote VTEPs an overlay network
+	// has a tunnel port to, VNI and DstPort are the key and UDP port of
+	// those tunnels
+	OverlayPeers []string
+	VNI          uint
+	DstPort      int
+	// TunnelType is vxlan, gre or geneve. TunnelTOS and TunnelTTL are
+	// passed to OVS as is, empty for its defaults.
+	TunnelType string
+	TunnelTOS  string
+	TunnelTTL  string
+	TunnelCsum bool
+	// ProxyARPInterface answers ARP for the addresses of a routed network,
+	// for upstream routers that see its subnet as on-link
+	ProxyARPInterface string
+	// MACPrefix replaces the 7a:42 prefix of the MAC addresses containers
+	// get from their IP address
+	MACPrefix string
+	// StaticRoutes are handed to the network's containers when they join
+	StaticRoutes []Route
+
+	// lock is held for reading by requests using the network, e.g. Join and
+	// Leave, and for writing while it is being created or deleted
+	lock    sync.RWMutex
+	deleted bool
+	// endpoints are recorded by CreateEndpoint for Join
+	endpointLock sync.Mutex
+	endpoints    map[string]endpoint
 }
 
 func (d *Driver) CreateNetwork(r *dknet.CreateNetworkRequest) error {
@@ -74,7 +216,26 @@ func (d *Driver) CreateNetwork(r *dknet.CreateNetworkRequest) error {
 		return err
 	}
 
-	gateway, mask, err := getGatewayIP(r)
+	if mode, err = getInternal(r, mode); err != nil {
+		return err
+	}
+
+	gateway, mask, err := getGatewayIP(r.IPv4Data)
+	if err != nil {
+		return err
+	}
+	gateway6, mask6, err := getGatewayIP(r.IPv6Data)
+	if err != nil {
+		return err
+	}
+	if gateway == "" && gateway6 == "" {
+		return fmt.Errorf("No gateway IP found")
+	}
+	subnets, err := getSubnets(r)
+	if err != nil {
+		return err
+	}
+	hostAddresses, devices, err := getAuxAddresses(r)
 	if err != nil {
 		return err
 	}
@@ -83,6 +244,67 @@ func (d *Driver) CreateNetwork(r *dknet.CreateNetworkRequest) error {
 	if err != nil {
 		return err
 	}
+	if mode == modeInternal && bindInterface != "" {
+		return fmt.Errorf("internal networks cannot have a %s", bindInterfaceOption)
+	}
+
+	migrate, err := getMigrate(r)
+	if err != nil {
+		return err
+	}
+
+	vlan, err := getVLAN(r)
+	if err != nil {
+		return err
+	}
+
+	peers, err := getOverlayPeers(r)
+	if err != nil {
+		return err
+	}
+
+	vni, err := getVNI(r, mode)
+	if err != nil {
+		return err
+	}
+
+	tunnelType, err := getTunnelType(r)
+	if err != nil {
+		return err
+	}
+
+	dstPort, err := getDstPort(r, tunnelType)
+	if err != nil {
+		return err
+	}
+
+	tos, ttl, csum, err := getTunnelOptions(r)
+	if err != nil {
+		return err
+	}
+
+	proxyARP, err := getProxyARPInterface(r)
+	if err != nil {
+		return err
+	}
+
+	macPrefix, err := getMACPrefix(r, subnets)
+	if err != nil {
+		return err
+	}
+
+	staticRoutes, err := getStaticRoutes(r, subnets)
+	if err != nil {
+		return err
+	}
+
+	var peerID string
+	if ref, ok := getOption(r, peerNetworkOption); ok {
+		ref, _ := ref.(string)
+		if peerID, err = d.resolveNetwork(ref); err != nil {
+			return fmt.Errorf("invalid %s: %s", peerNetworkOption, err)
+		}
+	}
 
 	ns := &NetworkState{
 		BridgeName:        bridgeName,
@@ -90,38 +312,184 @@ func (d *Driver) CreateNetwork(r *dknet.CreateNetworkRequest) error {
 		Mode:              mode,
 		Gateway:           gateway,
 		GatewayMask:       mask,
+		GatewayIPv6:       gateway6,
+		GatewayIPv6Mask:   mask6,
+		Subnets:           subnets,
+		HostAddresses:     hostAddresses,
+		Devices:           devices,
 		FlatBindInterface: bindInterface,
+		FlatMigrate:       migrate,
+		VLAN:              vlan,
+		OverlayPeers:      peers,
+		VNI:               vni,
+		DstPort:           dstPort,
+		TunnelType:        tunnelType,
+		TunnelTOS:         tos,
+		TunnelTTL:         ttl,
+		TunnelCsum:        csum,
+		ProxyARPInterface: proxyARP,
+		MACPrefix:         macPrefix,
+		StaticRoutes:      staticRoutes,
 	}
-	d.networks[r.NetworkID] = ns
+	if mtu := ns.containerMTU(); mtu < minMTU {
+		return fmt.Errorf("%s of %d leaves containers an MTU of %d, below the minimum of %d", mtuOption, ns.MTU, mtu, minMTU)
+	}
+	build := d.buildNetwork
+	// Every host of a global network is asked to create it, and may be asked
+	// again, e.g. after the plugin restarted
+	if d.scope == ScopeGlobal {
+		if _, err := d.getNetwork(r.NetworkID); err == nil {
+			build = d.recreateNetwork
+		}
+	}
+	if err := build(r.NetworkID, ns, peerID); err != nil {
+		return err
+	}
+	d.saveNetworks()
+	return nil
+}
 
-	log.Debugf("Initializing bridge for network %s", r.NetworkID)
-	if err := d.initBridge(r.NetworkID); err != nil {
-		delete(d.networks, r.NetworkID)
+// buildNetwork registers a new network and builds its bridge
+func (d *Driver) buildNetwork(id string, ns *NetworkState, peerID string) error {
+	// Requests for the network wait until it has been fully created
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	if err := d.addNetwork(id, ns); err != nil {
 		return err
 	}
+
+	log.Debugf("Initializing bridge for network %s", id)
+	if err := d.initBridge(id); err != nil {
+		d.undoNetwork(id, ns)
+		return err
+	}
+	if err := d.updateTrunks(ns.BridgeName, d.bridgeUplink(ns.BridgeName)); err != nil {
+		d.undoNetwork(id, ns)
+		return err
+	}
+	if peerID != "" {
+		if err := d.peerOnCreate(id, ns, peerID); err != nil {
+			d.undoNetwork(id, ns)
+			return err
+		}
+	}
 	return nil
 }
 
+// undoNetwork tears down what a failed create has set up, e.g. a bridge and
+// its uplink, and forgets the network even if part of the teardown fails
+func (d *Driver) undoNetwork(id string, ns *NetworkState) {
+	if err := d.deleteNetwork(id, ns); err != nil {
+		log.Errorf("Could not roll back network %s: %s", id, err)
+		d.removeNetwork(id)
+	}
+}
+
 func (d *Driver) DeleteNetwork(r *dknet.DeleteNetworkRequest) error {
 	log.Debugf("Delete network request: %+v", r)
-	bridgeName := d.networks[r.NetworkID].BridgeName
-	log.Debugf("Deleting Bridge %s", bridgeName)
-	err := d.deleteBridge(bridgeName)
+	ns, err := d.lockNetwork(r.NetworkID)
+	if err != nil {
+		// A global network may never have been created on this host
+		if d.scope == ScopeGlobal {
+			log.Debugf("Network %s to delete is not on this host", r.NetworkID)
+			return nil
+		}
+		return err
+	}
+	err = d.deleteNetwork(r.NetworkID, ns)
+	ns.lock.Unlock()
 	if err != nil {
-		log.Errorf("Deleting bridge %s failed: %s", bridgeName, err)
 		return err
 	}
-	delete(d.networks, r.NetworkID)
+	d.saveNetworks()
 	return nil
 }
 
+// deleteNetwork tears down a network, and its bridge if no other network
+// uses it. The network must be locked for writing.
+func (d *Driver) deleteNetwork(id string, ns *NetworkState) error {
+	bridgeName := ns.BridgeName
+	gatewayIface := bridgeName
+	if ns.VLAN != 0 {
+		gatewayIface = gatewayPortName(id)
+	}
+	d.removeAuxAddresses(gatewayIface, ns)
+	if ns.VLAN != 0 {
+		portName := gatewayPortName(id)
+		if err := d.deletePort(bridgeName, portName); err != nil && !isNotFound(err) {
+			log.Errorf("Deleting gateway port %s failed: %s", portName, err)
+			return err
+		}
+	}
+	if err := d.removePeerings(id); err != nil {
+		log.Errorf("Deleting the peerings of network %s failed: %s", id, err)
+		return err
+	}
+	if ns.Mode == modeOverlay {
+		if err := d.removeTunnels(id, ns); err != nil {
+			log.Errorf("Deleting the tunnels of network %s failed: %s", id, err)
+			return err
+		}
+	}
+	if ns.Mode == modeInternal {
+		if err := d.unisolate(ns, gatewayIface); err != nil {
+			log.Errorf("Could not remove the isolation rules of [ %s ]: %s", gatewayIface, err)
+		}
+	}
+	if ns.Mode == modeRouted && ns.ProxyARPInterface != "" {
+		d.disableProxyARP(id, ns.ProxyARPInterface)
+	}
+	// The bridge and its uplink stay until the last network using them is deleted
+	shared := d.bridgeShared(id, bridgeName)
+	uplink := d.bridgeUplink(bridgeName)
+	if !shared {
+		// The uplink may have been bound by another, already deleted, network
+		if err := d.unbindUplink(bridgeName); err != nil {
+			log.Errorf("Could not unbind [ %s ] from bridge [ %s ]: %s", uplink, bridgeName, err)
+		}
+		log.Debugf("Deleting Bridge %s", bridgeName)
+		if err := d.deleteBridge(bridgeName); err != nil {
+			log.Errorf("Deleting bridge %s failed: %s", bridgeName, err)
+			return err
+		}
+	}
+	d.removeNetwork(id)
+	if shared {
+		d.updateTrunks(bridgeName, uplink)
+	}
+	return nil
+}
+
+// GetCapabilities reports the scope of the driver's networks
+func (d *Driver) GetCapabilities() (*CapabilitiesResponse, error) {
+	return &CapabilitiesResponse{Scope: d.scope}, nil
+}
+
 func (d *Driver) CreateEndpoint(r *dknet.CreateEndpointRequest) error {
 	log.Debugf("Create endpoint request: %+v", r)
+	ns, err := d.rlockNetwork(r.NetworkID)
+	if err != nil {
+		return err
+	}
+	defer ns.lock.RUnlock()
+	ns.setEndpoint(r.EndpointID, r.Interface)
+	// Fail now rather than on Join if the endpoint's MAC is invalid
+	if _, err := ns.endpointMAC(ns.getEndpoint(r.EndpointID)); err != nil {
+		ns.forgetEndpoint(r.EndpointID)
+		return err
+	}
 	return nil
 }
 
 func (d *Driver) DeleteEndpoint(r *dknet.DeleteEndpointRequest) error {
 	log.Debugf("Delete endpoint request: %+v", r)
+	ns, err := d.rlockNetwork(r.NetworkID)
+	if err != nil {
+		// Nothing is left to forget once the network is gone
+		return nil
+	}
+	defer ns.lock.RUnlock()
+	ns.forgetEndpoint(r.EndpointID)
 	return nil
 }
 
@@ -132,58 +500,99 @@ func (d *Driver) EndpointInfo(r *dknet.InfoRequest) (*dknet.InfoResponse, error)
 	return res, nil
 }
 
-func (d *Driver) Join(r *dknet.JoinRequest) (*dknet.JoinResponse, error) {
+func (d *Driver) Join(r *dknet.JoinRequest) (*JoinResponse, error) {
+	ns, err := d.rlockNetwork(r.NetworkID)
+	if err != nil {
+		return nil, err
+	}
+	defer ns.lock.RUnlock()
 	// create and attach local name to the bridge
 	localVethPair := vethPair(truncateID(r.EndpointID))
-	if err := netlink.LinkAdd(localVethPair); err != nil {
-		log.Errorf("failed to create the veth pair named: [ %v ] error: [ %s ] ", localVethPair, err)
+	localVethPair.MTU = ns.containerMTU()
+	// A container keeps its MAC across restarts, so upstream switches need
+	// not relearn it
+	ep := ns.getEndpoint(r.EndpointID)
+	mac, err := ns.endpointMAC(ep)
+	if err != nil {
 		return nil, err
 	}
-	// Bring the veth pair up
-	err := netlink.LinkSetUp(localVethPair)
-	if err != nil {
-		log.Warnf("Error enabling  Veth local iface: [ %v ]", localVethPair)
+	if err := d.links.LinkAdd(localVethPair); err != nil {
+		log.Errorf("failed to create the veth pair named: [ %v ] error: [ %s ] ", localVethPair, err)
 		return nil, err
 	}
-	bridgeName := d.networks[r.NetworkID].BridgeName
-	err = d.addOvsVethPort(bridgeName, localVethPair.Name, 0)
-	if err != nil {
-		log.Errorf("error attaching veth [ %s ] to bridge [ %s ]", localVethPair.Name, bridgeName)
+	if err := d.attachVeth(r, ns, ep, localVethPair, mac); err != nil {
+		// Deleting one end of the pair deletes both
+		if delErr := d.links.LinkDel(localVethPair); delErr != nil {
+			log.Warnf("Could not delete the veth [ %s ] of a failed join: %s", localVethPair.Name, delErr)
+		}
 		return nil, err
 	}
-	log.Infof("Attached veth [ %s ] to bridge [ %s ]", localVethPair.Name, bridgeName)
 
+	// With several subnets, the gateway is the one of the endpoint's subnet
 	// SrcName gets renamed to DstPrefix + ID on the container iface
-	res := &dknet.JoinResponse{
+	res := &JoinResponse{
 		InterfaceName: dknet.InterfaceName{
 			SrcName:   localVethPair.PeerName,
 			DstPrefix: containerEthName,
 		},
-		Gateway: d.networks[r.NetworkID].Gateway,
+		Gateway:      ns.gatewayFor(ep.Address, ns.Gateway),
+		GatewayIPv6:  ns.gatewayFor(ep.AddressIPv6, ns.GatewayIPv6),
+		StaticRoutes: ns.staticRoutes(ep),
 	}
 	log.Debugf("Join endpoint %s:%s to %s", r.NetworkID, r.EndpointID, r.SandboxKey)
 	return res, nil
 }
 
+// attachVeth sets up a new veth pair of an endpoint and attaches it to the
+// bridge of its network
+func (d *Driver) attachVeth(r *dknet.JoinRequest, ns *NetworkState, ep endpoint, localVethPair *netlink.Veth, mac net.HardwareAddr) error {
+	if mac != nil {
+		if err := d.setMAC(localVethPair.PeerName, mac); err != nil {
+			log.Errorf("failed to set the MAC of [ %s ] to %s: %s", localVethPair.PeerName, mac, err)
+			return err
+		}
+	}
+	// Bring the veth pair up
+	err := d.links.LinkSetUp(localVethPair)
+	if err != nil {
+		log.Warnf("Error enabling  Veth local iface: [ %v ]", localVethPair)
+		return err
+	}
+	bridgeName := ns.BridgeName
+	externalIDs := map[string]string{
+		externalIDNetwork:  r.NetworkID,
+		externalIDEndpoint: r.EndpointID,
+	}
+	if ep.Address != "" {
+		externalIDs[externalIDAddress] = ep.Address
+	}
+	if ep.AddressIPv6 != "" {
+		externalIDs[externalIDAddressIPv6] = ep.AddressIPv6
+	}
+	err = d.addOvsVethPort(bridgeName, localVethPair.Name, ns.VLAN, externalIDs)
+	if err != nil {
+		log.Errorf("error attaching veth [ %s ] to bridge [ %s ]", localVethPair.Name, bridgeName)
+		return err
+	}
+	log.Infof("Attached veth [ %s ] to bridge [ %s ]", localVethPair.Name, bridgeName)
+	return nil
+}
+
 func (d *Driver) Leave(r *dknet.LeaveRequest) error {
 	log.Debugf("Leave request: %+v", r)
-	localVethPair := vethPair(truncateID(r.EndpointID))
-	if err := netlink.LinkDel(localVethPair); err != nil {
-		log.Errorf("unable to delete veth on leave: %s", err)
-	}
-	portID := fmt.Sprintf(ovsPortPrefix + truncateID(r.EndpointID))
-	bridgeName := d.networks[r.NetworkID].BridgeName
-	err := d.ovsdber.deletePort(bridgeName, portID)
+	ns, err := d.rlockNetwork(r.NetworkID)
 	if err != nil {
-		log.Errorf("OVS port [ %s ] delete transaction failed on bridge [ %s ] due to: %s", portID, bridgeName, err)
 		return err
 	}
-	log.Infof("Deleted OVS port [ %s ] from bridge [ %s ]", portID, bridgeName)
+	defer ns.lock.RUnlock()
+	if err := d.removeEndpoint(ns, r.EndpointID); err != nil {
+		return err
+	}
 	log.Debugf("Leave %s:%s", r.NetworkID, r.EndpointID)
 	return nil
 }
 
-func NewDriver() (*Driver, error) {
+func NewDriver(config Config) (*Driver, error) {
 	docker, err := dockerclient.NewDockerClient("unix:///var/run/docker.sock", nil)
 	if err != nil {
 		return nil, fmt.Errorf("could not connect to docker: %s", err)
@@ -209,16 +618,414 @@ func NewDriver() (*Driver, error) {
 		dockerer: dockerer{
 			client: docker,
 		},
-		ovsdber: ovsdber{
+		ovsdber: &ovsdber{
 			ovsdb: ovsdb,
+			cache: newOvsCache(),
+		},
+		links:     netlinker{},
+		addrs:     netlinker{},
+		firewall:  iptablesFirewall{},
+		firewall6: ip6tablesFirewall{},
+		sysctl:    procSysctl{},
+		store: networkStore{
+			path: defaultStateFile,
 		},
-		networks: make(map[string]*NetworkState),
+		gc: garbageCollector{
+			interval:   config.GCInterval,
+			reportOnly: config.GCReportOnly,
+		},
+		scope: config.Scope,
+	}
+	if d.scope == "" {
+		d.scope = ScopeLocal
+	}
+	if d.scope != ScopeLocal && d.scope != ScopeGlobal {
+		return nil, fmt.Errorf("scope must be %s or %s, got %s", ScopeLocal, ScopeGlobal, d.scope)
+	}
+	d.ovsdber.reconnected = d.verifyBridges
+	// Reload networks created before the plugin was restarted
+	d.networks, err = d.store.load()
+	if err != nil {
+		return nil, fmt.Errorf("could not load network state from %s: %s", d.store.path, err)
+	}
+	log.Debugf("Loaded %d network(s) from %s", len(d.networks), d.store.path)
+	d.ipam, err = newIPAM(defaultIPAMStateFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load IPAM state from %s: %s", defaultIPAMStateFile, err)
 	}
 	// Initialize ovsdb cache at rpc connection setup
 	d.ovsdber.initDBCache()
+	// OVSDB is the source of truth for any bridge tagged with a network ID
+	for id, ns := range d.ovsdber.networksFromCache() {
+		log.Debugf("Restored network %s on bridge %s from OVSDB", id, ns.BridgeName)
+		d.networks[id] = ns
+	}
+	d.uplinks = d.ovsdber.uplinksFromCache()
+	for id, ns := range d.networks {
+		// Uplinks bound before their ports recorded the binding
+		if _, ok := d.uplinks[ns.BridgeName]; !ok && ns.Mode == modeFlat && ns.FlatBindInterface != "" {
+			d.uplinks[ns.BridgeName] = uplinkBinding{Interface: ns.FlatBindInterface, Network: id, Migrated: ns.FlatMigrate}
+		}
+	}
+	// Addresses on OVS ports are in use whatever the IPAM state file says
+	d.ipam.reconcile(d.ovsdber.endpointAddresses())
+	// Clean up after endpoints that were never left
+	d.runGC()
+	// Clean up after containers that go away without a Leave
+	go d.watchEvents()
+	// Follow edits of the peer lists of overlay networks
+	go d.watchPeers(d.cache.subscribe("Bridge"), d.cache.subscribe("Port"))
 	return d, nil
 }
 
+// getNetwork returns the state of a network created by this driver
+func (d *Driver) getNetwork(id string) (*NetworkState, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	ns, ok := d.networks[id]
+	if !ok {
+		return nil, fmt.Errorf("network %s not found", id)
+	}
+	return ns, nil
+}
+
+// rlockNetwork returns a network with its lock held for reading so that it
+// cannot be deleted while in use. The caller must release ns.lock.
+func (d *Driver) rlockNetwork(id string) (*NetworkState, error) {
+	ns, err := d.getNetwork(id)
+	if err != nil {
+		return nil, err
+	}
+	ns.lock.RLock()
+	if ns.deleted {
+		ns.lock.RUnlock()
+		return nil, fmt.Errorf("network %s not found", id)
+	}
+	return ns, nil
+}
+
+// lockNetwork returns a network with its lock held for writing. The caller
+// must release ns.lock.
+func (d *Driver) lockNetwork(id string) (*NetworkState, error) {
+	ns, err := d.getNetwork(id)
+	if err != nil {
+		return nil, err
+	}
+	ns.lock.Lock()
+	if ns.deleted {
+		ns.lock.Unlock()
+		return nil, fmt.Errorf("network %s not found", id)
+	}
+	return ns, nil
+}
+
+// addNetwork registers a new network, failing if the ID is already in use
+func (d *Driver) addNetwork(id string, ns *NetworkState) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.networks[id]; ok {
+		return fmt.Errorf("network %s already exists", id)
+	}
+	// Untagged traffic would reach every VLAN of a shared bridge
+	for other, o := range d.networks {
+		if o.BridgeName != ns.BridgeName {
+			continue
+		}
+		switch {
+		case ns.VLAN == 0:
+			return fmt.Errorf("bridge %s is already used by network %s, an untagged network needs a bridge of its own", ns.BridgeName, other)
+		case o.VLAN == 0:
+			return fmt.Errorf("bridge %s is used by untagged network %s, it cannot be shared", ns.BridgeName, other)
+		case o.VLAN == ns.VLAN:
+			return fmt.Errorf("VLAN %d is already used by network %s on bridge %s", ns.VLAN, other, ns.BridgeName)
+		case ns.Mode == modeInternal && o.FlatBindInterface != "":
+			return fmt.Errorf("bridge %s has the uplink of network %s, an internal network needs a bridge without one", ns.BridgeName, other)
+		case o.Mode == modeInternal && ns.FlatBindInterface != "":
+			return fmt.Errorf("bridge %s is used by internal network %s, it cannot have an uplink", ns.BridgeName, other)
+		}
+	}
+	// The uplink outlives the network that bound it
+	if _, ok := d.uplinks[ns.BridgeName]; ok && ns.Mode == modeInternal {
+		return fmt.Errorf("bridge %s has an uplink, an internal network needs a bridge without one", ns.BridgeName)
+	}
+	d.networks[id] = ns
+	return nil
+}
+
+// recreateNetwork brings an existing network in line with a repeated create
+// request, building anything that is missing. The request may only change the
+// peers of an overlay network.
+func (d *Driver) recreateNetwork(id string, ns *NetworkState, peerID string) error {
+	existing, err := d.lockNetwork(id)
+	if err != nil {
+		return err
+	}
+	defer existing.lock.Unlock()
+	if len(existing.Subnets) == 0 {
+		// Saved before every subnet of a network was kept
+		existing.Subnets = ns.Subnets
+	}
+	if !existing.sameSettings(ns) {
+		return fmt.Errorf("network %s already exists with different settings", id)
+	}
+	existing.OverlayPeers = ns.OverlayPeers
+	log.Debugf("Network %s already exists, verifying its bridge", id)
+	if err := d.initBridge(id); err != nil {
+		return err
+	}
+	if err := d.updateTrunks(existing.BridgeName, d.bridgeUplink(existing.BridgeName)); err != nil {
+		return err
+	}
+	if peerID != "" {
+		if _, _, ok := d.ovsdber.cache.portByName(patchPortName(id, peerID)); !ok {
+			if err := d.peerOnCreate(id, existing, peerID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sameSettings reports whether two states describe the same network, apart
+// from the peers of an overlay network
+func (ns *NetworkState) sameSettings(o *NetworkState) bool {
+	return ns.BridgeName == o.BridgeName && ns.MTU == o.MTU && ns.Mode == o.Mode &&
+		ns.Gateway == o.Gateway && ns.GatewayMask == o.GatewayMask &&
+		ns.GatewayIPv6 == o.GatewayIPv6 && ns.GatewayIPv6Mask == o.GatewayIPv6Mask &&
+		sameSubnets(ns.Subnets, o.Subnets) &&
+		strings.Join(ns.HostAddresses, ",") == strings.Join(o.HostAddresses, ",") &&
+		formatDevices(ns.Devices) == formatDevices(o.Devices) &&
+		ns.FlatBindInterface == o.FlatBindInterface && ns.FlatMigrate == o.FlatMigrate &&
+		ns.VLAN == o.VLAN && ns.VNI == o.VNI && ns.DstPort == o.DstPort &&
+		ns.TunnelType == o.TunnelType && ns.TunnelTOS == o.TunnelTOS &&
+		ns.TunnelTTL == o.TunnelTTL && ns.TunnelCsum == o.TunnelCsum &&
+		ns.ProxyARPInterface == o.ProxyARPInterface && ns.MACPrefix == o.MACPrefix &&
+		formatRoutes(ns.StaticRoutes) == formatRoutes(o.StaticRoutes)
+}
+
+// bridgeShared reports whether a network other than id uses a bridge
+func (d *Driver) bridgeShared(id string, bridgeName string) bool {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	for other, ns := range d.networks {
+		if other != id && ns.BridgeName == bridgeName {
+			return true
+		}
+	}
+	return false
+}
+
+// removeNetwork unregisters a network. The caller must hold ns.lock for
+// writing so that requests waiting on the network see it is gone.
+func (d *Driver) removeNetwork(id string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if ns, ok := d.networks[id]; ok {
+		ns.deleted = true
+		delete(d.networks, id)
+	}
+}
+
+// saveNetworks writes the state of every network to the state file. Each
+// network is read under its lock, so the caller must not hold any.
+func (d *Driver) saveNetworks() {
+	// A save started after a change must not be overtaken by an older one
+	d.saveLock.Lock()
+	defer d.saveLock.Unlock()
+	d.lock.RLock()
+	networks := make(map[string]*NetworkState, len(d.networks))
+	for id, ns := range d.networks {
+		networks[id] = ns
+	}
+	d.lock.RUnlock()
+
+	snapshot := make(map[string]json.RawMessage, len(networks))
+	for id, ns := range networks {
+		ns.lock.RLock()
+		if !ns.deleted {
+			data, err := json.Marshal(ns)
+			if err != nil {
+				ns.lock.RUnlock()
+				log.Errorf("Could not save network state: %s", err)
+				return
+			}
+			snapshot[id] = data
+		}
+		ns.lock.RUnlock()
+	}
+	if err := d.store.save(snapshot); err != nil {
+		log.Errorf("Could not save network state: %s", err)
+	}
+}
+
+// networkExternalIDs returns the external_ids used to tag the OVSDB rows of a network
+func networkExternalIDs(id string, ns *NetworkState) map[string]string {
+	externalIDs := map[string]string{
+		externalIDNetwork: id,
+		externalIDMode:    ns.Mode,
+		externalIDMTU:     strconv.Itoa(ns.MTU),
+	}
+	if ns.Gateway != "" {
+		externalIDs[externalIDGateway] = ns.Gateway + "/" + ns.GatewayMask
+	}
+	if ns.GatewayIPv6 != "" {
+		externalIDs[externalIDGatewayIPv6] = ns.GatewayIPv6 + "/" + ns.GatewayIPv6Mask
+	}
+	if len(ns.Subnets) > 0 {
+		externalIDs[externalIDSubnets] = formatSubnets(ns.Subnets)
+	}
+	if len(ns.HostAddresses) > 0 {
+		externalIDs[externalIDHostAddresses] = strings.Join(ns.HostAddresses, ",")
+	}
+	if len(ns.Devices) > 0 {
+		externalIDs[externalIDDevices] = formatDevices(ns.Devices)
+	}
+	if ns.FlatBindInterface != "" {
+		externalIDs[externalIDBindInterface] = ns.FlatBindInterface
+	}
+	if ns.FlatMigrate {
+		externalIDs[externalIDMigrate] = "true"
+	}
+	if ns.VLAN != 0 {
+		externalIDs[externalIDVLAN] = strconv.Itoa(int(ns.VLAN))
+	}
+	if ns.ProxyARPInterface != "" {
+		externalIDs[externalIDProxyARP] = ns.ProxyARPInterface
+	}
+	if ns.MACPrefix != "" {
+		externalIDs[externalIDMACPrefix] = ns.MACPrefix
+	}
+	if len(ns.StaticRoutes) > 0 {
+		externalIDs[externalIDStaticRoutes] = formatRoutes(ns.StaticRoutes)
+	}
+	if ns.Mode == modeOverlay {
+		externalIDs[externalIDPeers] = strings.Join(ns.OverlayPeers, ",")
+		externalIDs[externalIDVNI] = strconv.Itoa(int(ns.VNI))
+		externalIDs[externalIDDstPort] = strconv.Itoa(ns.DstPort)
+		externalIDs[externalIDTunnelType] = ns.TunnelType
+		if ns.TunnelTOS != "" {
+			externalIDs[externalIDTOS] = ns.TunnelTOS
+		}
+		if ns.TunnelTTL != "" {
+			externalIDs[externalIDTTL] = ns.TunnelTTL
+		}
+		if ns.TunnelCsum {
+			externalIDs[externalIDCsum] = "true"
+		}
+	}
+	return externalIDs
+}
+
+// networkStateFromExternalIDs is the reverse of networkExternalIDs. It returns
+// an empty ID if the row was not created for a docker network.
+func networkStateFromExternalIDs(bridgeName string, externalIDs map[string]string) (string, *NetworkState, error) {
+	id, ok := externalIDs[externalIDNetwork]
+	if !ok || id == "" {
+		return "", nil, nil
+	}
+	mtu, err := strconv.Atoi(externalIDs[externalIDMTU])
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid MTU for network %s: %s", id, err)
+	}
+	ns := &NetworkState{
+		BridgeName:        bridgeName,
+		MTU:               mtu,
+		Mode:              externalIDs[externalIDMode],
+		FlatBindInterface: externalIDs[externalIDBindInterface],
+		FlatMigrate:       externalIDs[externalIDMigrate] == "true",
+		ProxyARPInterface: externalIDs[externalIDProxyARP],
+		MACPrefix:         externalIDs[externalIDMACPrefix],
+	}
+	if vlan := externalIDs[externalIDVLAN]; vlan != "" {
+		tag, err := strconv.Atoi(vlan)
+		if err != nil || tag < minVLAN || tag > maxVLAN {
+			return "", nil, fmt.Errorf("invalid VLAN %s for network %s", vlan, id)
+		}
+		ns.VLAN = uint(tag)
+	}
+	if ns.Mode == modeOverlay {
+		peers, err := parsePeers(externalIDs[externalIDPeers])
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid peers for network %s: %s", id, err)
+		}
+		vni, err := strconv.Atoi(externalIDs[externalIDVNI])
+		if err != nil || vni < 0 || vni > maxVNI {
+			return "", nil, fmt.Errorf("invalid VNI %s for network %s", externalIDs[externalIDVNI], id)
+		}
+		dstPort, err := strconv.Atoi(externalIDs[externalIDDstPort])
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid destination port for network %s: %s", id, err)
+		}
+		ns.OverlayPeers, ns.VNI, ns.DstPort = peers, uint(vni), dstPort
+		// Networks created before tunnel types were added use VXLAN
+		ns.TunnelType = externalIDs[externalIDTunnelType]
+		if ns.TunnelType == "" {
+			ns.TunnelType = tunnelVXLAN
+		}
+		if _, ok := tunnelOverheads[ns.TunnelType]; !ok {
+			return "", nil, fmt.Errorf("invalid tunnel type %s for network %s", ns.TunnelType, id)
+		}
+		ns.TunnelTOS, ns.TunnelTTL = externalIDs[externalIDTOS], externalIDs[externalIDTTL]
+		ns.TunnelCsum = externalIDs[externalIDCsum] == "true"
+	}
+	if gateway := externalIDs[externalIDGateway]; gateway != "" {
+		parts := strings.Split(gateway, "/")
+		if len(parts) != 2 {
+			return "", nil, fmt.Errorf("invalid gateway %s for network %s", gateway, id)
+		}
+		ns.Gateway, ns.GatewayMask = parts[0], parts[1]
+	}
+	if gateway := externalIDs[externalIDGatewayIPv6]; gateway != "" {
+		parts := strings.Split(gateway, "/")
+		if len(parts) != 2 {
+			return "", nil, fmt.Errorf("invalid IPv6 gateway %s for network %s", gateway, id)
+		}
+		ns.GatewayIPv6, ns.GatewayIPv6Mask = parts[0], parts[1]
+	}
+	subnets, err := parseSubnets(externalIDs[externalIDSubnets])
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid subnets for network %s: %s", id, err)
+	}
+	ns.Subnets = subnets
+	ns.HostAddresses = splitList(externalIDs[externalIDHostAddresses])
+	if ns.Devices, err = parseDevices(externalIDs[externalIDDevices]); err != nil {
+		return "", nil, fmt.Errorf("invalid devices for network %s: %s", id, err)
+	}
+	if ns.StaticRoutes, err = parseRoutes(externalIDs[externalIDStaticRoutes]); err != nil {
+		return "", nil, fmt.Errorf("invalid static routes for network %s: %s", id, err)
+	}
+	return id, ns, nil
+}
+
+// removeEndpoint deletes the veth and the OVS port of an endpoint. The
+// network must be locked for reading.
+func (d *Driver) removeEndpoint(ns *NetworkState, endpointID string) error {
+	localVethPair := vethPair(truncateID(endpointID))
+	if err := d.links.LinkDel(localVethPair); err != nil {
+		log.Errorf("unable to delete veth on leave: %s", err)
+	}
+	portID := ovsPortPrefix + truncateID(endpointID)
+	bridgeName := ns.BridgeName
+	err := d.ovsdber.deletePort(bridgeName, portID)
+	if isNotFound(err) {
+		// The docker events watcher may have cleaned up first
+		log.Debugf("OVS port [ %s ] is already gone from bridge [ %s ]", portID, bridgeName)
+		return nil
+	}
+	if err != nil {
+		log.Errorf("OVS port [ %s ] delete transaction failed on bridge [ %s ] due to: %s", portID, bridgeName, err)
+		return err
+	}
+	log.Infof("Deleted OVS port [ %s ] from bridge [ %s ]", portID, bridgeName)
+	return nil
+}
+
+// gatewayPortName returns the name of the internal port a tagged network
+// uses as its gateway on a shared bridge
+func gatewayPortName(id string) string {
+	return gatewayPortPrefix + truncateID(id)
+}
+
 // Create veth pair. Peername is renamed to eth0 in the container
 func vethPair(suffix string) *netlink.Veth {
 	return &netlink.Veth{
@@ -228,33 +1035,63 @@ func vethPair(suffix string) *netlink.Veth {
 }
 
 // Enable a netlink interface
-func interfaceUp(name string) error {
-	iface, err := netlink.LinkByName(name)
+func (d *Driver) interfaceUp(name string) error {
+	iface, err := d.links.LinkByName(name)
 	if err != nil {
-		log.Debugf("Error retrieving a link named [ %s ]", iface.Attrs().Name)
+		log.Debugf("Error retrieving a link named [ %s ]", name)
 		return err
 	}
-	return netlink.LinkSetUp(iface)
+	return d.links.LinkSetUp(iface)
 }
 
 func truncateID(id string) string {
 	return id[:5]
 }
 
+// getOption returns a driver option of a network. Options given to docker
+// network create with -o arrive in the generic options map.
+func getOption(r *dknet.CreateNetworkRequest, name string) (interface{}, bool) {
+	if r.Options == nil {
+		return nil, false
+	}
+	if generic, ok := r.Options[genericOption].(map[string]interface{}); ok {
+		if value, ok := generic[name]; ok {
+			return value, true
+		}
+	}
+	value, ok := r.Options[name]
+	return value, ok
+}
+
+// intOption converts an option given as a number or a string to an int
+func intOption(value interface{}) (int, error) {
+	switch v := value.(type) {
+	case int:
+		return v, nil
+	case float64:
+		return int(v), nil
+	case string:
+		return strconv.Atoi(v)
+	}
+	return 0, fmt.Errorf("%v is not a number", value)
+}
+
 func getBridgeMTU(r *dknet.CreateNetworkRequest) (int, error) {
 	bridgeMTU := defaultMTU
-	if r.Options != nil {
-		if mtu, ok := r.Options[mtuOption].(int); ok {
-			bridgeMTU = mtu
+	if value, ok := getOption(r, mtuOption); ok {
+		mtu, err := intOption(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s: %s", mtuOption, err)
 		}
+		bridgeMTU = mtu
 	}
 	return bridgeMTU, nil
 }
 
 func getBridgeName(r *dknet.CreateNetworkRequest) (string, error) {
 	bridgeName := bridgePrefix + truncateID(r.NetworkID)
-	if r.Options != nil {
-		if name, ok := r.Options[bridgeNameOption].(string); ok {
+	if name, ok := getOption(r, bridgeNameOption); ok {
+		if name, ok := name.(string); ok {
 			bridgeName = name
 		}
 	}
@@ -263,8 +1100,8 @@ func getBridgeName(r *dknet.CreateNetworkRequest) (string, error) {
 
 func getBridgeMode(r *dknet.CreateNetworkRequest) (string, error) {
 	bridgeMode := defaultMode
-	if r.Options != nil {
-		if mode, ok := r.Options[modeOption].(string); ok {
+	if mode, ok := getOption(r, modeOption); ok {
+		if mode, ok := mode.(string); ok {
 			if _, isValid := validModes[mode]; !isValid {
 				return "", fmt.Errorf("%s is not a valid mode", mode)
 			}
@@ -274,49 +1111,225 @@ func getBridgeMode(r *dknet.CreateNetworkRequest) (string, error) {
 	return bridgeMode, nil
 }
 
-func getGatewayIP(r *dknet.CreateNetworkRequest) (string, string, error) {
-	// FIXME: Dear future self, I'm sorry for leaving you with this mess, but I want to get this working ASAP
-	// This should be an array
-	// We need to handle case where we have
-	// a. v6 and v4 - dual stack
-	// auxilliary address
-	// multiple subnets on one network
-	// also in that case, we'll need a function to determine the correct default gateway based on it's IP/Mask
-	var gatewayIP string
-
-	if len(r.IPv6Data) > 0 {
-		if r.IPv6Data[0] != nil {
-			if r.IPv6Data[0].Gateway != "" {
-				gatewayIP = r.IPv6Data[0].Gateway
-			}
+// getInternal returns the mode of a network docker created with --internal,
+// which has to be internal mode
+func getInternal(r *dknet.CreateNetworkRequest, mode string) (string, error) {
+	value, ok := getOption(r, internalOption)
+	if !ok {
+		return mode, nil
+	}
+	internal, ok := value.(bool)
+	if s, isString := value.(string); isString {
+		b, err := strconv.ParseBool(s)
+		internal, ok = b, err == nil
+	}
+	if !ok {
+		return "", fmt.Errorf("%s must be true or false, got %v", internalOption, value)
+	}
+	if !internal {
+		return mode, nil
+	}
+	// The default mode gives way, an explicit one has to agree
+	if _, explicit := getOption(r, modeOption); explicit && mode != modeInternal {
+		return "", fmt.Errorf("internal networks cannot use %s mode", mode)
+	}
+	return modeInternal, nil
+}
+
+// getVLAN returns the access VLAN of the network's ports, zero if untagged
+func getVLAN(r *dknet.CreateNetworkRequest) (uint, error) {
+	value, ok := getOption(r, vlanOption)
+	if !ok {
+		return 0, nil
+	}
+	vlan, err := intOption(value)
+	if err != nil || vlan < minVLAN || vlan > maxVLAN {
+		return 0, fmt.Errorf("%s must be between %d and %d, got %v", vlanOption, minVLAN, maxVLAN, value)
+	}
+	return uint(vlan), nil
+}
+
+// getOverlayPeers returns the VTEP addresses an overlay network tunnels to,
+// given as a comma separated list
+func getOverlayPeers(r *dknet.CreateNetworkRequest) ([]string, error) {
+	value, ok := getOption(r, peersOption)
+	if !ok {
+		return nil, nil
+	}
+	peers, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a comma separated list of addresses, got %v", peersOption, value)
+	}
+	list, err := parsePeers(peers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", peersOption, err)
+	}
+	return list, nil
+}
+
+// getVNI returns the VXLAN network identifier of an overlay network. There is
+// no default, the hosts of a network only reach each other if they agree on it.
+func getVNI(r *dknet.CreateNetworkRequest, mode string) (uint, error) {
+	value, ok := getOption(r, vniOption)
+	if !ok {
+		if mode == modeOverlay {
+			return 0, fmt.Errorf("overlay networks need a %s, the same on every host", vniOption)
 		}
+		return 0, nil
 	}
-	// Assumption: IPAM will provide either IPv4 OR IPv6 but not both
-	// We may want to modify this in future to support dual stack
-	if len(r.IPv4Data) > 0 {
-		if r.IPv4Data[0] != nil {
-			if r.IPv4Data[0].Gateway != "" {
-				gatewayIP = r.IPv4Data[0].Gateway
-			}
+	vni, err := intOption(value)
+	if err != nil || vni < 0 || vni > maxVNI {
+		return 0, fmt.Errorf("%s must be between 0 and %d, got %v", vniOption, maxVNI, value)
+	}
+	return uint(vni), nil
+}
+
+// getTunnelType returns the encapsulation of the tunnels of an overlay network
+func getTunnelType(r *dknet.CreateNetworkRequest) (string, error) {
+	value, ok := getOption(r, tunnelTypeOption)
+	if !ok {
+		return tunnelVXLAN, nil
+	}
+	tunnelType, _ := value.(string)
+	if _, ok := tunnelOverheads[tunnelType]; !ok {
+		return "", fmt.Errorf("%s must be one of vxlan, gre or geneve, got %v", tunnelTypeOption, value)
+	}
+	return tunnelType, nil
+}
+
+// getDstPort returns the UDP port the tunnels of an overlay network use,
+// zero for GRE which does not run over UDP
+func getDstPort(r *dknet.CreateNetworkRequest, tunnelType string) (int, error) {
+	value, ok := getOption(r, dstPortOption)
+	if !ok {
+		return defaultDstPorts[tunnelType], nil
+	}
+	if tunnelType == tunnelGRE {
+		return 0, fmt.Errorf("%s does not apply to gre tunnels", dstPortOption)
+	}
+	port, err := intOption(value)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("%s must be between 1 and 65535, got %v", dstPortOption, value)
+	}
+	return port, nil
+}
+
+// getTunnelOptions returns the TOS, TTL and checksum settings of the tunnels
+// of an overlay network. TOS and TTL are a number or inherit.
+func getTunnelOptions(r *dknet.CreateNetworkRequest) (string, string, bool, error) {
+	var settings [2]string
+	for i, name := range []string{tosOption, ttlOption} {
+		value, ok := getOption(r, name)
+		if !ok {
+			continue
+		}
+		if value == "inherit" {
+			settings[i] = "inherit"
+			continue
+		}
+		n, err := intOption(value)
+		if err != nil || n < 0 || n > 255 {
+			return "", "", false, fmt.Errorf("%s must be between 0 and 255 or inherit, got %v", name, value)
 		}
+		settings[i] = strconv.Itoa(n)
 	}
+	value, _ := getOption(r, csumOption)
+	csum := false
+	switch v := value.(type) {
+	case bool:
+		csum = v
+	case string:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return "", "", false, fmt.Errorf("%s must be true or false, got %s", csumOption, v)
+		}
+		csum = b
+	}
+	return settings[0], settings[1], csum, nil
+}
 
-	if gatewayIP == "" {
-		return "", "", fmt.Errorf("No gateway IP found")
+// getGatewayIP returns the address and prefix length of the gateway IPAM
+// gave the first pool of an address family, empty if there is none. The
+// gateways of the other pools are in the network's Subnets.
+func getGatewayIP(data []*dknet.IPAMData) (string, string, error) {
+	if len(data) == 0 || data[0] == nil || data[0].Gateway == "" {
+		return "", "", nil
 	}
-	parts := strings.Split(gatewayIP, "/")
-	if parts[0] == "" || parts[1] == "" {
+	parts := strings.Split(data[0].Gateway, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
 		return "", "", fmt.Errorf("Cannot split gateway IP address")
 	}
 	return parts[0], parts[1], nil
 }
 
 func getBindInterface(r *dknet.CreateNetworkRequest) (string, error) {
-	if r.Options != nil {
-		if mode, ok := r.Options[bindInterfaceOption].(string); ok {
+	if mode, ok := getOption(r, bindInterfaceOption); ok {
+		if mode, ok := mode.(string); ok {
 			return mode, nil
 		}
 	}
 	// As bind interface is optional and has no default, don't return an error
 	return "", nil
 }
+
+// getProxyARPInterface returns the interface a routed network answers ARP
+// requests for its addresses on
+func getProxyARPInterface(r *dknet.CreateNetworkRequest) (string, error) {
+	value, ok := getOption(r, proxyARPOption)
+	if !ok {
+		return "", nil
+	}
+	name, ok := value.(string)
+	if !ok || name == "" || strings.ContainsAny(name, "/ ") || name == "." || name == ".." {
+		return "", fmt.Errorf("%s must be an interface name, got %v", proxyARPOption, value)
+	}
+	return name, nil
+}
+
+// getMACPrefix returns the first two or three bytes of the MAC addresses of
+// a network's containers. The rest of a MAC are the last bytes of the IPv4
+// address, so they must be the only bytes the network's subnets differ in.
+func getMACPrefix(r *dknet.CreateNetworkRequest, subnets []Subnet) (string, error) {
+	value, ok := getOption(r, macPrefixOption)
+	if !ok {
+		return "", nil
+	}
+	s, _ := value.(string)
+	prefix, err := parseMACPrefix(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s %v: %s", macPrefixOption, value, err)
+	}
+	fixed := net.IPv4len - (6 - len(prefix))
+	var high []byte
+	for _, subnet := range subnets {
+		cidr := subnet.Pool
+		if cidr == "" {
+			cidr = subnet.Gateway
+		}
+		_, pool, err := net.ParseCIDR(cidr)
+		if err != nil || pool.IP.To4() == nil {
+			continue
+		}
+		ones, _ := pool.Mask.Size()
+		if ones < fixed*8 || (high != nil && !bytes.Equal(high, pool.IP.To4()[:fixed])) {
+			return "", fmt.Errorf("invalid %s %s: the MAC addresses of the network would only hold the last %d bytes of their IPv4 addresses", macPrefixOption, prefix, net.IPv4len-fixed)
+		}
+		high = pool.IP.To4()[:fixed]
+	}
+	return prefix.String(), nil
+}
+
+func getMigrate(r *dknet.CreateNetworkRequest) (bool, error) {
+	value, _ := getOption(r, migrateOption)
+	switch migrate := value.(type) {
+	case bool:
+		return migrate, nil
+	case string:
+		b, err := strconv.ParseBool(migrate)
+		if err != nil {
+			return false, fmt.Errorf("%s must be true or false, got %s", migrateOption, migrate)
+		}
+		return b, nil
+	}
+	return false, nil
+}
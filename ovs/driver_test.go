@@ -0,0 +1,669 @@
+package ovs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gopher-net/dknet"
+)
+
+func newTestDriver(t *testing.T) (*Driver, func()) {
+	dir, err := ioutil.TempDir("", "ovs-driver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, o := newTestOvsdb(t)
+	links := newFakeLinker(s)
+	d := &Driver{
+		ovsdber:   o,
+		links:     links,
+		addrs:     links,
+		firewall:  newFakeFirewall(),
+		firewall6: newFakeFirewall(),
+		sysctl:    newFakeSysctl(),
+		networks:  make(map[string]*NetworkState),
+		uplinks:   make(map[string]uplinkBinding),
+		store: networkStore{
+			path: filepath.Join(dir, "networks.json"),
+		},
+		ipam: &ipam{
+			pools: make(map[string]*ipamPool),
+			path:  filepath.Join(dir, "ipam.json"),
+		},
+	}
+	return d, func() { os.RemoveAll(dir) }
+}
+
+func expectRecorded(t *testing.T, r *recorder, expected ...string) {
+	got := r.recorded()
+	if len(got) != len(expected) {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("expected %q, got %q", expected, got)
+		}
+	}
+}
+
+func createTestNetwork(t *testing.T, d *Driver) (string, *NetworkState) {
+	id, _ := testNetwork()
+	err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+		NetworkID: id,
+		IPv4Data:  []*dknet.IPAMData{{Pool: "172.18.40.0/24", Gateway: "172.18.40.1/24"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, err := d.getNetwork(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, ns
+}
+
+// createModeNetwork creates a network of a mode on the subnet of a gateway,
+// with options passed the way docker passes -o options
+func createModeNetwork(t *testing.T, d *Driver, mode string, gateway string, options map[string]interface{}) string {
+	id, _ := testNetwork()
+	options[modeOption] = mode
+	_, subnet, err := net.ParseCIDR(gateway)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.CreateNetwork(&dknet.CreateNetworkRequest{
+		NetworkID: id,
+		Options:   map[string]interface{}{genericOption: options},
+		IPv4Data:  []*dknet.IPAMData{{Pool: subnet.String(), Gateway: gateway}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestCreateNetwork(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	links := d.links.(*fakeLinker)
+	firewall := d.firewall.(*fakeFirewall)
+
+	id, ns := createTestNetwork(t, d)
+	if ns.BridgeName != "ovsbr-01234" || ns.Gateway != "172.18.40.1" || ns.GatewayMask != "24" {
+		t.Fatalf("unexpected network state %+v", ns)
+	}
+	expectRecorded(t, &links.recorder,
+		"addr add ovsbr-01234 172.18.40.1/24",
+		"up ovsbr-01234")
+	expectRecorded(t, &firewall.recorder,
+		"insert nat POSTROUTING -s 172.18.40.1/24 -j MASQUERADE")
+
+	_, bridge, ok := sharedOvsdb.rowByName("Bridge", ns.BridgeName)
+	if !ok {
+		t.Fatalf("bridge %s was not created", ns.BridgeName)
+	}
+	if fakeMap(bridge, "external_ids")[externalIDNetwork] != id {
+		t.Fatalf("bridge not tagged with its network: %v", bridge)
+	}
+	saved, err := d.store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := saved[id]; !ok {
+		t.Fatal("network was not saved")
+	}
+
+	err = d.CreateNetwork(&dknet.CreateNetworkRequest{
+		NetworkID: id,
+		IPv4Data:  []*dknet.IPAMData{{Pool: "172.18.40.0/24", Gateway: "172.18.40.1/24"}},
+	})
+	if err == nil {
+		t.Fatal("expected creating a network twice to fail")
+	}
+	expectRecorded(t, &links.recorder)
+	expectRecorded(t, &firewall.recorder)
+}
+
+func TestJoinLeave(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	links := d.links.(*fakeLinker)
+
+	id, ns := createTestNetwork(t, d)
+	links.recorded()
+
+	endpointID := "fedcba9876543210fedcba9876543210"
+	res, err := d.Join(&dknet.JoinRequest{NetworkID: id, EndpointID: endpointID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.InterfaceName.SrcName != "ethcfedcb" || res.InterfaceName.DstPrefix != containerEthName {
+		t.Fatalf("unexpected interface name %+v", res.InterfaceName)
+	}
+	if res.Gateway != ns.Gateway {
+		t.Fatalf("expected gateway %s, got %s", ns.Gateway, res.Gateway)
+	}
+	expectRecorded(t, &links.recorder,
+		"add veth ovs-veth0-fedcb",
+		"up ovs-veth0-fedcb")
+	_, port, ok := sharedOvsdb.rowByName("Port", "ovs-veth0-fedcb")
+	if !ok {
+		t.Fatal("veth was not attached to the bridge")
+	}
+	if fakeMap(port, "external_ids")[externalIDEndpoint] != endpointID {
+		t.Fatalf("port not tagged with its endpoint: %v", port)
+	}
+
+	waitFor(t, "the port to be cached", func() bool {
+		_, _, ok := d.cache.portByName("ovs-veth0-fedcb")
+		return ok
+	})
+	if err := d.Leave(&dknet.LeaveRequest{NetworkID: id, EndpointID: endpointID}); err != nil {
+		t.Fatal(err)
+	}
+	expectRecorded(t, &links.recorder, "del ovs-veth0-fedcb")
+	if _, _, ok := sharedOvsdb.rowByName("Port", "ovs-veth0-fedcb"); ok {
+		t.Fatal("port was not removed from the bridge")
+	}
+}
+
+func TestDeleteNetwork(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	id, ns := createTestNetwork(t, d)
+	waitFor(t, "the bridge to be cached", func() bool {
+		_, _, ok := d.cache.bridgeByName(ns.BridgeName)
+		return ok
+	})
+	if err := d.DeleteNetwork(&dknet.DeleteNetworkRequest{NetworkID: id}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := sharedOvsdb.rowByName("Bridge", ns.BridgeName); ok {
+		t.Fatal("bridge was not deleted")
+	}
+	if _, err := d.getNetwork(id); err == nil {
+		t.Fatal("network still known after it was deleted")
+	}
+	if err := d.DeleteNetwork(&dknet.DeleteNetworkRequest{NetworkID: id}); err == nil {
+		t.Fatal("expected deleting a network twice to fail")
+	}
+}
+
+// poll is waitFor for goroutines, which cannot fail the test themselves
+func poll(cond func() bool) bool {
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// Run with -race: creating, joining, leaving and deleting one network at
+// the same time from many goroutines
+func TestConcurrentNetworkRequests(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	id, ns := testNetwork()
+	create := &dknet.CreateNetworkRequest{
+		NetworkID: id,
+		IPv4Data:  []*dknet.IPAMData{{Pool: "172.18.40.0/24", Gateway: "172.18.40.1/24"}},
+	}
+	endpoint := func(i int) string {
+		return fmt.Sprintf("%05x%027x", i, 0)
+	}
+
+	// Joins are retried until the network has been created, then left
+	const workers = 20
+	var created int32
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := d.CreateNetwork(create); err == nil {
+				atomic.AddInt32(&created, 1)
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			endpointID := endpoint(i)
+			joined := poll(func() bool {
+				_, err := d.Join(&dknet.JoinRequest{NetworkID: id, EndpointID: endpointID})
+				return err == nil
+			})
+			if !joined {
+				t.Errorf("endpoint %s never joined", endpointID)
+				return
+			}
+			cached := poll(func() bool {
+				_, _, ok := d.cache.portByName(ovsPortPrefix + truncateID(endpointID))
+				return ok
+			})
+			if !cached {
+				t.Errorf("port of endpoint %s never cached", endpointID)
+				return
+			}
+			if err := d.Leave(&dknet.LeaveRequest{NetworkID: id, EndpointID: endpointID}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if created != 1 {
+		t.Fatalf("expected the network to be created once, got %d", created)
+	}
+	if n := sharedOvsdb.count("Port"); n != 1 {
+		t.Fatalf("expected only the bridge port to be left, got %d ports", n)
+	}
+	if saved, err := d.store.load(); err != nil || saved[id] == nil {
+		t.Fatalf("network was not saved: %v", err)
+	}
+
+	// Joins racing the delete either get in first or find no network
+	var deleted int32
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := d.DeleteNetwork(&dknet.DeleteNetworkRequest{NetworkID: id}); err == nil {
+				atomic.AddInt32(&deleted, 1)
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			_, err := d.Join(&dknet.JoinRequest{NetworkID: id, EndpointID: endpoint(workers + i)})
+			if err != nil && !strings.Contains(err.Error(), "not found") {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if deleted != 1 {
+		t.Fatalf("expected the network to be deleted once, got %d", deleted)
+	}
+	if _, _, ok := sharedOvsdb.rowByName("Bridge", ns.BridgeName); ok {
+		t.Fatal("bridge was not deleted")
+	}
+	if saved, err := d.store.load(); err != nil || len(saved) != 0 {
+		t.Fatalf("expected no saved networks, got %v %v", saved, err)
+	}
+}
+
+func TestAddNetworkTwice(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	if err := d.addNetwork("network1", &NetworkState{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.addNetwork("network1", &NetworkState{}); err == nil {
+		t.Fatal("expected adding a network twice to fail")
+	}
+}
+
+func createVLANNetwork(d *Driver, id string, vlan string, gateway string) error {
+	return d.CreateNetwork(&dknet.CreateNetworkRequest{
+		NetworkID: id,
+		Options: map[string]interface{}{
+			genericOption: map[string]interface{}{
+				bridgeNameOption: "ovsbr-shared",
+				vlanOption:       vlan,
+			},
+		},
+		IPv4Data: []*dknet.IPAMData{{Gateway: gateway}},
+	})
+}
+
+func TestVLANNetworksShareBridge(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	links := d.links.(*fakeLinker)
+
+	if err := createVLANNetwork(d, "1000000000", "100", "10.100.0.1/24"); err != nil {
+		t.Fatal(err)
+	}
+	if err := createVLANNetwork(d, "2000000000", "200", "10.200.0.1/24"); err != nil {
+		t.Fatal(err)
+	}
+	expectRecorded(t, &links.recorder,
+		"addr add ovs-gw-10000 10.100.0.1/24",
+		"up ovsbr-shared",
+		"up ovs-gw-10000",
+		"addr add ovs-gw-20000 10.200.0.1/24",
+		"up ovsbr-shared",
+		"up ovs-gw-20000")
+	if s := sharedOvsdb.count("Bridge"); s != 1 {
+		t.Fatalf("expected the networks to share a bridge, got %d bridges", s)
+	}
+
+	// Each network is restored from its gateway port
+	waitFor(t, "the gateway ports to be cached", func() bool {
+		return len(d.ovsdber.networksFromCache()) == 2
+	})
+	for id, ns := range d.ovsdber.networksFromCache() {
+		if ns.BridgeName != "ovsbr-shared" || ns.VLAN == 0 || fmt.Sprintf("%d0000000", ns.VLAN) != id {
+			t.Fatalf("unexpected network %s restored from OVSDB: %+v", id, ns)
+		}
+	}
+
+	if _, err := d.Join(&dknet.JoinRequest{NetworkID: "2000000000", EndpointID: "fedcba9876543210"}); err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := sharedOvsdb.rowByName("Port", "ovs-veth0-fedcb")
+	if tag := fakeInt(port, "tag"); tag != 200 {
+		t.Fatalf("expected the container port on VLAN 200, got %d", tag)
+	}
+
+	waitFor(t, "the gateway port to be cached", func() bool {
+		_, _, ok := d.cache.portByName("ovs-gw-10000")
+		return ok
+	})
+	if err := d.DeleteNetwork(&dknet.DeleteNetworkRequest{NetworkID: "1000000000"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := sharedOvsdb.rowByName("Port", "ovs-gw-10000"); ok {
+		t.Fatal("gateway port of the deleted network was not removed")
+	}
+	if _, _, ok := sharedOvsdb.rowByName("Bridge", "ovsbr-shared"); !ok {
+		t.Fatal("bridge deleted while another network still uses it")
+	}
+}
+
+func TestVLANValidation(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	for _, vlan := range []string{"0", "4095", "blue"} {
+		if err := createVLANNetwork(d, "1000000000", vlan, "10.100.0.1/24"); err == nil {
+			t.Fatalf("expected VLAN %s to be rejected", vlan)
+		}
+	}
+	if err := createVLANNetwork(d, "1000000000", "100", "10.100.0.1/24"); err != nil {
+		t.Fatal(err)
+	}
+	if err := createVLANNetwork(d, "2000000000", "100", "10.101.0.1/24"); err == nil {
+		t.Fatal("expected a second network on VLAN 100 of the same bridge to be rejected")
+	}
+}
+
+func TestGlobalScope(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	d.scope = ScopeGlobal
+	addTestNIC(t, d.links.(*fakeLinker), "eth1")
+
+	if caps, _ := d.GetCapabilities(); caps.Scope != ScopeGlobal {
+		t.Fatalf("expected global scope, got %s", caps.Scope)
+	}
+	// Every host gets the same options, the address of this one is skipped
+	options := map[string]interface{}{peersOption: "10.1.0.5,10.1.0.6", vniOption: "7"}
+	id := createModeNetwork(t, d, modeOverlay, "10.2.0.1/24", options)
+	if _, _, ok := sharedOvsdb.rowByName("Port", "vxlan-01234-0a010005"); ok {
+		t.Fatal("tunnel added to an address of this host")
+	}
+	tunnelInterface(t, "vxlan-01234-0a010006", "vxlan")
+
+	// Creating the network again is not an error and follows the peer list
+	waitFor(t, "the tunnel to be cached", func() bool {
+		_, _, ok := d.cache.portByName("vxlan-01234-0a010006")
+		return ok
+	})
+	createModeNetwork(t, d, modeOverlay, "10.2.0.1/24", map[string]interface{}{peersOption: "10.1.0.5,10.1.0.7", vniOption: "7"})
+	tunnelInterface(t, "vxlan-01234-0a010007", "vxlan")
+	if _, _, ok := sharedOvsdb.rowByName("Port", "vxlan-01234-0a010006"); ok {
+		t.Fatal("tunnel to a removed peer was kept")
+	}
+	err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+		NetworkID: id,
+		Options:   map[string]interface{}{modeOption: modeOverlay, vniOption: "8"},
+		IPv4Data:  []*dknet.IPAMData{{Gateway: "10.2.0.1/24"}},
+	})
+	if err == nil {
+		t.Fatal("expected a create with a different VNI to fail")
+	}
+
+	waitFor(t, "the bridge to be cached", func() bool {
+		_, _, ok := d.cache.bridgeByName("ovsbr-01234")
+		return ok
+	})
+	if err := d.DeleteNetwork(&dknet.DeleteNetworkRequest{NetworkID: id}); err != nil {
+		t.Fatal(err)
+	}
+	// Docker deletes a global network on hosts that never created it too
+	if err := d.DeleteNetwork(&dknet.DeleteNetworkRequest{NetworkID: id}); err != nil {
+		t.Fatalf("expected deleting a network unknown to this host to succeed: %s", err)
+	}
+}
+
+func TestGlobalRecreate(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	defer protectPorts(t, d.ovsdber)()
+	d.scope = ScopeGlobal
+
+	options := func() map[string]interface{} {
+		return map[string]interface{}{peersOption: "10.0.0.2,10.0.0.3", vlanOption: "10", vniOption: "10"}
+	}
+	createModeNetwork(t, d, modeOverlay, "10.2.0.1/24", options())
+	ports := sharedOvsdb.count("Port")
+	// Straight away, before the cache has the rows: the gateway port and
+	// tunnels are found to exist by the inserts ovsdb-server rejects
+	createModeNetwork(t, d, modeOverlay, "10.2.0.1/24", options())
+	if n := sharedOvsdb.count("Port"); n != ports {
+		t.Fatalf("expected %d ports after a repeated create, got %d", ports, n)
+	}
+
+	// Anything missing is built again
+	if err := d.ovsdber.deletePort("ovsbr-01234", "vxlan-01234-0a000003"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ovsdber.deletePort("ovsbr-01234", gatewayPortName("0123456789abcdef0123456789abcdef")); err != nil {
+		t.Fatal(err)
+	}
+	createModeNetwork(t, d, modeOverlay, "10.2.0.1/24", options())
+	if n := sharedOvsdb.count("Port"); n != ports {
+		t.Fatalf("expected %d ports after rebuilding the network, got %d", ports, n)
+	}
+	tunnelInterface(t, "vxlan-01234-0a000003", "vxlan")
+	if _, port, ok := sharedOvsdb.rowByName("Port", gatewayPortName("0123456789abcdef0123456789abcdef")); !ok || fakeMap(port, "external_ids")[externalIDNetwork] == "" {
+		t.Fatalf("gateway port not rebuilt with its network: %v", port)
+	}
+}
+
+func TestDualStackNetwork(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	links := d.links.(*fakeLinker)
+	firewall := d.firewall.(*fakeFirewall)
+	firewall6 := d.firewall6.(*fakeFirewall)
+
+	id, _ := testNetwork()
+	err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+		NetworkID: id,
+		IPv4Data:  []*dknet.IPAMData{{Pool: "172.18.40.0/24", Gateway: "172.18.40.1/24"}},
+		IPv6Data:  []*dknet.IPAMData{{Pool: "fd00:40::/64", Gateway: "fd00:40::1/64"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, err := d.getNetwork(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns.Gateway != "172.18.40.1" || ns.GatewayIPv6 != "fd00:40::1" || ns.GatewayIPv6Mask != "64" {
+		t.Fatalf("unexpected network state %+v", ns)
+	}
+	expectRecorded(t, &links.recorder,
+		"addr add ovsbr-01234 172.18.40.1/24",
+		"addr add ovsbr-01234 fd00:40::1/64",
+		"up ovsbr-01234")
+	expectRecorded(t, &firewall.recorder,
+		"insert nat POSTROUTING -s 172.18.40.1/24 -j MASQUERADE")
+	expectRecorded(t, &firewall6.recorder,
+		"insert nat POSTROUTING -s fd00:40::1/64 -j MASQUERADE")
+
+	waitFor(t, "the bridge to be cached", func() bool {
+		_, _, ok := d.cache.bridgeByName(ns.BridgeName)
+		return ok
+	})
+	restored, ok := d.networksFromCache()[id]
+	if !ok || restored.Gateway != ns.Gateway || restored.GatewayIPv6 != ns.GatewayIPv6 || restored.GatewayIPv6Mask != ns.GatewayIPv6Mask {
+		t.Fatalf("gateways not restored from the cache: %+v", restored)
+	}
+
+	res, err := d.Join(&dknet.JoinRequest{NetworkID: id, EndpointID: "fedcba9876543210fedcba9876543210"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Gateway != "172.18.40.1" || res.GatewayIPv6 != "fd00:40::1" {
+		t.Fatalf("unexpected gateways %s and %s", res.Gateway, res.GatewayIPv6)
+	}
+}
+
+func TestDualStackNATFailure(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	d.firewall6.(*fakeFirewall).fail = fmt.Errorf("ip6tables: table nat does not exist")
+
+	// A host without IPv6 NAT fails the create rather than the plugin
+	id, _ := testNetwork()
+	err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+		NetworkID: id,
+		IPv4Data:  []*dknet.IPAMData{{Pool: "172.18.40.0/24", Gateway: "172.18.40.1/24"}},
+		IPv6Data:  []*dknet.IPAMData{{Pool: "fd00:40::/64", Gateway: "fd00:40::1/64"}},
+	})
+	if err == nil {
+		t.Fatal("expected the create to fail without ip6tables NAT")
+	}
+	if _, err := d.getNetwork(id); err == nil {
+		t.Fatal("expected the failed network to be forgotten")
+	}
+}
+
+func TestIPv6OnlyNetwork(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	links := d.links.(*fakeLinker)
+	firewall := d.firewall.(*fakeFirewall)
+	firewall6 := d.firewall6.(*fakeFirewall)
+
+	id, _ := testNetwork()
+	err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+		NetworkID: id,
+		Options:   map[string]interface{}{internalOption: true},
+		IPv6Data:  []*dknet.IPAMData{{Pool: "fd00:41::/64", Gateway: "fd00:41::1/64"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRecorded(t, &links.recorder,
+		"addr add ovsbr-01234 fd00:41::1/64",
+		"up ovsbr-01234")
+	expectRecorded(t, &firewall.recorder)
+	expectRecorded(t, &firewall6.recorder,
+		"insert filter FORWARD -i ovsbr-01234 ! -o ovsbr-01234 -j DROP",
+		"insert filter FORWARD ! -i ovsbr-01234 -o ovsbr-01234 -j DROP")
+
+	res, err := d.Join(&dknet.JoinRequest{NetworkID: id, EndpointID: "fedcba9876543210fedcba9876543210"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Gateway != "" || res.GatewayIPv6 != "fd00:41::1" {
+		t.Fatalf("unexpected gateways %q and %q", res.Gateway, res.GatewayIPv6)
+	}
+
+	err = d.CreateNetwork(&dknet.CreateNetworkRequest{NetworkID: "fedcba9876543210fedcba9876543210"})
+	if err == nil {
+		t.Fatal("expected a network without a gateway to fail")
+	}
+}
+
+func TestMultipleSubnets(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	links := d.links.(*fakeLinker)
+	firewall := d.firewall.(*fakeFirewall)
+
+	id, _ := testNetwork()
+	err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+		NetworkID: id,
+		IPv4Data: []*dknet.IPAMData{
+			{Pool: "172.18.40.0/24", Gateway: "172.18.40.1/24"},
+			{Pool: "172.18.41.0/24", Gateway: "172.18.41.254/24"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, err := d.getNetwork(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns.Gateway != "172.18.40.1" || len(ns.Subnets) != 2 {
+		t.Fatalf("unexpected network state %+v", ns)
+	}
+	expectRecorded(t, &links.recorder,
+		"addr add ovsbr-01234 172.18.40.1/24",
+		"addr add ovsbr-01234 172.18.41.254/24",
+		"up ovsbr-01234")
+	expectRecorded(t, &firewall.recorder,
+		"insert nat POSTROUTING -s 172.18.40.1/24 -j MASQUERADE",
+		"insert nat POSTROUTING -s 172.18.41.254/24 -j MASQUERADE")
+
+	waitFor(t, "the bridge to be cached", func() bool {
+		_, _, ok := d.cache.bridgeByName(ns.BridgeName)
+		return ok
+	})
+	restored := d.networksFromCache()[id]
+	if restored == nil || !sameSubnets(restored.Subnets, ns.Subnets) {
+		t.Fatalf("subnets not restored from the cache: %+v", restored)
+	}
+
+	// Join returns the gateway of the subnet of the endpoint
+	for _, tc := range []struct {
+		endpointID string
+		address    string
+		gateway    string
+	}{
+		{"fedcba9876543210fedcba9876543210", "172.18.41.7/24", "172.18.41.254"},
+		{"edcba9876543210fedcba9876543210f", "172.18.40.7/24", "172.18.40.1"},
+		{"dcba9876543210fedcba9876543210fe", "", "172.18.40.1"},
+	} {
+		if tc.address != "" {
+			err := d.CreateEndpoint(&dknet.CreateEndpointRequest{
+				NetworkID:  id,
+				EndpointID: tc.endpointID,
+				Interface:  &dknet.EndpointInterface{Address: tc.address},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		res, err := d.Join(&dknet.JoinRequest{NetworkID: id, EndpointID: tc.endpointID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Gateway != tc.gateway {
+			t.Fatalf("expected gateway %s for %q, got %s", tc.gateway, tc.address, res.Gateway)
+		}
+	}
+
+	if err := d.DeleteEndpoint(&dknet.DeleteEndpointRequest{NetworkID: id, EndpointID: "fedcba9876543210fedcba9876543210"}); err != nil {
+		t.Fatal(err)
+	}
+	if ep := ns.getEndpoint("fedcba9876543210fedcba9876543210"); ep.Address != "" {
+		t.Fatalf("endpoint not forgotten: %+v", ep)
+	}
+}
@@ -0,0 +1,78 @@
+package ovs
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/gopher-net/dknet"
+)
+
+// endpoint is what CreateEndpoint tells the driver about an endpoint, kept
+// for its Join
+type endpoint struct {
+	Address     string
+	AddressIPv6 string
+	MacAddress  string
+}
+
+// setEndpoint records an endpoint of a network. The network must be locked
+// for reading.
+func (ns *NetworkState) setEndpoint(id string, intf *dknet.EndpointInterface) {
+	ns.endpointLock.Lock()
+	defer ns.endpointLock.Unlock()
+	if ns.endpoints == nil {
+		ns.endpoints = make(map[string]endpoint)
+	}
+	ep := endpoint{}
+	if intf != nil {
+		ep = endpoint{
+			Address:     intf.Address,
+			AddressIPv6: intf.AddressIPv6,
+			MacAddress:  intf.MacAddress,
+		}
+	}
+	ns.endpoints[id] = ep
+}
+
+// getEndpoint returns what was recorded about an endpoint, empty if nothing
+func (ns *NetworkState) getEndpoint(id string) endpoint {
+	ns.endpointLock.Lock()
+	defer ns.endpointLock.Unlock()
+	return ns.endpoints[id]
+}
+
+func (ns *NetworkState) forgetEndpoint(id string) {
+	ns.endpointLock.Lock()
+	defer ns.endpointLock.Unlock()
+	delete(ns.endpoints, id)
+}
+
+// endpointMAC returns the MAC an endpoint asked for, or the one made from its
+// address. It is nil if neither is known, e.g. after a restart of the plugin.
+func (ns *NetworkState) endpointMAC(ep endpoint) (net.HardwareAddr, error) {
+	if ep.MacAddress != "" {
+		mac, err := net.ParseMAC(ep.MacAddress)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC address %s: %s", ep.MacAddress, err)
+		}
+		return mac, nil
+	}
+	address := ep.Address
+	if address == "" {
+		address = ep.AddressIPv6
+	}
+	if address == "" {
+		return nil, nil
+	}
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint address %s: %s", address, err)
+	}
+	var prefix net.HardwareAddr
+	if ns.MACPrefix != "" {
+		if prefix, err = parseMACPrefix(ns.MACPrefix); err != nil {
+			return nil, err
+		}
+	}
+	return net.ParseMAC(makeMac(prefix, ip))
+}
@@ -0,0 +1,130 @@
+package ovs
+
+import (
+	"testing"
+
+	"github.com/gopher-net/dknet"
+)
+
+func TestContainerMAC(t *testing.T) {
+	for _, tc := range []struct {
+		options map[string]interface{}
+		intf    *dknet.EndpointInterface
+		mac     string
+	}{
+		// The default prefix and the IPv4 address
+		{nil, &dknet.EndpointInterface{Address: "172.18.40.7/24"}, "7a:42:ac:12:28:07"},
+		// A three byte OUI leaves room for the last three bytes only
+		{map[string]interface{}{macPrefixOption: "00:16:3e"}, &dknet.EndpointInterface{Address: "172.18.40.7/24"}, "00:16:3e:12:28:07"},
+		{nil, &dknet.EndpointInterface{AddressIPv6: "fd00:40::a:7/64"}, "7a:42:00:0a:00:07"},
+		// A requested MAC wins over the address
+		{nil, &dknet.EndpointInterface{Address: "172.18.40.7/24", MacAddress: "02:00:00:00:00:01"}, "02:00:00:00:00:01"},
+		// Nothing to go by, the kernel picks one
+		{nil, nil, ""},
+	} {
+		func() {
+			d, cleanup := newTestDriver(t)
+			defer cleanup()
+			links := d.links.(*fakeLinker)
+
+			id, _ := testNetwork()
+			err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+				NetworkID: id,
+				Options:   tc.options,
+				IPv4Data:  []*dknet.IPAMData{{Pool: "172.18.40.0/24", Gateway: "172.18.40.1/24"}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			links.recorded()
+
+			endpointID := "fedcba9876543210fedcba9876543210"
+			err = d.CreateEndpoint(&dknet.CreateEndpointRequest{NetworkID: id, EndpointID: endpointID, Interface: tc.intf})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := d.Join(&dknet.JoinRequest{NetworkID: id, EndpointID: endpointID}); err != nil {
+				t.Fatal(err)
+			}
+			expected := []string{"add veth ovs-veth0-fedcb"}
+			if tc.mac != "" {
+				expected = append(expected, "set ethcfedcb address "+tc.mac)
+			}
+			expectRecorded(t, &links.recorder, append(expected, "up ovs-veth0-fedcb")...)
+		}()
+	}
+}
+
+func TestMACValidation(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	for _, prefix := range []string{"01:00", "7a", "7a:42:00:00", "7a:4g", "7a:420"} {
+		id, _ := testNetwork()
+		err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+			NetworkID: id,
+			Options:   map[string]interface{}{macPrefixOption: prefix},
+			IPv4Data:  []*dknet.IPAMData{{Gateway: "172.18.40.1/24"}},
+		})
+		if err == nil {
+			t.Fatalf("expected MAC prefix %s to be rejected", prefix)
+		}
+	}
+	// A three byte prefix leaves room for the last three bytes of an address
+	ipamData := func(gateways ...string) []*dknet.IPAMData {
+		var data []*dknet.IPAMData
+		for _, gateway := range gateways {
+			data = append(data, &dknet.IPAMData{Gateway: gateway})
+		}
+		return data
+	}
+	for _, gateways := range [][]string{{"10.0.0.1/7"}, {"10.1.0.1/24", "11.1.0.1/24"}} {
+		id, _ := testNetwork()
+		err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+			NetworkID: id,
+			Options:   map[string]interface{}{modeOption: modeFlat, macPrefixOption: "00:16:3e"},
+			IPv4Data:  ipamData(gateways...),
+		})
+		if err == nil {
+			t.Fatalf("expected MAC prefix 00:16:3e to be rejected for %v", gateways)
+		}
+	}
+	err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+		NetworkID: "1000000000",
+		Options:   map[string]interface{}{modeOption: modeFlat, macPrefixOption: "00:16:3e"},
+		IPv4Data:  ipamData("10.1.0.1/24", "10.2.0.1/24"),
+	})
+	if err != nil {
+		t.Fatalf("expected MAC prefix 00:16:3e to fit subnets of 10.0.0.0/8: %s", err)
+	}
+
+	id, _ := createTestNetwork(t, d)
+	err = d.CreateEndpoint(&dknet.CreateEndpointRequest{
+		NetworkID:  id,
+		EndpointID: "fedcba9876543210fedcba9876543210",
+		Interface:  &dknet.EndpointInterface{MacAddress: "not a mac"},
+	})
+	if err == nil {
+		t.Fatal("expected an invalid MAC address to be rejected")
+	}
+}
+
+func TestJoinFailureDeletesVeth(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	links := d.links.(*fakeLinker)
+
+	id, ns := createTestNetwork(t, d)
+	// A leftover port of the same name makes attaching the veth fail
+	if err := d.ovsdber.addUplinkPort(ns.BridgeName, "ovs-veth0-fedcb", nil); err != nil {
+		t.Fatal(err)
+	}
+	links.recorded()
+	if _, err := d.Join(&dknet.JoinRequest{NetworkID: id, EndpointID: "fedcba9876543210fedcba9876543210"}); err == nil {
+		t.Fatal("expected the join to fail")
+	}
+	expectRecorded(t, &links.recorder, "add veth ovs-veth0-fedcb", "up ovs-veth0-fedcb", "del ovs-veth0-fedcb")
+	if _, err := links.LinkByName("ethcfedcb"); err == nil {
+		t.Fatal("the container end of the veth pair was left behind")
+	}
+}
@@ -0,0 +1,206 @@
+package ovs
+
+import (
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gopher-net/dknet"
+)
+
+// watchEvents follows the docker events stream, reconnecting with an
+// exponential backoff whenever the stream is lost
+func (d *Driver) watchEvents() {
+	backoff := minReconnectBackoff
+	for {
+		err := d.dockerer.followEvents(func() {
+			backoff = minReconnectBackoff
+			// Containers may have started while nobody was listening
+			d.labelEndpoints()
+			d.assignAllStaticAddresses()
+		}, d.handleEvent)
+		log.Errorf("Lost the docker events stream: %v. Retrying in %s", err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// handleEvent reconciles the driver with a container or network event
+func (d *Driver) handleEvent(e *event) {
+	// Daemons older than API 1.22 only fill in Status and Id
+	action := e.Action
+	if action == "" {
+		action = e.Status
+	}
+	id := e.Actor.ID
+	if id == "" {
+		id = e.ID
+	}
+
+	switch e.Type {
+	case "network":
+		switch action {
+		case "connect":
+			d.labelEndpoints()
+		case "disconnect":
+			d.cleanupContainer(e.Actor.Attributes["container"], id)
+		case "destroy":
+			d.forgetNetwork(id)
+		}
+	case "container", "":
+		switch action {
+		case "create":
+			d.assignStaticAddresses(id)
+		case "start":
+			d.labelEndpoints()
+		case "die", "destroy":
+			d.cleanupContainer(id, "")
+		}
+	}
+}
+
+// labelEndpoints tags the OVS Interface of every endpoint with the ID and
+// name of its container
+func (d *Driver) labelEndpoints() {
+	containers, err := d.dockerer.endpointContainers()
+	if err != nil {
+		log.Errorf("Could not list docker endpoints: %s", err)
+		return
+	}
+	for endpointID, containerID := range containers {
+		portName := ovsPortPrefix + truncateID(endpointID)
+		_, row, ok := d.ovsdber.cache.interfaceByName(portName)
+		if !ok {
+			continue
+		}
+		externalIDs := rowExternalIDs(row)
+		if externalIDs[externalIDEndpoint] != endpointID || externalIDs[externalIDContainer] == containerID {
+			continue
+		}
+		name, err := d.dockerer.containerName(containerID)
+		if err != nil {
+			log.Errorf("Could not inspect container %s: %s", containerID, err)
+			continue
+		}
+		labels := map[string]string{
+			externalIDContainer:     containerID,
+			externalIDContainerName: name,
+		}
+		if err := d.ovsdber.setExternalIDs("Interface", portName, labels); err != nil {
+			log.Errorf("Could not label interface [ %s ] with container %s: %s", portName, name, err)
+			continue
+		}
+		log.Debugf("Labeled interface [ %s ] with container %s", portName, name)
+	}
+}
+
+// assignAllStaticAddresses assigns the static addresses of every container
+// carrying staticLabel
+func (d *Driver) assignAllStaticAddresses() {
+	containers, err := d.dockerer.labeledContainers(staticLabel)
+	if err != nil {
+		log.Errorf("Could not list the containers with a static address: %s", err)
+		return
+	}
+	for _, containerID := range containers {
+		d.assignStaticAddresses(containerID)
+	}
+}
+
+// assignStaticAddresses reconnects a container carrying staticLabel to each
+// network whose pools keep an address for the label's value, asking for that
+// address. Docker does not tell the IPAM driver which container an address is
+// for, so the label is resolved once docker reports the container.
+func (d *Driver) assignStaticAddresses(containerID string) {
+	c, err := d.dockerer.containerNetworks(containerID)
+	if err != nil {
+		log.Errorf("Could not inspect container %s: %s", containerID, err)
+		return
+	}
+	name := c.Config.Labels[staticLabel]
+	if name == "" {
+		return
+	}
+	for networkName, settings := range c.NetworkSettings.Networks {
+		subnets, err := d.dockerer.networkSubnets(settings.NetworkID)
+		if err != nil {
+			log.Errorf("Could not inspect network %s: %s", networkName, err)
+			continue
+		}
+		var asked endpointIPAMConfig
+		if settings.IPAMConfig != nil {
+			asked = *settings.IPAMConfig
+		}
+		wanted := asked
+		for _, subnet := range subnets {
+			address := d.ipam.staticAddress(subnet, name)
+			if address == "" {
+				continue
+			}
+			if net.ParseIP(address).To4() != nil {
+				wanted.IPv4Address = address
+			} else {
+				wanted.IPv6Address = address
+			}
+		}
+		if wanted == asked {
+			continue
+		}
+		reconnected := &endpointSettings{Aliases: settings.Aliases, IPAMConfig: &wanted}
+		if err := d.dockerer.reconnect(settings.NetworkID, containerID, settings, reconnected); err != nil {
+			log.Errorf("Could not give container %s its static address on network %s: %s", containerID, networkName, err)
+			continue
+		}
+		log.Infof("Reconnected container %s to network %s with its static address for %s=%s", containerID, networkName, staticLabel, name)
+	}
+}
+
+// cleanupContainer removes and forgets the endpoints of a container docker no
+// longer knows about, limited to a single network if networkID is set. Docker
+// normally sends a Leave first, in which case there is nothing left to do.
+func (d *Driver) cleanupContainer(containerID string, networkID string) {
+	if containerID == "" {
+		return
+	}
+	endpoints, err := d.dockerer.endpointIDs()
+	if err != nil {
+		log.Errorf("Could not list docker endpoints: %s", err)
+		return
+	}
+	for _, row := range d.ovsdber.cache.table("Interface") {
+		externalIDs := rowExternalIDs(row)
+		if externalIDs[externalIDContainer] != containerID {
+			continue
+		}
+		if networkID != "" && externalIDs[externalIDNetwork] != networkID {
+			continue
+		}
+		// The endpoint is still in use, e.g. the container was restarted
+		endpointID := externalIDs[externalIDEndpoint]
+		if endpoints[endpointID] {
+			continue
+		}
+		ns, err := d.rlockNetwork(externalIDs[externalIDNetwork])
+		if err != nil {
+			continue
+		}
+		log.Infof("Container %s is gone without leaving endpoint %s, cleaning up", containerID, endpointID)
+		d.removeEndpoint(ns, endpointID)
+		ns.forgetEndpoint(endpointID)
+		ns.lock.RUnlock()
+	}
+}
+
+// forgetNetwork deletes a network docker destroyed without telling the driver
+func (d *Driver) forgetNetwork(networkID string) {
+	if _, err := d.getNetwork(networkID); err != nil {
+		return
+	}
+	log.Infof("Network %s was destroyed without a DeleteNetwork, cleaning up", networkID)
+	if err := d.DeleteNetwork(&dknet.DeleteNetworkRequest{NetworkID: networkID}); err != nil {
+		log.Errorf("Could not clean up network %s: %s", networkID, err)
+	}
+}
@@ -0,0 +1,344 @@
+package ovs
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gopher-net/dknet"
+	"github.com/samalba/dockerclient"
+)
+
+// fakeDocker serves the parts of the docker remote API the driver uses. It
+// records network connects and disconnects, the recorder's lock guards the
+// rest.
+type fakeDocker struct {
+	recorder
+	networks []*dockerclient.NetworkResource
+	names    map[string]string
+	// containers holds the labels and network settings of containers
+	containers map[string]*containerNetworks
+	// events is the raw events stream, which ends after them
+	events string
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/"+dockerclient.APIVersion)
+	switch {
+	case path == "/events":
+		w.Write([]byte(f.events))
+	case path == "/networks":
+		json.NewEncoder(w).Encode(f.networks)
+	case path == "/containers/json":
+		var list []dockerclient.Container
+		for id, c := range f.containers {
+			if c.Config.Labels[staticLabel] != "" {
+				list = append(list, dockerclient.Container{Id: id})
+			}
+		}
+		json.NewEncoder(w).Encode(list)
+	case strings.HasPrefix(path, "/containers/") && strings.HasSuffix(path, "/json"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/containers/"), "/json")
+		name, named := f.names[id]
+		c, ok := f.containers[id]
+		if !named && !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if !ok {
+			c = &containerNetworks{}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Id":              id,
+			"Name":            "/" + name,
+			"Config":          c.Config,
+			"NetworkSettings": c.NetworkSettings,
+		})
+	case strings.HasPrefix(path, "/networks/"):
+		parts := strings.Split(strings.TrimPrefix(path, "/networks/"), "/")
+		var network *dockerclient.NetworkResource
+		for _, n := range f.networks {
+			if n.ID == parts[0] {
+				network = n
+			}
+		}
+		if network == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if len(parts) == 1 {
+			json.NewEncoder(w).Encode(network)
+			return
+		}
+		var body struct {
+			Container      string
+			EndpointConfig *endpointSettings
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		c, ok := f.containers[body.Container]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		switch parts[1] {
+		case "disconnect":
+			f.record("disconnect %s %s", network.ID, body.Container)
+			delete(c.NetworkSettings.Networks, network.Name)
+		case "connect":
+			settings := body.EndpointConfig
+			if settings == nil {
+				settings = &endpointSettings{}
+			}
+			settings.NetworkID = network.ID
+			ipv4 := ""
+			if settings.IPAMConfig != nil {
+				ipv4 = settings.IPAMConfig.IPv4Address
+			}
+			f.record("connect %s %s %s", network.ID, body.Container, ipv4)
+			c.NetworkSettings.Networks[network.Name] = settings
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// attach makes docker report a container named web as attached to a network
+func (f *fakeDocker) attach(networkID string, containerID string, endpointID string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.names[containerID] = "web"
+	f.networks = []*dockerclient.NetworkResource{{
+		ID:     networkID,
+		Driver: "ovs",
+		Containers: map[string]dockerclient.EndpointResource{
+			containerID: {EndpointID: endpointID},
+		},
+	}}
+}
+
+// detach makes docker forget every endpoint
+func (f *fakeDocker) detach() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.networks = nil
+}
+
+func newFakeDocker(t *testing.T, d *Driver) (*fakeDocker, func()) {
+	f := &fakeDocker{names: make(map[string]string), containers: make(map[string]*containerNetworks)}
+	server := httptest.NewServer(f)
+	client, err := dockerclient.NewDockerClient(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.dockerer.client = client
+	return f, server.Close
+}
+
+// joinTestContainer creates a network and joins a container to it
+func joinTestContainer(t *testing.T, d *Driver, docker *fakeDocker) (string, string, string) {
+	id, _ := createTestNetwork(t, d)
+	endpointID := "fedcba9876543210fedcba9876543210"
+	containerID := "c0ffee0000000000c0ffee0000000000"
+	if err := d.CreateEndpoint(&dknet.CreateEndpointRequest{
+		NetworkID:  id,
+		EndpointID: endpointID,
+		Interface:  &dknet.EndpointInterface{Address: "172.18.40.2/24"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Join(&dknet.JoinRequest{NetworkID: id, EndpointID: endpointID}); err != nil {
+		t.Fatal(err)
+	}
+	docker.attach(id, containerID, endpointID)
+	waitFor(t, "the interface to be cached", func() bool {
+		_, _, ok := d.cache.interfaceByName("ovs-veth0-fedcb")
+		return ok
+	})
+
+	d.handleEvent(&event{Type: "container", Action: "start", Actor: eventActor{ID: containerID}})
+	waitFor(t, "the interface to be labeled", func() bool {
+		_, row, _ := d.cache.interfaceByName("ovs-veth0-fedcb")
+		return rowExternalIDs(row)[externalIDContainer] == containerID
+	})
+	return id, endpointID, containerID
+}
+
+// knowsEndpoint reports whether the driver still has the state of an endpoint
+func knowsEndpoint(t *testing.T, d *Driver, networkID string, endpointID string) bool {
+	ns, err := d.getNetwork(networkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.endpointLock.Lock()
+	defer ns.endpointLock.Unlock()
+	_, ok := ns.endpoints[endpointID]
+	return ok
+}
+
+func TestLabelEndpoints(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	docker, closeDocker := newFakeDocker(t, d)
+	defer closeDocker()
+
+	_, endpointID, containerID := joinTestContainer(t, d, docker)
+	_, intf, _ := sharedOvsdb.rowByName("Interface", "ovs-veth0-fedcb")
+	ids := fakeMap(intf, "external_ids")
+	if ids[externalIDContainer] != containerID || ids[externalIDContainerName] != "web" {
+		t.Fatalf("interface not labeled with its container: %v", ids)
+	}
+	if ids[externalIDEndpoint] != endpointID {
+		t.Fatalf("labeling dropped the endpoint: %v", ids)
+	}
+}
+
+func TestContainerDieWithoutLeave(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	docker, closeDocker := newFakeDocker(t, d)
+	defer closeDocker()
+	links := d.links.(*fakeLinker)
+
+	id, endpointID, containerID := joinTestContainer(t, d, docker)
+	links.recorded()
+
+	// A restarted container keeps its endpoint
+	d.handleEvent(&event{Status: "die", ID: containerID})
+	expectRecorded(t, &links.recorder)
+	if _, _, ok := sharedOvsdb.rowByName("Port", "ovs-veth0-fedcb"); !ok || !knowsEndpoint(t, d, id, endpointID) {
+		t.Fatal("endpoint docker still knows was removed")
+	}
+
+	docker.detach()
+	d.handleEvent(&event{Type: "container", Action: "destroy", Actor: eventActor{ID: containerID}})
+	expectRecorded(t, &links.recorder, "del ovs-veth0-fedcb")
+	if _, _, ok := sharedOvsdb.rowByName("Port", "ovs-veth0-fedcb"); ok {
+		t.Fatal("port of a destroyed container was not removed")
+	}
+	if knowsEndpoint(t, d, id, endpointID) {
+		t.Fatal("endpoint of a destroyed container is still known")
+	}
+
+	// Docker's own Leave may still arrive
+	waitFor(t, "the port to leave the cache", func() bool {
+		_, _, ok := d.cache.portByName("ovs-veth0-fedcb")
+		return !ok
+	})
+	if err := d.Leave(&dknet.LeaveRequest{NetworkID: id, EndpointID: endpointID}); err != nil {
+		t.Fatalf("expected a Leave after the cleanup to succeed, got %s", err)
+	}
+}
+
+func TestNetworkDisconnectWithoutLeave(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	docker, closeDocker := newFakeDocker(t, d)
+	defer closeDocker()
+	links := d.links.(*fakeLinker)
+
+	id, endpointID, containerID := joinTestContainer(t, d, docker)
+	links.recorded()
+
+	docker.detach()
+	d.handleEvent(&event{
+		Type:   "network",
+		Action: "disconnect",
+		Actor:  eventActor{ID: id, Attributes: map[string]string{"container": containerID}},
+	})
+	expectRecorded(t, &links.recorder, "del ovs-veth0-fedcb")
+	if knowsEndpoint(t, d, id, endpointID) {
+		t.Fatal("endpoint of a disconnected container is still known")
+	}
+
+	d.handleEvent(&event{Type: "network", Action: "destroy", Actor: eventActor{ID: id}})
+	if _, err := d.getNetwork(id); err == nil {
+		t.Fatal("destroyed network is still known")
+	}
+}
+
+func TestFollowEvents(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	docker, closeDocker := newFakeDocker(t, d)
+	defer closeDocker()
+
+	// An event of a daemon older than API 1.22, then a newer one
+	docker.events = `{"status":"die","id":"c0ffee","from":"busybox","time":1}` +
+		`{"status":"disconnect","id":"n1","Type":"network","Action":"disconnect","Actor":{"ID":"n1","Attributes":{"container":"c0ffee"}},"time":2}`
+	connected := false
+	var events []*event
+	err := d.dockerer.followEvents(func() { connected = true }, func(e *event) { events = append(events, e) })
+	if err != io.EOF {
+		t.Fatalf("expected the stream to end, got %v", err)
+	}
+	if !connected || len(events) != 2 {
+		t.Fatalf("expected two events once connected, got %d", len(events))
+	}
+	if e := events[0]; e.Status != "die" || e.ID != "c0ffee" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if e := events[1]; e.Type != "network" || e.Action != "disconnect" || e.Actor.ID != "n1" || e.Actor.Attributes["container"] != "c0ffee" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+}
+
+// labeledContainer makes docker report a container with the static address
+// label, connected to a network without asking for an address
+func (f *fakeDocker) labeledContainer(id string, label string, networkID string, networkName string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	c := &containerNetworks{}
+	c.Config.Labels = map[string]string{}
+	if label != "" {
+		c.Config.Labels[staticLabel] = label
+	}
+	c.NetworkSettings.Networks = map[string]*endpointSettings{networkName: {NetworkID: networkID}}
+	f.containers[id] = c
+}
+
+func TestStaticAddressByLabel(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	docker, closeDocker := newFakeDocker(t, d)
+	defer closeDocker()
+
+	_, err := d.RequestPool(&RequestPoolRequest{
+		AddressSpace: localAddressSpace,
+		Pool:         "10.1.0.0/24",
+		Options:      map[string]string{staticOption: "web=10.1.0.50,db=10.1.0.51"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	docker.networks = []*dockerclient.NetworkResource{{
+		ID:   "n1",
+		Name: "ipam0",
+		IPAM: dockerclient.IPAM{Driver: "ovs", Config: []dockerclient.IPAMConfig{{Subnet: "10.1.0.0/24"}}},
+	}}
+	docker.labeledContainer("web1", "web", "n1", "ipam0")
+	docker.labeledContainer("plain", "", "n1", "ipam0")
+
+	// The container is connected again asking for its address, which docker
+	// then requests from the IPAM driver when it starts
+	d.handleEvent(&event{Type: "container", Action: "create", Actor: eventActor{ID: "web1"}})
+	expectRecorded(t, &docker.recorder, "disconnect n1 web1", "connect n1 web1 10.1.0.50")
+	// Only once
+	d.handleEvent(&event{Type: "container", Action: "create", Actor: eventActor{ID: "web1"}})
+	d.handleEvent(&event{Type: "container", Action: "create", Actor: eventActor{ID: "plain"}})
+	expectRecorded(t, &docker.recorder)
+
+	// Containers created while the events stream was down
+	docker.labeledContainer("db1", "db", "n1", "ipam0")
+	docker.labeledContainer("cache1", "cache", "n1", "ipam0")
+	d.assignAllStaticAddresses()
+	expectRecorded(t, &docker.recorder, "disconnect n1 db1", "connect n1 db1 10.1.0.51")
+
+	if address := requestAddress(t, d, &RequestAddressRequest{PoolID: "ovs-local/10.1.0.0/24", Address: "10.1.0.50"}); address != "10.1.0.50/24" {
+		t.Fatalf("expected the static address of web, got %s", address)
+	}
+}
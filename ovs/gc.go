@@ -0,0 +1,95 @@
+package ovs
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// garbageCollector removes veth links and OVS ports that belong to endpoints
+// docker no longer knows about, e.g. when the plugin crashed in the middle of
+// a Join or docker never sent a Leave.
+type garbageCollector struct {
+	interval   time.Duration
+	reportOnly bool
+	// suspects holds leftovers seen by the previous pass. A periodic pass only
+	// removes a leftover the second time it sees it so that it does not race
+	// with a Join docker has not finished recording yet.
+	suspects map[string]bool
+}
+
+// runGC reconciles once at startup and then every gc.interval
+func (d *Driver) runGC() {
+	d.collectGarbage(true)
+	if d.gc.interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(d.gc.interval) {
+			d.collectGarbage(false)
+		}
+	}()
+}
+
+// collectGarbage compares the ovs-veth links and OVS ports on the host with
+// the endpoints docker knows about. If immediate is false a leftover is only
+// removed once it has been seen by two consecutive passes.
+func (d *Driver) collectGarbage(immediate bool) {
+	endpoints, err := d.dockerer.endpointIDs()
+	if err != nil {
+		log.Errorf("Skipping garbage collection, could not list docker endpoints: %s", err)
+		return
+	}
+	known := make(map[string]bool)
+	for id := range endpoints {
+		known[ovsPortPrefix+truncateID(id)] = true
+	}
+
+	suspects := make(map[string]bool)
+	orphaned := func(name string) bool {
+		if known[name] {
+			return false
+		}
+		suspects[name] = true
+		return immediate || d.gc.suspects[name]
+	}
+
+	links, err := d.links.LinkList()
+	if err != nil {
+		log.Errorf("Garbage collection could not list links: %s", err)
+	}
+	for _, link := range links {
+		name := link.Attrs().Name
+		if !strings.HasPrefix(name, ovsPortPrefix) || !orphaned(name) {
+			continue
+		}
+		if d.gc.reportOnly {
+			log.Infof("Found orphaned veth [ %s ]", name)
+			continue
+		}
+		if err := d.links.LinkDel(link); err != nil {
+			log.Errorf("Could not remove orphaned veth [ %s ]: %s", name, err)
+			continue
+		}
+		log.Infof("Removed orphaned veth [ %s ]", name)
+	}
+
+	for uuid, row := range d.ovsdber.cache.table("Port") {
+		name, ok := row.Fields["name"].(string)
+		if !ok || !strings.HasPrefix(name, ovsPortPrefix) || !orphaned(name) {
+			continue
+		}
+		bridgeName := d.ovsdber.cache.bridgeOfPort(uuid)
+		if d.gc.reportOnly {
+			log.Infof("Found orphaned OVS port [ %s ] on bridge [ %s ]", name, bridgeName)
+			continue
+		}
+		if err := d.ovsdber.deletePort(bridgeName, name); err != nil {
+			log.Errorf("Could not remove orphaned OVS port [ %s ] from bridge [ %s ]: %s", name, bridgeName, err)
+			continue
+		}
+		log.Infof("Removed orphaned OVS port [ %s ] from bridge [ %s ]", name, bridgeName)
+	}
+	d.gc.suspects = suspects
+}
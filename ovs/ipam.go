@@ -0,0 +1,501 @@
+package ovs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultIPAMStateFile = "/var/lib/docker-ovs-plugin/ipam.json"
+	// There is no global address space, allocations are kept on each host
+	localAddressSpace = "ovs-local"
+
+	// reservedOption lists addresses, ranges (first-last) and CIDRs of a
+	// pool that are never handed out unless asked for
+	reservedOption = "net.gopher.ovs.ipam.reserved"
+	// staticOption maps the values of staticLabel to the addresses the
+	// containers carrying them get, as name=address pairs
+	staticOption = "net.gopher.ovs.ipam.static"
+	staticLabel  = "net.gopher.ovs.ipam.static"
+)
+
+var (
+	// Pools requested without a subnet are carved out of these
+	defaultPoolsIPv4 = mustParseCIDR("10.200.0.0/16")
+	defaultPoolsIPv6 = mustParseCIDR("fd6f:7673::/48")
+	defaultPoolSize  = map[bool]int{false: 24, true: 64}
+)
+
+// Requests and responses of the IpamDriver calls of the plugin API
+type IpamCapabilitiesResponse struct {
+	RequiresMACAddress bool
+}
+
+type AddressSpacesResponse struct {
+	LocalDefaultAddressSpace  string
+	GlobalDefaultAddressSpace string
+}
+
+type RequestPoolRequest struct {
+	AddressSpace string
+	Pool         string
+	SubPool      string
+	Options      map[string]string
+	V6           bool
+}
+
+type RequestPoolResponse struct {
+	PoolID string
+	Pool   string
+	Data   map[string]string
+}
+
+type ReleasePoolRequest struct {
+	PoolID string
+}
+
+type RequestAddressRequest struct {
+	PoolID  string
+	Address string
+	Options map[string]string
+}
+
+type RequestAddressResponse struct {
+	Address string
+	Data    map[string]string
+}
+
+type ReleaseAddressRequest struct {
+	PoolID  string
+	Address string
+}
+
+// ipamPool is an address pool handed out by the IPAM driver
+type ipamPool struct {
+	AddressSpace string
+	Pool         string
+	// SubPool is the range addresses are handed out from, the whole pool
+	// if empty
+	SubPool  string
+	Reserved []string
+	// Static maps staticLabel values to addresses, which are only handed
+	// out when asked for like reserved ones
+	Static map[string]string
+	// Allocated are the addresses in use, gateways included
+	Allocated map[string]bool
+}
+
+// ipam allocates pools and addresses, keeping them in a state file so that
+// they survive restarts of the plugin
+type ipam struct {
+	lock  sync.Mutex
+	pools map[string]*ipamPool
+	path  string
+}
+
+func newIPAM(path string) (*ipam, error) {
+	i := &ipam{
+		pools: make(map[string]*ipamPool),
+		path:  path,
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return i, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &i.pools); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// save writes the pools to the state file. The lock must be held.
+func (i *ipam) save() {
+	if err := writeJSON(i.path, i.pools); err != nil {
+		log.Errorf("Could not save IPAM state: %s", err)
+	}
+}
+
+func poolID(addressSpace string, pool string) string {
+	return addressSpace + "/" + pool
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return ipNet
+}
+
+func overlaps(a *net.IPNet, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func (i *ipam) requestPool(r *RequestPoolRequest) (*RequestPoolResponse, error) {
+	space := r.AddressSpace
+	if space != localAddressSpace {
+		// Docker asks global networks for pools of the global default address
+		// space, which is left empty
+		return nil, fmt.Errorf("unknown address space %q, the ovs IPAM driver only has the local address space %s", space, localAddressSpace)
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	var pool *net.IPNet
+	if r.Pool == "" {
+		if r.SubPool != "" {
+			return nil, fmt.Errorf("a sub-pool needs a pool")
+		}
+		if pool = i.freePool(space, r.V6); pool == nil {
+			return nil, fmt.Errorf("no free pool left in address space %s", space)
+		}
+	} else {
+		var err error
+		if _, pool, err = net.ParseCIDR(r.Pool); err != nil {
+			return nil, fmt.Errorf("invalid pool %s: %s", r.Pool, err)
+		}
+		for _, p := range i.pools {
+			if p.AddressSpace == space && overlaps(pool, mustParseCIDR(p.Pool)) {
+				return nil, fmt.Errorf("pool %s overlaps with pool %s", pool, p.Pool)
+			}
+		}
+	}
+
+	p := &ipamPool{
+		AddressSpace: space,
+		Pool:         pool.String(),
+		Allocated:    make(map[string]bool),
+	}
+	if r.SubPool != "" {
+		_, subPool, err := net.ParseCIDR(r.SubPool)
+		if err != nil || !pool.Contains(subPool.IP) {
+			return nil, fmt.Errorf("invalid sub-pool %s of pool %s", r.SubPool, pool)
+		}
+		p.SubPool = subPool.String()
+	}
+	if value := r.Options[reservedOption]; value != "" {
+		from := pool
+		if p.SubPool != "" {
+			from = mustParseCIDR(p.SubPool)
+		}
+		for _, reserved := range strings.Split(value, ",") {
+			first, last, err := parseRange(reserved)
+			if err != nil || !pool.Contains(first) || !pool.Contains(last) {
+				return nil, fmt.Errorf("invalid %s %s in pool %s", reservedOption, reserved, pool)
+			}
+			// A pool left with nothing to hand out is a mistake, e.g. a
+			// reserved /64 in an IPv6 /64
+			if bytes.Compare(first.To16(), from.IP.To16()) <= 0 && bytes.Compare(last.To16(), lastIP(from)) >= 0 {
+				return nil, fmt.Errorf("%s %s leaves no address of %s to hand out", reservedOption, reserved, from)
+			}
+			p.Reserved = append(p.Reserved, reserved)
+		}
+	}
+	if value := r.Options[staticOption]; value != "" {
+		p.Static = make(map[string]string)
+		for _, pair := range strings.Split(value, ",") {
+			parts := strings.Split(pair, "=")
+			if len(parts) != 2 || parts[0] == "" {
+				return nil, fmt.Errorf("invalid %s %s, expected name=address", staticOption, pair)
+			}
+			ip := net.ParseIP(parts[1])
+			if ip == nil || !pool.Contains(ip) {
+				return nil, fmt.Errorf("invalid %s %s in pool %s", staticOption, pair, pool)
+			}
+			p.Static[parts[0]] = ip.String()
+		}
+	}
+
+	id := poolID(space, p.Pool)
+	i.pools[id] = p
+	i.save()
+	log.Infof("Allocated pool %s", id)
+	return &RequestPoolResponse{PoolID: id, Pool: p.Pool}, nil
+}
+
+// freePool returns the first default pool of an address family that no pool
+// of an address space overlaps. The lock must be held.
+func (i *ipam) freePool(space string, v6 bool) *net.IPNet {
+	defaults := defaultPoolsIPv4
+	if v6 {
+		defaults = defaultPoolsIPv6
+	}
+	ones, _ := defaults.Mask.Size()
+	size := defaultPoolSize[v6]
+	for n := 0; n < 1<<uint(size-ones); n++ {
+		candidate := nthSubnet(defaults, size, n)
+		free := true
+		for _, p := range i.pools {
+			if p.AddressSpace == space && overlaps(candidate, mustParseCIDR(p.Pool)) {
+				free = false
+				break
+			}
+		}
+		if free {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// nthSubnet returns the nth subnet of a prefix length in a network
+func nthSubnet(ipNet *net.IPNet, size int, n int) *net.IPNet {
+	_, bits := ipNet.Mask.Size()
+	ip := append(net.IP{}, ipNet.IP...)
+	shift := uint(bits - size)
+	carry := uint(n) << (shift % 8)
+	for i := len(ip) - 1 - int(shift/8); i >= 0 && carry > 0; i-- {
+		sum := uint(ip[i]) + carry
+		ip[i] = byte(sum)
+		carry = sum >> 8
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(size, bits)}
+}
+
+func (i *ipam) releasePool(r *ReleasePoolRequest) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if _, ok := i.pools[r.PoolID]; !ok {
+		return fmt.Errorf("pool %s not found", r.PoolID)
+	}
+	delete(i.pools, r.PoolID)
+	i.save()
+	log.Infof("Released pool %s", r.PoolID)
+	return nil
+}
+
+func (i *ipam) requestAddress(r *RequestAddressRequest) (*RequestAddressResponse, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	p, ok := i.pools[r.PoolID]
+	if !ok {
+		return nil, fmt.Errorf("pool %s not found", r.PoolID)
+	}
+	pool := mustParseCIDR(p.Pool)
+	var ip net.IP
+	if r.Address != "" {
+		// Addresses asked for are handed out even if they are reserved
+		if ip = net.ParseIP(r.Address); ip == nil || !pool.Contains(ip) {
+			return nil, fmt.Errorf("address %s is not in pool %s", r.Address, p.Pool)
+		}
+		if p.Allocated[ip.String()] {
+			return nil, fmt.Errorf("address %s is already in use", ip)
+		}
+	} else if ip = p.nextFree(); ip == nil {
+		return nil, fmt.Errorf("no free address left in pool %s", r.PoolID)
+	}
+
+	p.Allocated[ip.String()] = true
+	i.save()
+	ones, _ := pool.Mask.Size()
+	return &RequestAddressResponse{Address: fmt.Sprintf("%s/%d", ip, ones)}, nil
+}
+
+// staticAddress returns the address a pool keeps for the containers whose
+// staticLabel is name, empty if there is none
+func (i *ipam) staticAddress(pool string, name string) string {
+	_, ipNet, err := net.ParseCIDR(pool)
+	if err != nil {
+		return ""
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	p, ok := i.pools[poolID(localAddressSpace, ipNet.String())]
+	if !ok {
+		return ""
+	}
+	return p.Static[name]
+}
+
+func (i *ipam) releaseAddress(r *ReleaseAddressRequest) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	p, ok := i.pools[r.PoolID]
+	if !ok {
+		return fmt.Errorf("pool %s not found", r.PoolID)
+	}
+	ip := net.ParseIP(r.Address)
+	if ip == nil {
+		return fmt.Errorf("invalid address %s", r.Address)
+	}
+	delete(p.Allocated, ip.String())
+	i.save()
+	return nil
+}
+
+// reconcile marks addresses found on OVS ports as allocated in the pools
+// they are in, e.g. if the state file was lost
+func (i *ipam) reconcile(addresses []string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	changed := false
+	for _, address := range addresses {
+		ip, _, err := net.ParseCIDR(address)
+		if err != nil {
+			continue
+		}
+		for id, p := range i.pools {
+			if mustParseCIDR(p.Pool).Contains(ip) && !p.Allocated[ip.String()] {
+				log.Infof("Address %s is in use on an OVS port, marking it allocated in pool %s", ip, id)
+				p.Allocated[ip.String()] = true
+				changed = true
+			}
+		}
+	}
+	if changed {
+		i.save()
+	}
+}
+
+// nextFree returns the first address of the pool that is neither in use,
+// reserved nor the static address of a container. Reserved ranges are stepped over as a whole, so the scan takes no
+// more steps than there are allocations and ranges, whatever their size.
+func (p *ipamPool) nextFree() net.IP {
+	pool := mustParseCIDR(p.Pool)
+	from := pool
+	if p.SubPool != "" {
+		from = mustParseCIDR(p.SubPool)
+	}
+	reserved := p.reservedRanges()
+	last := lastIP(from)
+	for ip := append(net.IP{}, from.IP.To16()...); ; ip = ipIncrement(ip) {
+		if end := reservedEnd(reserved, ip); end != nil {
+			ip = end
+		} else if p.usable(pool, ip) {
+			if v4 := ip.To4(); v4 != nil {
+				return v4
+			}
+			return ip
+		}
+		if bytes.Compare(ip, last) >= 0 {
+			return nil
+		}
+	}
+}
+
+// usable reports whether an address that is not reserved can be handed out.
+// The first address of a pool is never handed out, it is the network address
+// of an IPv4 pool and the subnet-router anycast address of an IPv6 one, and
+// neither is the broadcast address of an IPv4 pool.
+func (p *ipamPool) usable(pool *net.IPNet, ip net.IP) bool {
+	if ip.Equal(pool.IP) || ip.To4() != nil && ip.Equal(lastIP(pool)) {
+		return false
+	}
+	return !p.Allocated[ip.String()]
+}
+
+// ipRange is an inclusive range of addresses in their 16 byte form
+type ipRange struct {
+	first net.IP
+	last  net.IP
+}
+
+// reservedRanges returns the reserved ranges of a pool and its static
+// addresses as ranges of one
+func (p *ipamPool) reservedRanges() []ipRange {
+	var ranges []ipRange
+	for _, reserved := range p.Reserved {
+		first, last, err := parseRange(reserved)
+		if err != nil {
+			continue
+		}
+		ranges = append(ranges, ipRange{first.To16(), last.To16()})
+	}
+	for _, address := range p.Static {
+		ip := net.ParseIP(address).To16()
+		ranges = append(ranges, ipRange{ip, ip})
+	}
+	return ranges
+}
+
+// reservedEnd returns the last address of the reserved ranges an address is
+// in, or nil if it is not reserved
+func reservedEnd(ranges []ipRange, ip net.IP) net.IP {
+	var end net.IP
+	for _, r := range ranges {
+		if bytes.Compare(ip, r.first) >= 0 && bytes.Compare(ip, r.last) <= 0 && bytes.Compare(r.last, end) > 0 {
+			end = r.last
+		}
+	}
+	if end == nil {
+		return nil
+	}
+	return append(net.IP{}, end...)
+}
+
+// parseRange returns the first and last address of an address, a CIDR or a
+// first-last range
+func parseRange(s string) (net.IP, net.IP, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ipNet.IP, lastIP(ipNet), nil
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) > 2 {
+		return nil, nil, fmt.Errorf("invalid range %s", s)
+	}
+	first := net.ParseIP(parts[0])
+	last := net.ParseIP(parts[len(parts)-1])
+	if first == nil || last == nil || bytes.Compare(first.To16(), last.To16()) > 0 {
+		return nil, nil, fmt.Errorf("invalid range %s", s)
+	}
+	return first, last, nil
+}
+
+// lastIP returns the last address of a subnet
+func lastIP(ipNet *net.IPNet) net.IP {
+	ip := ipNet.IP.To16()
+	mask := ipNet.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+	last := make(net.IP, net.IPv6len)
+	for i := range ip {
+		last[i] = ip[i] | ^mask[i]
+	}
+	return last
+}
+
+// GetDefaultAddressSpaces returns the address spaces of the IPAM driver. The
+// allocations are in a file of each host, so there is no global address
+// space: the hosts of a global network would hand out the same addresses.
+func (d *Driver) GetDefaultAddressSpaces() (*AddressSpacesResponse, error) {
+	return &AddressSpacesResponse{LocalDefaultAddressSpace: localAddressSpace}, nil
+}
+
+// RequestPool allocates a pool, the one asked for or a free default one
+func (d *Driver) RequestPool(r *RequestPoolRequest) (*RequestPoolResponse, error) {
+	log.Debugf("Request pool request: %+v", r)
+	return d.ipam.requestPool(r)
+}
+
+func (d *Driver) ReleasePool(r *ReleasePoolRequest) error {
+	log.Debugf("Release pool request: %+v", r)
+	return d.ipam.releasePool(r)
+}
+
+// RequestAddress allocates an address of a pool, the one asked for or the
+// first free one
+func (d *Driver) RequestAddress(r *RequestAddressRequest) (*RequestAddressResponse, error) {
+	log.Debugf("Request address request: %+v", r)
+	return d.ipam.requestAddress(r)
+}
+
+func (d *Driver) ReleaseAddress(r *ReleaseAddressRequest) error {
+	log.Debugf("Release address request: %+v", r)
+	return d.ipam.releaseAddress(r)
+}
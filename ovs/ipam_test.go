@@ -0,0 +1,203 @@
+package ovs
+
+import (
+	"testing"
+
+	"github.com/gopher-net/dknet"
+)
+
+func requestAddress(t *testing.T, d *Driver, r *RequestAddressRequest) string {
+	res, err := d.RequestAddress(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.Address
+}
+
+func TestIPAMPools(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	for _, expected := range []string{"10.200.0.0/24", "10.200.1.0/24"} {
+		res, err := d.RequestPool(&RequestPoolRequest{AddressSpace: localAddressSpace})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Pool != expected || res.PoolID != poolID(localAddressSpace, expected) {
+			t.Fatalf("expected pool %s, got %+v", expected, res)
+		}
+	}
+	res, err := d.RequestPool(&RequestPoolRequest{AddressSpace: localAddressSpace, V6: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Pool != "fd6f:7673::/64" {
+		t.Fatalf("expected the first default IPv6 pool, got %s", res.Pool)
+	}
+
+	for _, r := range []*RequestPoolRequest{
+		{AddressSpace: localAddressSpace, Pool: "10.200.0.128/25"},
+		{AddressSpace: localAddressSpace, Pool: "10.0.0.0/8"},
+		{AddressSpace: "elsewhere", Pool: "10.1.0.0/24"},
+		{Pool: "10.1.0.0/24"},
+		{AddressSpace: localAddressSpace, SubPool: "10.1.0.0/25"},
+		{AddressSpace: localAddressSpace, Pool: "10.1.0.0/24", SubPool: "10.2.0.0/25"},
+		{AddressSpace: localAddressSpace, Pool: "10.1.0.0/24", Options: map[string]string{reservedOption: "10.1.0.250-10.1.1.5"}},
+		{AddressSpace: localAddressSpace, Pool: "10.1.0.0/24", Options: map[string]string{staticOption: "web"}},
+		{AddressSpace: localAddressSpace, Pool: "10.1.0.0/24", Options: map[string]string{staticOption: "web=10.1.1.5"}},
+	} {
+		if _, err := d.RequestPool(r); err == nil {
+			t.Fatalf("expected pool request %+v to be rejected", r)
+		}
+	}
+	// Nothing for global networks, whose hosts would not know of each
+	// other's allocations
+	if spaces, _ := d.GetDefaultAddressSpaces(); spaces.LocalDefaultAddressSpace != localAddressSpace || spaces.GlobalDefaultAddressSpace != "" {
+		t.Fatalf("expected only a local address space, got %+v", spaces)
+	}
+
+	if err := d.ReleasePool(&ReleasePoolRequest{PoolID: poolID(localAddressSpace, "10.200.0.0/24")}); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := d.RequestPool(&RequestPoolRequest{AddressSpace: localAddressSpace}); res == nil || res.Pool != "10.200.0.0/24" {
+		t.Fatalf("expected the released pool to be handed out again, got %+v", res)
+	}
+	if err := d.ReleasePool(&ReleasePoolRequest{PoolID: "ovs-local/10.9.0.0/24"}); err == nil {
+		t.Fatal("expected releasing an unknown pool to fail")
+	}
+}
+
+func TestIPAMAddresses(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	res, err := d.RequestPool(&RequestPoolRequest{
+		AddressSpace: localAddressSpace,
+		Pool:         "10.1.0.0/24",
+		SubPool:      "10.1.0.0/28",
+		Options: map[string]string{
+			reservedOption: "10.1.0.2-10.1.0.3,10.1.0.4/31,10.1.0.200",
+			staticOption:   "web=10.1.0.6",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := res.PoolID
+
+	gateway := requestAddress(t, d, &RequestAddressRequest{PoolID: id})
+	if gateway != "10.1.0.1/24" {
+		t.Fatalf("expected the first address for the gateway, got %s", gateway)
+	}
+	// Reserved and static addresses are skipped
+	if address := requestAddress(t, d, &RequestAddressRequest{PoolID: id}); address != "10.1.0.7/24" {
+		t.Fatalf("expected 10.1.0.7/24, got %s", address)
+	}
+	if address := requestAddress(t, d, &RequestAddressRequest{PoolID: id}); address != "10.1.0.8/24" {
+		t.Fatalf("expected 10.1.0.8/24, got %s", address)
+	}
+	// Reserved addresses can be asked for, e.g. with docker run --ip
+	for _, address := range []string{"10.1.0.2", "10.1.0.200"} {
+		if got := requestAddress(t, d, &RequestAddressRequest{PoolID: id, Address: address}); got != address+"/24" {
+			t.Fatalf("expected the requested address %s, got %s", address, got)
+		}
+	}
+	for _, address := range []string{"10.1.0.2", "10.2.0.1"} {
+		if _, err := d.RequestAddress(&RequestAddressRequest{PoolID: id, Address: address}); err == nil {
+			t.Fatalf("expected a request for %s to fail", address)
+		}
+	}
+
+	if err := d.ReleaseAddress(&ReleaseAddressRequest{PoolID: id, Address: "10.1.0.7"}); err != nil {
+		t.Fatal(err)
+	}
+	// The allocations survive a restart
+	reloaded, err := newIPAM(d.ipam.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.ipam = reloaded
+	if address := requestAddress(t, d, &RequestAddressRequest{PoolID: id}); address != "10.1.0.7/24" {
+		t.Fatalf("expected the released address, got %s", address)
+	}
+	// 10.1.0.9 to 10.1.0.15, then the sub-pool is exhausted
+	for i := 0; i < 7; i++ {
+		requestAddress(t, d, &RequestAddressRequest{PoolID: id})
+	}
+	if _, err := d.RequestAddress(&RequestAddressRequest{PoolID: id}); err == nil {
+		t.Fatal("expected the sub-pool to be exhausted")
+	}
+}
+
+func TestIPAMReconcile(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	res, err := d.RequestPool(&RequestPoolRequest{AddressSpace: localAddressSpace, Pool: "172.18.40.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := createTestNetwork(t, d)
+	endpointID := "fedcba9876543210fedcba9876543210"
+	err = d.CreateEndpoint(&dknet.CreateEndpointRequest{
+		NetworkID:  id,
+		EndpointID: endpointID,
+		Interface:  &dknet.EndpointInterface{Address: "172.18.40.2/24"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Join(&dknet.JoinRequest{NetworkID: id, EndpointID: endpointID}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the port to be cached", func() bool {
+		return len(d.endpointAddresses()) == 1
+	})
+
+	// The state file lost track of the address
+	d.ipam.reconcile(d.endpointAddresses())
+	if _, err := d.RequestAddress(&RequestAddressRequest{PoolID: res.PoolID, Address: "172.18.40.2"}); err == nil {
+		t.Fatal("expected the address of the port to be allocated")
+	}
+	if address := requestAddress(t, d, &RequestAddressRequest{PoolID: res.PoolID}); address != "172.18.40.1/24" {
+		t.Fatalf("expected 172.18.40.1/24, got %s", address)
+	}
+}
+
+func TestIPAMIPv6Reservations(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	// The subnet-router anycast address is never handed out
+	res, err := d.RequestPool(&RequestPoolRequest{AddressSpace: localAddressSpace, Pool: "fd00:1::/64", V6: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address := requestAddress(t, d, &RequestAddressRequest{PoolID: res.PoolID}); address != "fd00:1::1/64" {
+		t.Fatalf("expected fd00:1::1/64, got %s", address)
+	}
+
+	// Half of the pool is stepped over at once
+	res, err = d.RequestPool(&RequestPoolRequest{
+		AddressSpace: localAddressSpace,
+		Pool:         "fd00:2::/64",
+		V6:           true,
+		Options:      map[string]string{reservedOption: "fd00:2::/65,fd00:2:0:0:8000::-fd00:2:0:0:8000::5"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address := requestAddress(t, d, &RequestAddressRequest{PoolID: res.PoolID}); address != "fd00:2::8000:0:0:6/64" {
+		t.Fatalf("expected fd00:2::8000:0:0:6/64, got %s", address)
+	}
+
+	// A reservation of the whole pool leaves nothing to hand out
+	for _, r := range []*RequestPoolRequest{
+		{AddressSpace: localAddressSpace, Pool: "fd00:3::/64", V6: true, Options: map[string]string{reservedOption: "fd00:3::/64"}},
+		{AddressSpace: localAddressSpace, Pool: "fd00:3::/64", SubPool: "fd00:3::/96", V6: true, Options: map[string]string{reservedOption: "fd00:3::/80"}},
+	} {
+		if _, err := d.RequestPool(r); err == nil {
+			t.Fatalf("expected pool request %+v to be rejected", r)
+		}
+	}
+}
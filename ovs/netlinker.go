@@ -0,0 +1,176 @@
+package ovs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/libnetwork/iptables"
+	"github.com/vishvananda/netlink"
+)
+
+// linker creates, deletes and looks up network links on the host
+type linker interface {
+	LinkAdd(link netlink.Link) error
+	LinkDel(link netlink.Link) error
+	LinkSetUp(link netlink.Link) error
+	LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error
+	LinkByName(name string) (netlink.Link, error)
+	LinkList() ([]netlink.Link, error)
+}
+
+// addresser manages the IP addresses, routes and neighbor entries of links
+// on the host
+type addresser interface {
+	AddrAdd(link netlink.Link, addr *netlink.Addr) error
+	AddrDel(link netlink.Link, addr *netlink.Addr) error
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	RouteAdd(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+	RouteList(link netlink.Link, family int) ([]netlink.Route, error)
+	NeighSet(neigh *netlink.Neigh) error
+	NeighDel(neigh *netlink.Neigh) error
+}
+
+// firewaller programs iptables rules
+type firewaller interface {
+	// ruleExists reports whether a rule is present in a chain of a table
+	ruleExists(table iptables.Table, chain string, rule ...string) bool
+	// insertRule inserts a rule at the top of a chain of a table
+	insertRule(table iptables.Table, chain string, rule ...string) error
+	// deleteRule removes a rule from a chain of a table
+	deleteRule(table iptables.Table, chain string, rule ...string) error
+}
+
+// sysctler sets kernel parameters
+type sysctler interface {
+	// setSysctl writes a value to a parameter named by its path under
+	// /proc/sys, e.g. net/ipv4/ip_forward
+	setSysctl(name string, value string) error
+}
+
+// netlinker is the linker and addresser of the host, backed by netlink
+type netlinker struct{}
+
+func (netlinker) LinkAdd(link netlink.Link) error {
+	return netlink.LinkAdd(link)
+}
+
+func (netlinker) LinkDel(link netlink.Link) error {
+	return netlink.LinkDel(link)
+}
+
+func (netlinker) LinkSetUp(link netlink.Link) error {
+	return netlink.LinkSetUp(link)
+}
+
+func (netlinker) LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error {
+	return netlink.LinkSetHardwareAddr(link, hwaddr)
+}
+
+func (netlinker) LinkByName(name string) (netlink.Link, error) {
+	return netlink.LinkByName(name)
+}
+
+func (netlinker) LinkList() ([]netlink.Link, error) {
+	return netlink.LinkList()
+}
+
+func (netlinker) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	return netlink.AddrAdd(link, addr)
+}
+
+func (netlinker) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	return netlink.AddrDel(link, addr)
+}
+
+func (netlinker) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	return netlink.AddrList(link, family)
+}
+
+func (netlinker) RouteAdd(route *netlink.Route) error {
+	return netlink.RouteAdd(route)
+}
+
+func (netlinker) RouteDel(route *netlink.Route) error {
+	return netlink.RouteDel(route)
+}
+
+func (netlinker) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	return netlink.RouteList(link, family)
+}
+
+func (netlinker) NeighSet(neigh *netlink.Neigh) error {
+	return netlink.NeighSet(neigh)
+}
+
+func (netlinker) NeighDel(neigh *netlink.Neigh) error {
+	return netlink.NeighDel(neigh)
+}
+
+// iptablesFirewall is the firewaller of the host, backed by iptables
+type iptablesFirewall struct{}
+
+func (iptablesFirewall) ruleExists(table iptables.Table, chain string, rule ...string) bool {
+	return iptables.Exists(table, chain, rule...)
+}
+
+func (iptablesFirewall) insertRule(table iptables.Table, chain string, rule ...string) error {
+	return rawRule(chain, append([]string{"-t", string(table), "-I", chain}, rule...))
+}
+
+func (iptablesFirewall) deleteRule(table iptables.Table, chain string, rule ...string) error {
+	return rawRule(chain, append([]string{"-t", string(table), "-D", chain}, rule...))
+}
+
+// ip6tablesFirewall is the IPv6 firewaller of the host, backed by ip6tables
+type ip6tablesFirewall struct{}
+
+func (ip6tablesFirewall) ruleExists(table iptables.Table, chain string, rule ...string) bool {
+	_, err := ip6tables(append([]string{"-t", string(table), "-C", chain}, rule...))
+	return err == nil
+}
+
+func (ip6tablesFirewall) insertRule(table iptables.Table, chain string, rule ...string) error {
+	_, err := ip6tables(append([]string{"-t", string(table), "-I", chain}, rule...))
+	return err
+}
+
+func (ip6tablesFirewall) deleteRule(table iptables.Table, chain string, rule ...string) error {
+	_, err := ip6tables(append([]string{"-t", string(table), "-D", chain}, rule...))
+	return err
+}
+
+// ip6tables runs ip6tables, waiting for the xtables lock
+func ip6tables(args []string) ([]byte, error) {
+	output, err := exec.Command("ip6tables", append([]string{"--wait"}, args...)...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("ip6tables %s failed: %s (%s)", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return output, nil
+}
+
+// rawRule runs iptables, treating any output as a failure of the chain
+func rawRule(chain string, args []string) error {
+	output, err := iptables.Raw(args...)
+	if err != nil {
+		return err
+	}
+	if len(output) > 0 {
+		return &iptables.ChainError{
+			Chain:  chain,
+			Output: output,
+		}
+	}
+	return nil
+}
+
+// procSysctl is the sysctler of the host, backed by /proc/sys
+type procSysctl struct{}
+
+func (procSysctl) setSysctl(name string, value string) error {
+	return ioutil.WriteFile(filepath.Join("/proc/sys", name), []byte(value), 0644)
+}
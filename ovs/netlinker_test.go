@@ -0,0 +1,358 @@
+package ovs
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/docker/libnetwork/iptables"
+	"github.com/vishvananda/netlink"
+)
+
+// recorder keeps a log of the operations a fake was asked to perform
+type recorder struct {
+	lock sync.Mutex
+	ops  []string
+}
+
+func (r *recorder) record(format string, args ...interface{}) {
+	r.ops = append(r.ops, fmt.Sprintf(format, args...))
+}
+
+// recorded returns the logged operations and clears the log
+func (r *recorder) recorded() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ops := r.ops
+	r.ops = nil
+	return ops
+}
+
+// fakeLinker is a linker and addresser keeping links and addresses in memory.
+// Internal interfaces in the fake OVSDB server show up as links, like
+// ovs-vswitchd would create them.
+type fakeLinker struct {
+	recorder
+	ovsdb  *fakeOvsdb
+	links  map[string]netlink.Link
+	up     map[string]bool
+	addrs  map[string][]netlink.Addr
+	routes []netlink.Route
+	neighs map[string]string
+	// indexes numbers links by name like the kernel does by ifindex
+	indexes map[string]int
+	// fails lists operations, as they would be recorded, that fail instead
+	fails map[string]bool
+}
+
+func newFakeLinker(ovsdb *fakeOvsdb) *fakeLinker {
+	return &fakeLinker{
+		ovsdb:   ovsdb,
+		links:   make(map[string]netlink.Link),
+		up:      make(map[string]bool),
+		addrs:   make(map[string][]netlink.Addr),
+		neighs:  make(map[string]string),
+		indexes: make(map[string]int),
+		fails:   make(map[string]bool),
+	}
+}
+
+// fail returns an error if an operation is set to fail
+func (l *fakeLinker) fail(format string, args ...interface{}) error {
+	if op := fmt.Sprintf(format, args...); l.fails[op] {
+		return fmt.Errorf("%s failed", op)
+	}
+	return nil
+}
+
+// index returns the ifindex of a link, numbering new names as they are seen
+func (l *fakeLinker) index(name string) int {
+	if _, ok := l.indexes[name]; !ok {
+		l.indexes[name] = len(l.indexes) + 1
+	}
+	return l.indexes[name]
+}
+
+// name returns the name of the link with an ifindex
+func (l *fakeLinker) name(index int) string {
+	for name, i := range l.indexes {
+		if i == index {
+			return name
+		}
+	}
+	return ""
+}
+
+// routeString formats a route like ip route does
+func (l *fakeLinker) routeString(route *netlink.Route) string {
+	dst := "default"
+	if route.Dst != nil {
+		dst = route.Dst.String()
+	}
+	if route.Gw != nil {
+		dst += " via " + route.Gw.String()
+	}
+	return dst + " dev " + l.name(route.LinkIndex)
+}
+
+// link returns a link without recording the lookup
+func (l *fakeLinker) link(name string) (netlink.Link, bool) {
+	if link, ok := l.links[name]; ok {
+		return link, true
+	}
+	if l.ovsdb != nil {
+		if _, row, ok := l.ovsdb.rowByName("Interface", name); ok && row["type"] == "internal" {
+			return &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: name, Index: l.index(name)}}, true
+		}
+	}
+	return nil, false
+}
+
+func (l *fakeLinker) LinkAdd(link netlink.Link) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	name := link.Attrs().Name
+	if _, ok := l.link(name); ok {
+		return fmt.Errorf("link %s already exists", name)
+	}
+	l.record("add %s %s", link.Type(), name)
+	link.Attrs().Index = l.index(name)
+	l.links[name] = link
+	if veth, ok := link.(*netlink.Veth); ok {
+		l.links[veth.PeerName] = &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: veth.PeerName}, PeerName: name}
+	}
+	return nil
+}
+
+func (l *fakeLinker) LinkDel(link netlink.Link) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	name := link.Attrs().Name
+	existing, ok := l.links[name]
+	if !ok {
+		return fmt.Errorf("link %s not found", name)
+	}
+	l.record("del %s", name)
+	delete(l.links, name)
+	delete(l.up, name)
+	delete(l.addrs, name)
+	if veth, ok := existing.(*netlink.Veth); ok {
+		delete(l.links, veth.PeerName)
+	}
+	return nil
+}
+
+func (l *fakeLinker) LinkSetUp(link netlink.Link) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	name := link.Attrs().Name
+	if _, ok := l.link(name); !ok {
+		return fmt.Errorf("link %s not found", name)
+	}
+	l.record("up %s", name)
+	l.up[name] = true
+	return nil
+}
+
+func (l *fakeLinker) LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	name := link.Attrs().Name
+	existing, ok := l.link(name)
+	if !ok {
+		return fmt.Errorf("link %s not found", name)
+	}
+	l.record("set %s address %s", name, hwaddr)
+	existing.Attrs().HardwareAddr = hwaddr
+	return nil
+}
+
+func (l *fakeLinker) LinkByName(name string) (netlink.Link, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if link, ok := l.link(name); ok {
+		return link, nil
+	}
+	return nil, fmt.Errorf("link %s not found", name)
+}
+
+func (l *fakeLinker) LinkList() ([]netlink.Link, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var links []netlink.Link
+	for _, link := range l.links {
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+func (l *fakeLinker) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	name := link.Attrs().Name
+	for _, a := range l.addrs[name] {
+		if a.IPNet.String() == addr.IPNet.String() {
+			return fmt.Errorf("address %s already assigned to %s", addr.IPNet, name)
+		}
+	}
+	if err := l.fail("addr add %s %s", name, addr.IPNet); err != nil {
+		return err
+	}
+	l.record("addr add %s %s", name, addr.IPNet)
+	l.addrs[name] = append(l.addrs[name], *addr)
+	return nil
+}
+
+func (l *fakeLinker) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	name := link.Attrs().Name
+	for i, a := range l.addrs[name] {
+		if a.IPNet.String() == addr.IPNet.String() {
+			l.record("addr del %s %s", name, addr.IPNet)
+			l.addrs[name] = append(l.addrs[name][:i], l.addrs[name][i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("address %s not assigned to %s", addr.IPNet, name)
+}
+
+func (l *fakeLinker) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var addrs []netlink.Addr
+	for _, a := range l.addrs[link.Attrs().Name] {
+		v4 := a.IP.To4() != nil
+		if family == netlink.FAMILY_ALL || (family == netlink.FAMILY_V4) == v4 {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs, nil
+}
+
+func (l *fakeLinker) RouteAdd(route *netlink.Route) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, r := range l.routes {
+		if l.routeString(&r) == l.routeString(route) {
+			return fmt.Errorf("route %s already exists", l.routeString(route))
+		}
+	}
+	if err := l.fail("route add %s", l.routeString(route)); err != nil {
+		return err
+	}
+	l.record("route add %s", l.routeString(route))
+	l.routes = append(l.routes, *route)
+	return nil
+}
+
+func (l *fakeLinker) RouteDel(route *netlink.Route) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i, r := range l.routes {
+		if l.routeString(&r) == l.routeString(route) {
+			l.record("route del %s", l.routeString(route))
+			l.routes = append(l.routes[:i], l.routes[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("route %s not found", l.routeString(route))
+}
+
+func (l *fakeLinker) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var routes []netlink.Route
+	for _, r := range l.routes {
+		if r.LinkIndex == link.Attrs().Index {
+			routes = append(routes, r)
+		}
+	}
+	return routes, nil
+}
+
+func (l *fakeLinker) NeighSet(neigh *netlink.Neigh) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	key := neigh.IP.String() + " dev " + l.name(neigh.LinkIndex)
+	l.record("neigh set %s lladdr %s", key, neigh.HardwareAddr)
+	l.neighs[key] = neigh.HardwareAddr.String()
+	return nil
+}
+
+func (l *fakeLinker) NeighDel(neigh *netlink.Neigh) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	key := neigh.IP.String() + " dev " + l.name(neigh.LinkIndex)
+	if _, ok := l.neighs[key]; !ok {
+		return fmt.Errorf("neighbor %s not found", key)
+	}
+	l.record("neigh del %s", key)
+	delete(l.neighs, key)
+	return nil
+}
+
+// fakeFirewall is a firewaller keeping rules in memory
+type fakeFirewall struct {
+	recorder
+	rules map[string]bool
+	// fail, if set, is returned by every insert
+	fail error
+}
+
+func newFakeFirewall() *fakeFirewall {
+	return &fakeFirewall{rules: make(map[string]bool)}
+}
+
+func ruleKey(table iptables.Table, chain string, rule []string) string {
+	return string(table) + " " + chain + " " + strings.Join(rule, " ")
+}
+
+func (f *fakeFirewall) ruleExists(table iptables.Table, chain string, rule ...string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.rules[ruleKey(table, chain, rule)]
+}
+
+func (f *fakeFirewall) insertRule(table iptables.Table, chain string, rule ...string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key := ruleKey(table, chain, rule)
+	if f.fail != nil {
+		return f.fail
+	}
+	f.record("insert %s", key)
+	f.rules[key] = true
+	return nil
+}
+
+func (f *fakeFirewall) deleteRule(table iptables.Table, chain string, rule ...string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key := ruleKey(table, chain, rule)
+	if !f.rules[key] {
+		return fmt.Errorf("rule %s does not exist", key)
+	}
+	f.record("delete %s", key)
+	delete(f.rules, key)
+	return nil
+}
+
+// fakeSysctl is a sysctler keeping kernel parameters in memory
+type fakeSysctl struct {
+	recorder
+	values map[string]string
+}
+
+func newFakeSysctl() *fakeSysctl {
+	return &fakeSysctl{values: make(map[string]string)}
+}
+
+func (s *fakeSysctl) setSysctl(name string, value string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.record("sysctl %s=%s", name, value)
+	s.values[name] = value
+	return nil
+}
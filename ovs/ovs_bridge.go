@@ -3,159 +3,201 @@ package ovs
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/libnetwork/iptables"
-	"github.com/socketplane/libovsdb"
 )
 
 //  setupBridge If bridge does not exist create it.
 func (d *Driver) initBridge(id string) error {
-	bridgeName := d.networks[id].BridgeName
-	if err := d.ovsdber.addBridge(bridgeName); err != nil {
+	ns, err := d.getNetwork(id)
+	if err != nil {
+		return err
+	}
+	bridgeName := ns.BridgeName
+	// A tagged network shares its bridge, so it is recorded on its gateway
+	// port instead of the Bridge row
+	bridgeIDs := networkExternalIDs(id, ns)
+	if ns.VLAN != 0 {
+		bridgeIDs = nil
+	}
+	if err := d.ovsdber.addBridge(bridgeName, bridgeIDs); err != nil {
 		log.Errorf("error creating ovs bridge [ %s ] : [ %s ]", bridgeName, err)
 		return err
 	}
-
-	retries := 3
-	found := false
-	for i := 0; i < retries; i++ {
-		if found = validateIface(bridgeName); found {
-			break
-		}
-		log.Debugf("A link for the OVS bridge named [ %s ] not found, retrying in 2 seconds", bridgeName)
-		time.Sleep(2 * time.Second)
+	if err := d.waitForLink(bridgeName); err != nil {
+		return err
 	}
-	if found == false {
-		return fmt.Errorf("Could not find a link for the OVS bridge named %s", bridgeName)
 
+	// The gateway interface is the bridge itself, or a port on its VLAN
+	gatewayIface := bridgeName
+	if ns.VLAN != 0 {
+		gatewayIface = gatewayPortName(id)
+		err := d.ovsdber.addInternalPort(bridgeName, gatewayIface, ns.VLAN, networkExternalIDs(id, ns))
+		if err != nil && !isExists(err) {
+			log.Errorf("error creating gateway port [ %s ] : [ %s ]", gatewayIface, err)
+			return err
+		}
+		if err := d.waitForLink(gatewayIface); err != nil {
+			return err
+		}
 	}
 
-	bridgeMode := d.networks[id].Mode
+	bridgeMode := ns.Mode
 	switch bridgeMode {
-	case modeNAT:
+	case modeNAT, modeRouted, modeInternal:
 		{
-			gatewayIP := d.networks[id].Gateway + "/" + d.networks[id].GatewayMask
-			if err := setInterfaceIP(bridgeName, gatewayIP); err != nil {
-				log.Debugf("Error assigning address: %s on bridge: %s with an error of: %s", gatewayIP, bridgeName, err)
+			gatewayIPs := ns.gatewayCIDRs()
+			for _, gatewayIP := range gatewayIPs {
+				if err := d.setInterfaceIP(gatewayIface, gatewayIP); err != nil {
+					log.Debugf("Error assigning address: %s on bridge: %s with an error of: %s", gatewayIP, gatewayIface, err)
+				}
 			}
 
 			// Validate that the IPAddress is there!
-			_, err := getIfaceAddr(bridgeName)
-			if err != nil {
-				log.Fatalf("No IP address found on bridge %s", bridgeName)
-				return err
+			if ns.Gateway != "" {
+				if _, err := d.getIfaceAddr(gatewayIface); err != nil {
+					log.Fatalf("No IP address found on bridge %s", gatewayIface)
+					return err
+				}
 			}
 
-			// Add NAT rules for iptables
-			if err = natOut(gatewayIP); err != nil {
-				log.Fatalf("Could not set NAT rules for bridge %s", bridgeName)
-				return err
+			switch bridgeMode {
+			case modeRouted:
+				// Routed networks keep their source addresses
+				if err := d.enableRouting(ns); err != nil {
+					log.Errorf("Could not enable routing for bridge %s: %s", gatewayIface, err)
+					return err
+				}
+			case modeInternal:
+				// Internal networks have no way off the bridge
+				if err := d.isolate(ns, gatewayIface); err != nil {
+					log.Errorf("Could not isolate bridge %s: %s", gatewayIface, err)
+					return err
+				}
+			default:
+				// Add NAT rules for iptables and ip6tables
+				for _, gatewayIP := range gatewayIPs {
+					if err = d.natOut(gatewayIP); err != nil {
+						log.Errorf("Could not set NAT rules for %s on bridge %s: %s", gatewayIP, gatewayIface, err)
+						return err
+					}
+				}
 			}
 		}
 
 	case modeFlat:
 		{
-			//ToDo: Add NIC to the bridge
+			if ns.FlatBindInterface != "" {
+				if err := d.bindUplink(id, ns); err != nil {
+					log.Errorf("Could not bind [ %s ] to bridge [ %s ]: %s", ns.FlatBindInterface, bridgeName, err)
+					return err
+				}
+			}
+		}
+
+	case modeOverlay:
+		{
+			if err := d.addTunnels(id, ns); err != nil {
+				log.Errorf("Could not add the tunnels of bridge [ %s ]: %s", bridgeName, err)
+				return err
+			}
 		}
 	}
 
+	if err := d.addAuxAddresses(gatewayIface, ns); err != nil {
+		log.Errorf("Could not add the auxiliary addresses of bridge [ %s ]: %s", bridgeName, err)
+		return err
+	}
+
 	// Bring the bridge up
-	err := interfaceUp(bridgeName)
+	err = d.interfaceUp(bridgeName)
 	if err != nil {
 		log.Warnf("Error enabling bridge: [ %s ]", err)
 		return err
 	}
+	if gatewayIface != bridgeName {
+		if err := d.interfaceUp(gatewayIface); err != nil {
+			log.Warnf("Error enabling gateway port: [ %s ]", err)
+			return err
+		}
+	}
 
 	return nil
 }
 
-func (ovsdber *ovsdber) createBridgeIface(name string) error {
-	err := ovsdber.createOvsdbBridge(name)
-	if err != nil {
-		log.Errorf("Bridge creation failed for the bridge named [ %s ] with errors: %s", name, err)
+// waitForLink waits for ovs-vswitchd to create the link of an internal port
+func (d *Driver) waitForLink(name string) error {
+	retries := 3
+	for i := 0; i < retries; i++ {
+		if d.validateIface(name) {
+			return nil
+		}
+		log.Debugf("A link for the OVS port named [ %s ] not found, retrying in 2 seconds", name)
+		time.Sleep(2 * time.Second)
 	}
-	return nil
+	return fmt.Errorf("Could not find a link for the OVS port named %s", name)
 }
 
-// createOvsdbBridge creates the OVS bridge
-func (ovsdber *ovsdber) createOvsdbBridge(bridgeName string) error {
-	namedBridgeUUID := "bridge"
-	namedPortUUID := "port"
-	namedIntfUUID := "intf"
-
-	// intf row to insert
-	intf := make(map[string]interface{})
-	intf["name"] = bridgeName
-	intf["type"] = `internal`
-
-	insertIntfOp := libovsdb.Operation{
-		Op:       "insert",
-		Table:    "Interface",
-		Row:      intf,
-		UUIDName: namedIntfUUID,
-	}
-
-	// Port row to insert
-	port := make(map[string]interface{})
-	port["name"] = bridgeName
-	port["interfaces"] = libovsdb.UUID{namedIntfUUID}
-
-	insertPortOp := libovsdb.Operation{
-		Op:       "insert",
-		Table:    "Port",
-		Row:      port,
-		UUIDName: namedPortUUID,
-	}
-
-	// Bridge row to insert
-	bridge := make(map[string]interface{})
-	bridge["name"] = bridgeName
-	bridge["stp_enable"] = false
-	bridge["ports"] = libovsdb.UUID{namedPortUUID}
-
-	insertBridgeOp := libovsdb.Operation{
-		Op:       "insert",
-		Table:    "Bridge",
-		Row:      bridge,
-		UUIDName: namedBridgeUUID,
-	}
-
-	// Inserting a Bridge row in Bridge table requires mutating the open_vswitch table.
-	mutateUUID := []libovsdb.UUID{libovsdb.UUID{namedBridgeUUID}}
-	mutateSet, _ := libovsdb.NewOvsSet(mutateUUID)
-	mutation := libovsdb.NewMutation("bridges", "insert", mutateSet)
-	condition := libovsdb.NewCondition("_uuid", "==", libovsdb.UUID{ovsdber.getRootUUID()})
-
-	// Mutate operation
-	mutateOp := libovsdb.Operation{
-		Op:        "mutate",
-		Table:     "Open_vSwitch",
-		Mutations: []interface{}{mutation},
-		Where:     []interface{}{condition},
-	}
-
-	operations := []libovsdb.Operation{insertIntfOp, insertPortOp, insertBridgeOp, mutateOp}
-	reply, _ := ovsdber.ovsdb.Transact("Open_vSwitch", operations...)
-
-	if len(reply) < len(operations) {
-		return errors.New("Number of Replies should be atleast equal to number of Operations")
-	}
-	for i, o := range reply {
-		if o.Error != "" && i < len(operations) {
-			return errors.New("Transaction Failed due to an error :" + o.Error + " details : " + o.Details)
-		} else if o.Error != "" {
-			return errors.New("Transaction Failed due to an error :" + o.Error + " details : " + o.Details)
+// verifyBridges recreates the bridge of any network that is missing from
+// OVSDB, e.g. after ovsdb-server was restarted with an empty database
+func (d *Driver) verifyBridges() {
+	bridges := make(map[string]bool)
+	for _, row := range d.ovsdber.cache.table("Bridge") {
+		if name, ok := row.Fields["name"].(string); ok {
+			bridges[name] = true
 		}
 	}
-	return nil
+
+	d.lock.RLock()
+	var ids []string
+	for id := range d.networks {
+		ids = append(ids, id)
+	}
+	d.lock.RUnlock()
+
+	for _, id := range ids {
+		ns, err := d.rlockNetwork(id)
+		if err != nil {
+			continue
+		}
+		if !bridges[ns.BridgeName] {
+			log.Warnf("Bridge [ %s ] of network %s is missing from OVSDB, recreating it", ns.BridgeName, id)
+			if err := d.initBridge(id); err != nil {
+				log.Errorf("Could not recreate bridge [ %s ]: %s", ns.BridgeName, err)
+			}
+		}
+		ns.lock.RUnlock()
+	}
 }
 
-// Check if port exists prior to creating a bridge
-func (ovsdber *ovsdber) addBridge(bridgeName string) error {
-	if ovsdber.ovsdb == nil {
+func (ovsdber *ovsdber) createBridgeIface(name string, externalIDs map[string]string) error {
+	err := ovsdber.createOvsdbBridge(name, externalIDs)
+	if err != nil {
+		log.Errorf("Bridge creation failed for the bridge named [ %s ] with errors: %s", name, err)
+	}
+	return err
+}
+
+// createOvsdbBridge creates the OVS bridge, tagging the Bridge row with externalIDs
+func (ovsdber *ovsdber) createOvsdbBridge(bridgeName string, externalIDs map[string]string) error {
+	// A bridge needs an internal port of the same name for its local interface
+	txn := newTransaction()
+	intf := txn.insertInterface(bridgeName, "internal", nil, nil)
+	port := txn.insertPort(bridgeName, intf, 0, nil)
+	bridge := txn.insertBridge(bridgeName, port, externalIDs)
+	txn.attachBridge(ovsdber.getRootUUID(), bridge)
+	_, err := ovsdber.commit(txn)
+	return err
+}
+
+// Check if port exists prior to creating a bridge. A bridge that already
+// exists is re-tagged with externalIDs so that it records its new owner.
+func (ovsdber *ovsdber) addBridge(bridgeName string, externalIDs map[string]string) error {
+	if ovsdber.client() == nil {
 		return errors.New("OVS not connected")
 	}
 	// If the bridge has been created, an internal port with the same name will exist
@@ -164,7 +206,7 @@ func (ovsdber *ovsdber) addBridge(bridgeName string) error {
 		return err
 	}
 	if !exists {
-		if err := ovsdber.createBridgeIface(bridgeName); err != nil {
+		if err := ovsdber.createBridgeIface(bridgeName, externalIDs); err != nil && !isExists(err) {
 			return err
 		}
 		exists, err = ovsdber.portExists(bridgeName)
@@ -174,72 +216,99 @@ func (ovsdber *ovsdber) addBridge(bridgeName string) error {
 		if !exists {
 			return errors.New("Error creating Bridge")
 		}
+		return nil
+	}
+	if len(externalIDs) > 0 {
+		return ovsdber.setExternalIDs("Bridge", bridgeName, externalIDs)
 	}
 	return nil
 }
 
 // deleteBridge deletes the OVS bridge
 func (ovsdber *ovsdber) deleteBridge(bridgeName string) error {
-	namedBridgeUUID := "bridge"
-
-	// simple delete operation
-	condition := libovsdb.NewCondition("name", "==", bridgeName)
-	deleteOp := libovsdb.Operation{
-		Op:    "delete",
-		Table: "Bridge",
-		Where: []interface{}{condition},
-	}
-
-	// Deleting a Bridge row in Bridge table requires mutating the open_vswitch table.
-	mutateUUID := []libovsdb.UUID{libovsdb.UUID{namedBridgeUUID}}
-	mutateSet, _ := libovsdb.NewOvsSet(mutateUUID)
-	mutation := libovsdb.NewMutation("bridges", "delete", mutateSet)
-
-	// simple mutate operation
-	mutateOp := libovsdb.Operation{
-		Op:        "mutate",
-		Table:     "Open_vSwitch",
-		Mutations: []interface{}{mutation},
-		Where:     []interface{}{condition},
-	}
-
-	operations := []libovsdb.Operation{deleteOp, mutateOp}
-	reply, _ := ovsdber.ovsdb.Transact("Open_vSwitch", operations...)
-
-	if len(reply) < len(operations) {
-		log.Error("Number of Replies should be atleast equal to number of Operations")
-	}
-	for i, o := range reply {
-		if o.Error != "" && i < len(operations) {
-			log.Error("Transaction Failed due to an error :", o.Error, " in ", operations[i])
-			errMsg := fmt.Sprintf("Transaction Failed due to an error: %s in operation: %v", o.Error, operations[i])
-			return errors.New(errMsg)
-		} else if o.Error != "" {
-			errMsg := fmt.Sprintf("Transaction Failed due to an error : %s", o.Error)
-			return errors.New(errMsg)
-		}
+	bridgeUUID, err := ovsdber.rowUUID("Bridge", bridgeName)
+	if err != nil {
+		return err
+	}
+
+	txn := newTransaction()
+	txn.deleteByName("Bridge", bridgeName)
+	txn.detachBridge(ovsdber.getRootUUID(), bridgeUUID)
+	if _, err := ovsdber.commit(txn); err != nil {
+		log.Errorf("OVSDB delete bridge transaction failed: %s", err)
+		return err
 	}
 	log.Debugf("OVSDB delete bridge transaction succesful")
 	return nil
 }
 
+// firewallFor returns the firewaller of the address family of an address
+func (d *Driver) firewallFor(addr string) firewaller {
+	if strings.Contains(addr, ":") {
+		return d.firewall6
+	}
+	return d.firewall
+}
+
+// firewalls returns the firewallers of the address families of a network
+func (d *Driver) firewalls(ns *NetworkState) []firewaller {
+	var firewalls []firewaller
+	if ns.Gateway != "" {
+		firewalls = append(firewalls, d.firewall)
+	}
+	if ns.GatewayIPv6 != "" {
+		firewalls = append(firewalls, d.firewall6)
+	}
+	return firewalls
+}
+
 // todo: reconcile with what libnetwork does and port mappings
-func natOut(cidr string) error {
+func (d *Driver) natOut(cidr string) error {
 	masquerade := []string{
-		"POSTROUTING", "-t", "nat",
 		"-s", cidr,
 		"-j", "MASQUERADE",
 	}
-	if _, err := iptables.Raw(
-		append([]string{"-C"}, masquerade...)...,
-	); err != nil {
-		incl := append([]string{"-I"}, masquerade...)
-		if output, err := iptables.Raw(incl...); err != nil {
-			return err
-		} else if len(output) > 0 {
-			return &iptables.ChainError{
-				Chain:  "POSTROUTING",
-				Output: output,
+	firewall := d.firewallFor(cidr)
+	if !firewall.ruleExists(iptables.Nat, "POSTROUTING", masquerade...) {
+		return firewall.insertRule(iptables.Nat, "POSTROUTING", masquerade...)
+	}
+	return nil
+}
+
+// isolationRules returns the FORWARD rules dropping traffic between an
+// interface and any other
+func isolationRules(iface string) [][]string {
+	return [][]string{
+		{"-i", iface, "!", "-o", iface, "-j", "DROP"},
+		{"!", "-i", iface, "-o", iface, "-j", "DROP"},
+	}
+}
+
+// isolate stops the host from forwarding traffic in or out of the gateway
+// interface of a network, for each of its address families
+func (d *Driver) isolate(ns *NetworkState, iface string) error {
+	for _, firewall := range d.firewalls(ns) {
+		for _, rule := range isolationRules(iface) {
+			if firewall.ruleExists(iptables.Filter, "FORWARD", rule...) {
+				continue
+			}
+			if err := firewall.insertRule(iptables.Filter, "FORWARD", rule...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unisolate removes the rules added by isolate
+func (d *Driver) unisolate(ns *NetworkState, iface string) error {
+	for _, firewall := range d.firewalls(ns) {
+		for _, rule := range isolationRules(iface) {
+			if !firewall.ruleExists(iptables.Filter, "FORWARD", rule...) {
+				continue
+			}
+			if err := firewall.deleteRule(iptables.Filter, "FORWARD", rule...); err != nil {
+				return err
 			}
 		}
 	}
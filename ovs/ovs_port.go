@@ -1,261 +1,131 @@
 package ovs
 
 import (
-	"errors"
-	"fmt"
-
 	log "github.com/Sirupsen/logrus"
 	"github.com/socketplane/libovsdb"
 )
 
-func (ovsdber *ovsdber) createOvsInternalPort(prefix string, bridge string, tag uint) (port string, err error) {
-	// if you desire a longer hash add using generateRandomName(prefix, 5)
-	port = prefix
-	if ovsdber.ovsdb == nil {
-		err = errors.New("OVS not connected")
-		return
-	}
-
-	ovsdber.addInternalPort(bridge, port, tag)
-	return
-}
-
-func (ovsdber *ovsdber) addInternalPort(bridgeName string, portName string, tag uint) error {
-	namedPortUUID := "port"
-	namedIntfUUID := "intf"
-
-	// intf row to insert
-	intf := make(map[string]interface{})
-	intf["name"] = portName
-	intf["type"] = `internal`
-
-	insertIntfOp := libovsdb.Operation{
-		Op:       "insert",
-		Table:    "Interface",
-		Row:      intf,
-		UUIDName: namedIntfUUID,
-	}
-
-	// port row to insert
-	port := make(map[string]interface{})
-	port["name"] = portName
-	port["interfaces"] = libovsdb.UUID{namedIntfUUID}
-
-	if tag != 0 {
-		port["tag"] = tag
-	}
-
-	insertPortOp := libovsdb.Operation{
-		Op:       "insert",
-		Table:    "Port",
-		Row:      port,
-		UUIDName: namedPortUUID,
-	}
-
-	// Inserting a row in Port table requires mutating the bridge table.
-	mutateUUID := []libovsdb.UUID{libovsdb.UUID{namedPortUUID}}
-	mutateSet, _ := libovsdb.NewOvsSet(mutateUUID)
-	mutation := libovsdb.NewMutation("ports", "insert", mutateSet)
-	condition := libovsdb.NewCondition("name", "==", bridgeName)
-
-	// Mutate operation
-	mutateOp := libovsdb.Operation{
-		Op:        "mutate",
-		Table:     "Bridge",
-		Mutations: []interface{}{mutation},
-		Where:     []interface{}{condition},
-	}
-
-	operations := []libovsdb.Operation{insertIntfOp, insertPortOp, mutateOp}
-	reply, _ := ovsdber.ovsdb.Transact("Open_vSwitch", operations...)
-	if len(reply) < len(operations) {
-		log.Error("Number of Replies should be atleast equal to number of Operations")
-		return errors.New("Number of Replies should be atleast equal to number of Operations")
-	}
-	for i, o := range reply {
-		if o.Error != "" && i < len(operations) {
-			msg := fmt.Sprintf("Transaction Failed due to an error : %v details: %v in %v", o.Error, o.Details, operations[i])
-			return errors.New(msg)
-		} else if o.Error != "" {
-			msg := fmt.Sprintf("Transaction Failed due to an error : %v", o.Error)
-			return errors.New(msg)
-		}
-	}
-	return nil
+// addInternalPort adds an internal port to a bridge.
+// externalIDs are set on the Port row
+func (ovsdber *ovsdber) addInternalPort(bridgeName string, portName string, tag uint, externalIDs map[string]string) error {
+	txn := newTransaction()
+	intf := txn.insertInterface(portName, "internal", nil, nil)
+	port := txn.insertPort(portName, intf, tag, externalIDs)
+	txn.attachPort(bridgeName, port)
+	_, err := ovsdber.commit(txn)
+	return err
 }
 
 func (ovsdber *ovsdber) deletePort(bridgeName string, portName string) error {
-	condition := libovsdb.NewCondition("name", "==", portName)
-	deleteOp := libovsdb.Operation{
-		Op:    "delete",
-		Table: "Port",
-		Where: []interface{}{condition},
-	}
-
-	portUUID := portUUIDForName(portName)
-	if portUUID == "" {
-		log.Error("Unable to find a matching Port : ", portName)
-		return fmt.Errorf("Unable to find a matching Port : [ %s ]", portName)
-	}
-
-	// Deleting a Bridge row in Bridge table requires mutating the open_vswitch table.
-	mutateUUID := []libovsdb.UUID{libovsdb.UUID{portUUID}}
-	mutateSet, _ := libovsdb.NewOvsSet(mutateUUID)
-	mutation := libovsdb.NewMutation("ports", "delete", mutateSet)
-	condition = libovsdb.NewCondition("name", "==", bridgeName)
-
-	// simple mutate operation
-	mutateOp := libovsdb.Operation{
-		Op:        "mutate",
-		Table:     "Bridge",
-		Mutations: []interface{}{mutation},
-		Where:     []interface{}{condition},
+	portUUID, err := ovsdber.rowUUID("Port", portName)
+	if err != nil {
+		log.Debugf("Unable to find a matching Port : %s", portName)
+		return err
 	}
 
-	operations := []libovsdb.Operation{deleteOp, mutateOp}
-	reply, _ := ovsdber.ovsdb.Transact("Open_vSwitch", operations...)
-
-	if len(reply) < len(operations) {
-		log.Error("Number of Replies should be atleast equal to number of Operations")
-		return fmt.Errorf("Number of Replies should be atleast equal to number of Operations")
-	}
-	for i, o := range reply {
-		if o.Error != "" && i < len(operations) {
-			log.Error("Transaction Failed due to an error :", o.Error, " in ", operations[i])
-			return fmt.Errorf("Transaction Failed due to an error: %s in %v", o.Error, operations[i])
-		} else if o.Error != "" {
-			log.Error("Transaction Failed due to an error :", o.Error)
-			return fmt.Errorf("Transaction Failed due to an error %s", o.Error)
-		}
+	// Removing the port from the bridge is enough for OVSDB to delete it,
+	// the explicit delete makes the intent obvious in the transaction
+	txn := newTransaction()
+	txn.deleteByName("Port", portName)
+	txn.detachPort(bridgeName, portUUID)
+	if _, err := ovsdber.commit(txn); err != nil {
+		log.Errorf("Deleting port [ %s ] from bridge [ %s ] failed: %s", portName, bridgeName, err)
+		return err
 	}
 	return nil
 }
 
-func (ovsdber *ovsdber) addVxlanPort(bridgeName string, portName string, peerAddress string) {
-	namedPortUUID := "port"
-	namedIntfUUID := "intf"
-
-	options := make(map[string]interface{})
-	options["remote_ip"] = peerAddress
-
-	// intf row to insert
-	intf := make(map[string]interface{})
-	intf["name"] = portName
-	intf["type"] = `vxlan`
-	intf["options"], _ = libovsdb.NewOvsMap(options)
-
-	insertIntfOp := libovsdb.Operation{
-		Op:       "insert",
-		Table:    "Interface",
-		Row:      intf,
-		UUIDName: namedIntfUUID,
-	}
-
-	// port row to insert
-	port := make(map[string]interface{})
-	port["name"] = portName
-	port["interfaces"] = libovsdb.UUID{namedIntfUUID}
-
-	insertPortOp := libovsdb.Operation{
-		Op:       "insert",
-		Table:    "Port",
-		Row:      port,
-		UUIDName: namedPortUUID,
-	}
-
-	// Inserting a row in Port table requires mutating the bridge table.
-	mutateUUID := []libovsdb.UUID{libovsdb.UUID{namedPortUUID}}
-	mutateSet, _ := libovsdb.NewOvsSet(mutateUUID)
-	mutation := libovsdb.NewMutation("ports", "insert", mutateSet)
-	condition := libovsdb.NewCondition("name", "==", bridgeName)
-
-	// simple mutate operation
-	mutateOp := libovsdb.Operation{
-		Op:        "mutate",
-		Table:     "Bridge",
-		Mutations: []interface{}{mutation},
-		Where:     []interface{}{condition},
-	}
-	operations := []libovsdb.Operation{insertIntfOp, insertPortOp, mutateOp}
-	reply, _ := ovsdber.ovsdb.Transact("Open_vSwitch", operations...)
-	if len(reply) < len(operations) {
-		fmt.Println("Number of Replies should be atleast equal to number of Operations")
-	}
-	for i, o := range reply {
-		if o.Error != "" && i < len(operations) {
-			fmt.Println("Transaction Failed due to an error :", o.Error, " details:", o.Details, " in ", operations[i])
-		} else if o.Error != "" {
-			fmt.Println("Transaction Failed due to an error :", o.Error)
-		}
-	}
+// addTunnelPort adds a tunnel of type vxlan, gre or geneve to a remote
+// endpoint. options are the Interface options, e.g. remote_ip and key, and
+// tag the access VLAN of the port on the bridge.
+// Tunnel ports are protected where Open vSwitch supports it, OVS never
+// forwards between two of them: the peers of a network are a full mesh, so
+// every host is reached directly and a frame flooded back into the mesh would
+// loop between the bridges.
+func (ovsdber *ovsdber) addTunnelPort(bridgeName string, portName string, tunnelType string, options map[string]string, tag uint) error {
+	txn := newTransaction()
+	intf := txn.insertInterface(portName, tunnelType, options, nil)
+	port := txn.insertPort(portName, intf, tag, nil)
+	txn.attachPort(bridgeName, port)
+	if ovsdber.hasColumn("Port", "protected") {
+		txn.updateByName("Port", portName, map[string]interface{}{"protected": true})
+	}
+	_, err := ovsdber.commit(txn)
+	return err
 }
 
-// Silently fails :/
-func (ovsdber *ovsdber) addOvsVethPort(bridgeName string, portName string, tag uint) error {
-
-	namedPortUUID := "port"
-	namedIntfUUID := "intf"
-
-	// intf row to insert
-	intf := make(map[string]interface{})
-	intf["name"] = portName
-	intf["type"] = `system`
-
-	insertIntfOp := libovsdb.Operation{
-		Op:       "insert",
-		Table:    "Interface",
-		Row:      intf,
-		UUIDName: namedIntfUUID,
-	}
+// addOvsVethPort attaches an existing veth to a bridge.
+// externalIDs are set on both the Port and the Interface row
+func (ovsdber *ovsdber) addOvsVethPort(bridgeName string, portName string, tag uint, externalIDs map[string]string) error {
+	txn := newTransaction()
+	intf := txn.insertInterface(portName, "system", nil, externalIDs)
+	port := txn.insertPort(portName, intf, tag, externalIDs)
+	txn.attachPort(bridgeName, port)
+	_, err := ovsdber.commit(txn)
+	return err
+}
 
-	// port row to insert
-	port := make(map[string]interface{})
-	port["name"] = portName
-	port["interfaces"] = libovsdb.UUID{namedIntfUUID}
+// addUplinkPort attaches a host NIC to a bridge as a system port.
+// externalIDs are set on the Port row
+func (ovsdber *ovsdber) addUplinkPort(bridgeName string, portName string, externalIDs map[string]string) error {
+	txn := newTransaction()
+	intf := txn.insertInterface(portName, "system", nil, nil)
+	port := txn.insertPort(portName, intf, 0, externalIDs)
+	txn.attachPort(bridgeName, port)
+	_, err := ovsdber.commit(txn)
+	return err
+}
 
-	insertPortOp := libovsdb.Operation{
-		Op:       "insert",
-		Table:    "Port",
-		Row:      port,
-		UUIDName: namedPortUUID,
-	}
-	// Inserting a row in Port table requires mutating the bridge table.
-	mutateUUID := []libovsdb.UUID{libovsdb.UUID{namedPortUUID}}
-	mutateSet, _ := libovsdb.NewOvsSet(mutateUUID)
-	mutation := libovsdb.NewMutation("ports", "insert", mutateSet)
-	condition := libovsdb.NewCondition("name", "==", bridgeName)
+// setTrunks sets the VLANs a port trunks. VLAN 0 carries untagged traffic,
+// an empty list trunks every VLAN.
+func (ovsdber *ovsdber) setTrunks(portName string, vlans []uint) error {
+	// NewOvsSet encodes an empty slice as null
+	trunks := libovsdb.OvsSet{GoSet: []interface{}{}}
+	for _, vlan := range vlans {
+		trunks.GoSet = append(trunks.GoSet, vlan)
+	}
+	txn := newTransaction()
+	txn.updateByName("Port", portName, map[string]interface{}{"trunks": trunks})
+	_, err := ovsdber.commit(txn)
+	return err
+}
 
-	// Mutate operation
-	mutateOp := libovsdb.Operation{
-		Op:        "mutate",
-		Table:     "Bridge",
-		Mutations: []interface{}{mutation},
-		Where:     []interface{}{condition},
-	}
-	operations := []libovsdb.Operation{insertIntfOp, insertPortOp, mutateOp}
-	reply, _ := ovsdber.ovsdb.Transact("Open_vSwitch", operations...)
+// patchPort is one end of a pair of patch ports between two bridges
+type patchPort struct {
+	bridge      string
+	name        string
+	tag         uint
+	externalIDs map[string]string
+}
 
-	if len(reply) < len(operations) {
-		log.Error("Number of Replies should be atleast equal to number of Operations")
-	}
-	for i, o := range reply {
-		if o.Error != "" && i < len(operations) {
-			msg := fmt.Sprintf("Transaction Failed due to an error ]", o.Error, " details:", o.Details, " in ", operations[i])
-			return errors.New(msg)
-		} else if o.Error != "" {
-			msg := fmt.Sprintf("Transaction Failed due to an error :", o.Error)
-			return errors.New(msg)
-		}
-	}
-	return nil
+// addPatchPorts connects two bridges with a pair of patch ports peered with
+// each other, in a single transaction
+func (ovsdber *ovsdber) addPatchPorts(a patchPort, b patchPort) error {
+	txn := newTransaction()
+	for _, end := range []struct{ from, to patchPort }{{a, b}, {b, a}} {
+		intf := txn.insertInterface(end.from.name, "patch", map[string]string{"peer": end.to.name}, nil)
+		port := txn.insertPort(end.from.name, intf, end.from.tag, end.from.externalIDs)
+		txn.attachPort(end.from.bridge, port)
+	}
+	_, err := ovsdber.commit(txn)
+	return err
 }
 
-func portUUIDForName(portName string) string {
-	portCache := ovsdbCache["Port"]
-	for key, val := range portCache {
-		if val.Fields["name"] == portName {
-			return key
+// deletePatchPorts removes patch ports from their bridges in a single
+// transaction, skipping any that are already gone
+func (ovsdber *ovsdber) deletePatchPorts(ports ...patchPort) error {
+	txn := newTransaction()
+	for _, p := range ports {
+		portUUID, _, ok := ovsdber.cache.portByName(p.name)
+		if !ok {
+			continue
 		}
+		txn.deleteByName("Port", p.name)
+		txn.detachPort(p.bridge, portUUID)
+	}
+	if len(txn.ops) == 0 {
+		return nil
 	}
-	return ""
+	_, err := ovsdber.commit(txn)
+	return err
 }
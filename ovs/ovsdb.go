@@ -1,9 +1,8 @@
 package ovs
 
 import (
-	"errors"
 	"fmt"
-	"reflect"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -16,27 +15,34 @@ const (
 	contextKey   = "container_id"
 	contextValue = "container_data"
 	minMTU       = 68
-)
 
-var (
-	quit         chan bool
-	update       chan *libovsdb.TableUpdates
-	ovsdbCache   map[string]map[string]libovsdb.Row
-	contextCache map[string]string
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = 30 * time.Second
 )
 
 type ovsdber struct {
+	// lock guards ovsdb, which is replaced when ovsdb-server restarts
+	lock  sync.RWMutex
 	ovsdb *libovsdb.OvsdbClient
+	cache *ovsCache
+	// reconnected is called once the cache has been rebuilt after a reconnect
+	reconnected func()
 }
 
 type OvsdbNotifier struct {
+	ovsdber *ovsdber
 }
 
 func (o OvsdbNotifier) Update(context interface{}, tableUpdates libovsdb.TableUpdates) {
-	populateCache(tableUpdates)
-	update <- &tableUpdates
+	o.ovsdber.cache.populate(tableUpdates)
 }
 func (o OvsdbNotifier) Disconnected(ovsClient *libovsdb.OvsdbClient) {
+	// Connections dropped while reconnecting are not the current one
+	if o.ovsdber == nil || ovsClient != o.ovsdber.client() {
+		return
+	}
+	log.Warnf("Lost the connection to ovsdb-server")
+	go o.ovsdber.reconnect()
 }
 func (o OvsdbNotifier) Locked([]interface{}) {
 }
@@ -45,118 +51,223 @@ func (o OvsdbNotifier) Stolen([]interface{}) {
 func (o OvsdbNotifier) Echo([]interface{}) {
 }
 
-func (ovsdber *ovsdber) initDBCache() {
-	quit = make(chan bool)
-	update = make(chan *libovsdb.TableUpdates)
-	ovsdbCache = make(map[string]map[string]libovsdb.Row)
+// client returns the current ovsdb-server connection
+func (ovsdber *ovsdber) client() *libovsdb.OvsdbClient {
+	ovsdber.lock.RLock()
+	defer ovsdber.lock.RUnlock()
+	return ovsdber.ovsdb
+}
 
-	// Register for ovsdb table notifications
-	var notifier OvsdbNotifier
-	ovsdber.ovsdb.Register(notifier)
-	// Populate ovsdb cache for the default Open_vSwitch db
-	initCache, err := ovsdber.ovsdb.MonitorAll("Open_vSwitch", "")
-	if err != nil {
+func (ovsdber *ovsdber) initDBCache() {
+	// async monitoring of the ovs bridge(s) for table updates. It runs
+	// before the cache is populated, which sends every existing bridge to
+	// it and would block on a full subscriber buffer otherwise.
+	go ovsdber.monitorBridges(ovsdber.cache.subscribe("Bridge"))
+	if err := ovsdber.syncCache(ovsdber.client()); err != nil {
 		log.Errorf("Error populating initial OVSDB cache: %s", err)
 	}
-	populateCache(*initCache)
-	contextCache = make(map[string]string)
-	populateContextCache(ovsdber.ovsdb)
 
-	// async monitoring of the ovs bridge(s) for table updates
-	go ovsdber.monitorBridges()
 	for ovsdber.getRootUUID() == "" {
 		time.Sleep(time.Second * 1)
 	}
 }
 
-func populateContextCache(ovs *libovsdb.OvsdbClient) {
-	if ovs == nil {
-		return
+// syncCache registers for table notifications on a connection and rebuilds
+// the cache from scratch
+func (ovsdber *ovsdber) syncCache(ovs *libovsdb.OvsdbClient) error {
+	ovsdber.cache.reset()
+
+	// Register for ovsdb table notifications
+	ovs.Register(OvsdbNotifier{ovsdber: ovsdber})
+	// Populate ovsdb cache for the default Open_vSwitch db
+	initCache, err := ovs.MonitorAll("Open_vSwitch", "")
+	if err != nil {
+		return err
 	}
-	tableCache := getTableCache("Interface")
-	for _, row := range tableCache {
-		config, ok := row.Fields["other_config"]
-		ovsMap := config.(libovsdb.OvsMap)
-		otherConfig := map[interface{}]interface{}(ovsMap.GoMap)
-		if ok {
-			containerID, ok := otherConfig[contextKey]
-			if ok {
-				contextCache[containerID.(string)] = otherConfig[contextValue].(string)
+	ovsdber.cache.populate(*initCache)
+	return nil
+}
+
+// reconnect dials ovsdb-server with an exponential backoff until it is back,
+// then resyncs the cache and lets the driver verify its bridges
+func (ovsdber *ovsdber) reconnect() {
+	backoff := minReconnectBackoff
+	for {
+		ovs, err := libovsdb.Connect(localhost, ovsdbPort)
+		if err == nil {
+			if err = ovsdber.syncCache(ovs); err == nil {
+				ovsdber.lock.Lock()
+				ovsdber.ovsdb = ovs
+				ovsdber.lock.Unlock()
+				break
 			}
+			ovs.Disconnect()
+		}
+		log.Errorf("could not reconnect to openvswitch on port [ %d ]: %s. Retrying in %s", ovsdbPort, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
 		}
 	}
-}
-
-func getTableCache(tableName string) map[string]libovsdb.Row {
-	return ovsdbCache[tableName]
+	for ovsdber.getRootUUID() == "" {
+		time.Sleep(time.Second * 1)
+	}
+	log.Infof("Reconnected to ovsdb-server")
+	if ovsdber.reconnected != nil {
+		ovsdber.reconnected()
+	}
 }
 
 func (ovsdber *ovsdber) portExists(portName string) (bool, error) {
-	condition := libovsdb.NewCondition("name", "==", portName)
-	selectOp := libovsdb.Operation{
-		Op:    "select",
-		Table: "Port",
-		Where: []interface{}{condition},
+	txn := newTransaction()
+	txn.selectByName("Port", portName)
+	reply, err := ovsdber.commit(txn)
+	if err != nil {
+		return false, err
 	}
-	operations := []libovsdb.Operation{selectOp}
-	reply, _ := ovsdber.ovsdb.Transact("Open_vSwitch", operations...)
+	return len(reply[0].Rows) > 0, nil
+}
 
-	if len(reply) < len(operations) {
-		return false, errors.New("Number of Replies should be atleast equal to number of Operations")
+// rowUUID returns the UUID of a named row. A row inserted moments ago may not
+// have reached the cache yet, so a cache miss asks ovsdb-server.
+func (ovsdber *ovsdber) rowUUID(table string, name string) (string, error) {
+	if uuid, _, ok := ovsdber.cache.rowByName(table, name); ok {
+		return uuid, nil
 	}
-
-	if reply[0].Error != "" {
-		errMsg := fmt.Sprintf("Transaction Failed due to an error: %v", reply[0].Error)
-		return false, errors.New(errMsg)
+	txn := newTransaction()
+	txn.selectByName(table, name)
+	reply, err := ovsdber.commit(txn)
+	if err != nil {
+		return "", err
 	}
-
 	if len(reply[0].Rows) == 0 {
-		return false, nil
+		return "", &notFoundError{Table: table, Name: name}
 	}
-	return true, nil
+	uuid, ok := reply[0].Rows[0]["_uuid"].([]interface{})
+	if !ok || len(uuid) != 2 {
+		return "", fmt.Errorf("invalid _uuid of %s [ %s ]", table, name)
+	}
+	return fmt.Sprint(uuid[1]), nil
 }
 
-func (ovsdber *ovsdber) monitorBridges() {
-	for {
-		select {
-		case currUpdate := <-update:
-			for table, tableUpdate := range currUpdate.Updates {
-				if table == "Bridge" {
-					for _, row := range tableUpdate.Rows {
-						empty := libovsdb.Row{}
-						if !reflect.DeepEqual(row.New, empty) {
-							oldRow := row.Old
-							if _, ok := oldRow.Fields["name"]; ok {
-								name := oldRow.Fields["name"].(string)
-								ovsdber.createOvsdbBridge(name)
-							}
-						}
-					}
-				}
+func (ovsdber *ovsdber) monitorBridges(updates <-chan rowUpdate) {
+	for row := range updates {
+		if !row.deleted() {
+			if name, ok := row.Old.Fields["name"].(string); ok {
+				ovsdber.createOvsdbBridge(name, nil)
 			}
 		}
 	}
 }
 
+// hasColumn reports whether the schema of ovsdb-server has a column, which
+// depends on the Open vSwitch release
+func (ovsdber *ovsdber) hasColumn(table string, column string) bool {
+	ovs := ovsdber.client()
+	if ovs == nil {
+		return false
+	}
+	_, ok := ovs.Schema["Open_vSwitch"].Tables[table].Columns[column]
+	return ok
+}
+
 func (ovsdber *ovsdber) getRootUUID() string {
-	for uuid := range ovsdbCache["Open_vSwitch"] {
-		return uuid
+	return ovsdber.cache.rootUUID()
+}
+
+// setExternalIDs replaces the given external_ids keys on the named row,
+// leaving any other keys in place
+func (ovsdber *ovsdber) setExternalIDs(table string, name string, externalIDs map[string]string) error {
+	txn := newTransaction()
+	txn.setExternalIDs(table, name, externalIDs)
+	_, err := ovsdber.commit(txn)
+	return err
+}
+
+// rowExternalIDs returns the external_ids column of a cached row
+func rowExternalIDs(row libovsdb.Row) map[string]string {
+	return rowMap(row, "external_ids")
+}
+
+// networksFromCache rebuilds the state of every network whose bridge
+// carries the docker network ID in its external_ids
+func (ovsdber *ovsdber) networksFromCache() map[string]*NetworkState {
+	networks := make(map[string]*NetworkState)
+	for _, row := range ovsdber.cache.table("Bridge") {
+		name, ok := row.Fields["name"].(string)
+		if !ok {
+			continue
+		}
+		id, ns, err := networkStateFromExternalIDs(name, rowExternalIDs(row))
+		if err != nil {
+			log.Warnf("Ignoring bridge [ %s ]: %s", name, err)
+			continue
+		}
+		if id != "" {
+			networks[id] = ns
+		}
+	}
+	// Tagged networks are recorded on their gateway port, container ports
+	// also carry a network ID but have an endpoint ID as well
+	for uuid, row := range ovsdber.cache.table("Port") {
+		externalIDs := rowExternalIDs(row)
+		if _, ok := externalIDs[externalIDEndpoint]; ok {
+			continue
+		}
+		bridgeName := ovsdber.cache.bridgeOfPort(uuid)
+		if bridgeName == "" {
+			continue
+		}
+		id, ns, err := networkStateFromExternalIDs(bridgeName, externalIDs)
+		if err != nil {
+			log.Warnf("Ignoring port [ %v ]: %s", row.Fields["name"], err)
+			continue
+		}
+		if id != "" {
+			networks[id] = ns
+		}
+	}
+	return networks
+}
+
+// uplinksFromCache rebuilds the uplink binding of each bridge from the
+// external_ids of its uplink port
+func (ovsdber *ovsdber) uplinksFromCache() map[string]uplinkBinding {
+	uplinks := make(map[string]uplinkBinding)
+	for uuid, row := range ovsdber.cache.table("Port") {
+		externalIDs := rowExternalIDs(row)
+		network, ok := externalIDs[externalIDUplinkNetwork]
+		if !ok {
+			continue
+		}
+		name, _ := row.Fields["name"].(string)
+		bridgeName := ovsdber.cache.bridgeOfPort(uuid)
+		if name == "" || bridgeName == "" {
+			continue
+		}
+		uplinks[bridgeName] = uplinkBinding{
+			Interface: name,
+			Network:   network,
+			Migrated:  externalIDs[externalIDUplinkMigrated] == "true",
+		}
 	}
-	return ""
+	return uplinks
 }
 
-func populateCache(updates libovsdb.TableUpdates) {
-	for table, tableUpdate := range updates.Updates {
-		if _, ok := ovsdbCache[table]; !ok {
-			ovsdbCache[table] = make(map[string]libovsdb.Row)
+// endpointAddresses returns the addresses of the container ports
+func (ovsdber *ovsdber) endpointAddresses() []string {
+	var addresses []string
+	for _, row := range ovsdber.cache.table("Port") {
+		externalIDs := rowExternalIDs(row)
+		if _, ok := externalIDs[externalIDEndpoint]; !ok {
+			continue
 		}
-		for uuid, row := range tableUpdate.Rows {
-			empty := libovsdb.Row{}
-			if !reflect.DeepEqual(row.New, empty) {
-				ovsdbCache[table][uuid] = row.New
-			} else {
-				delete(ovsdbCache[table], uuid)
+		for _, key := range []string{externalIDAddress, externalIDAddressIPv6} {
+			if address := externalIDs[key]; address != "" {
+				addresses = append(addresses, address)
 			}
 		}
 	}
+	return addresses
 }
@@ -0,0 +1,235 @@
+package ovs
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/socketplane/libovsdb"
+)
+
+const (
+	// subscriberBuffer is how many row updates a subscriber may fall behind
+	// before the libovsdb notifier blocks on it
+	subscriberBuffer = 64
+)
+
+// rowUpdate is a change to a single row sent to subscribers of its table
+type rowUpdate struct {
+	UUID string
+	Old  libovsdb.Row
+	New  libovsdb.Row
+}
+
+// deleted reports whether the update removed the row
+func (u rowUpdate) deleted() bool {
+	return reflect.DeepEqual(u.New, libovsdb.Row{})
+}
+
+// ovsCache mirrors the Open_vSwitch database as reported by a MonitorAll. It
+// keeps name indexes for the Bridge, Port and Interface tables and tracks
+// which bridge each port belongs to.
+type ovsCache struct {
+	lock   sync.RWMutex
+	tables map[string]map[string]libovsdb.Row
+	// names maps table -> row name -> row UUID
+	names map[string]map[string]string
+	// portBridge maps port UUID -> bridge UUID
+	portBridge map[string]string
+	// context maps a container ID to its container_data from Interface other_config
+	context     map[string]string
+	subscribers map[string][]chan rowUpdate
+}
+
+func newOvsCache() *ovsCache {
+	c := &ovsCache{
+		subscribers: make(map[string][]chan rowUpdate),
+	}
+	c.reset()
+	return c
+}
+
+// reset drops every cached row, subscriptions are kept
+func (c *ovsCache) reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tables = make(map[string]map[string]libovsdb.Row)
+	c.names = make(map[string]map[string]string)
+	c.portBridge = make(map[string]string)
+	c.context = make(map[string]string)
+}
+
+// subscribe returns a channel receiving every change to rows of a table
+func (c *ovsCache) subscribe(table string) <-chan rowUpdate {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ch := make(chan rowUpdate, subscriberBuffer)
+	c.subscribers[table] = append(c.subscribers[table], ch)
+	return ch
+}
+
+// populate applies table updates to the cache and then notifies subscribers
+func (c *ovsCache) populate(updates libovsdb.TableUpdates) {
+	var notify []func()
+	c.lock.Lock()
+	for table, tableUpdate := range updates.Updates {
+		if _, ok := c.tables[table]; !ok {
+			c.tables[table] = make(map[string]libovsdb.Row)
+		}
+		for uuid, row := range tableUpdate.Rows {
+			update := rowUpdate{UUID: uuid, Old: row.Old, New: row.New}
+			c.apply(table, update)
+			for _, ch := range c.subscribers[table] {
+				ch, update := ch, update
+				notify = append(notify, func() { ch <- update })
+			}
+		}
+	}
+	c.lock.Unlock()
+
+	for _, send := range notify {
+		send()
+	}
+}
+
+// apply updates a single row and its indexes. c.lock must be held.
+func (c *ovsCache) apply(table string, update rowUpdate) {
+	if old, ok := c.tables[table][update.UUID]; ok {
+		if name, ok := old.Fields["name"].(string); ok {
+			delete(c.names[table], name)
+		}
+		if table == "Bridge" {
+			for _, port := range rowUUIDs(old, "ports") {
+				delete(c.portBridge, port)
+			}
+		}
+	}
+	if update.deleted() {
+		delete(c.tables[table], update.UUID)
+		return
+	}
+
+	c.tables[table][update.UUID] = update.New
+	if name, ok := update.New.Fields["name"].(string); ok {
+		if _, ok := c.names[table]; !ok {
+			c.names[table] = make(map[string]string)
+		}
+		c.names[table][name] = update.UUID
+	}
+	switch table {
+	case "Bridge":
+		for _, port := range rowUUIDs(update.New, "ports") {
+			c.portBridge[port] = update.UUID
+		}
+	case "Interface":
+		otherConfig := rowMap(update.New, "other_config")
+		if containerID, ok := otherConfig[contextKey]; ok {
+			c.context[containerID] = otherConfig[contextValue]
+		}
+	}
+}
+
+// table returns a snapshot of the rows of a table keyed by UUID
+func (c *ovsCache) table(name string) map[string]libovsdb.Row {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	rows := make(map[string]libovsdb.Row, len(c.tables[name]))
+	for uuid, row := range c.tables[name] {
+		rows[uuid] = row
+	}
+	return rows
+}
+
+// rowByName returns the UUID and row with the given name
+func (c *ovsCache) rowByName(table string, name string) (string, libovsdb.Row, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	uuid, ok := c.names[table][name]
+	if !ok {
+		return "", libovsdb.Row{}, false
+	}
+	return uuid, c.tables[table][uuid], true
+}
+
+func (c *ovsCache) bridgeByName(name string) (string, libovsdb.Row, bool) {
+	return c.rowByName("Bridge", name)
+}
+
+func (c *ovsCache) portByName(name string) (string, libovsdb.Row, bool) {
+	return c.rowByName("Port", name)
+}
+
+func (c *ovsCache) interfaceByName(name string) (string, libovsdb.Row, bool) {
+	return c.rowByName("Interface", name)
+}
+
+// portsOfBridge returns the Port rows of a bridge keyed by UUID
+func (c *ovsCache) portsOfBridge(bridgeName string) map[string]libovsdb.Row {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	ports := make(map[string]libovsdb.Row)
+	uuid, ok := c.names["Bridge"][bridgeName]
+	if !ok {
+		return ports
+	}
+	for _, port := range rowUUIDs(c.tables["Bridge"][uuid], "ports") {
+		if row, ok := c.tables["Port"][port]; ok {
+			ports[port] = row
+		}
+	}
+	return ports
+}
+
+// bridgeOfPort returns the name of the bridge holding a port
+func (c *ovsCache) bridgeOfPort(portUUID string) string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	bridge, ok := c.portBridge[portUUID]
+	if !ok {
+		return ""
+	}
+	name, _ := c.tables["Bridge"][bridge].Fields["name"].(string)
+	return name
+}
+
+// rootUUID returns the UUID of the single Open_vSwitch row
+func (c *ovsCache) rootUUID() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for uuid := range c.tables["Open_vSwitch"] {
+		return uuid
+	}
+	return ""
+}
+
+// rowUUIDs returns the UUIDs held in a column that is either a single UUID or a set of them
+func rowUUIDs(row libovsdb.Row, column string) []string {
+	var uuids []string
+	switch val := row.Fields[column].(type) {
+	case libovsdb.UUID:
+		uuids = append(uuids, val.GoUuid)
+	case libovsdb.OvsSet:
+		for _, elem := range val.GoSet {
+			if uuid, ok := elem.(libovsdb.UUID); ok {
+				uuids = append(uuids, uuid.GoUuid)
+			}
+		}
+	}
+	return uuids
+}
+
+// rowMap returns a string to string map column of a row
+func rowMap(row libovsdb.Row, column string) map[string]string {
+	m := make(map[string]string)
+	ovsMap, ok := row.Fields[column].(libovsdb.OvsMap)
+	if !ok {
+		return m
+	}
+	for key, val := range ovsMap.GoMap {
+		k, kok := key.(string)
+		v, vok := val.(string)
+		if kok && vok {
+			m[k] = v
+		}
+	}
+	return m
+}
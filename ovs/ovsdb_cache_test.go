@@ -0,0 +1,113 @@
+package ovs
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/socketplane/libovsdb"
+)
+
+func tableUpdate(table string, uuid string, old libovsdb.Row, new libovsdb.Row) libovsdb.TableUpdates {
+	return libovsdb.TableUpdates{Updates: map[string]libovsdb.TableUpdate{
+		table: {Rows: map[string]libovsdb.RowUpdate{uuid: {Old: old, New: new}}},
+	}}
+}
+
+func namedRow(name string) libovsdb.Row {
+	return libovsdb.Row{Fields: map[string]interface{}{"name": name}}
+}
+
+func TestCacheIndexes(t *testing.T) {
+	c := newOvsCache()
+	ports, _ := libovsdb.NewOvsSet([]libovsdb.UUID{{GoUuid: "port1"}, {GoUuid: "port2"}})
+	bridge := libovsdb.Row{Fields: map[string]interface{}{"name": "ovsbr-test", "ports": *ports}}
+
+	c.populate(tableUpdate("Port", "port1", libovsdb.Row{}, namedRow("ovsbr-test")))
+	c.populate(tableUpdate("Port", "port2", libovsdb.Row{}, namedRow(ovsPortPrefix+"abcde")))
+	c.populate(tableUpdate("Bridge", "bridge1", libovsdb.Row{}, bridge))
+
+	if uuid, _, ok := c.bridgeByName("ovsbr-test"); !ok || uuid != "bridge1" {
+		t.Fatalf("expected bridge1, got %q", uuid)
+	}
+	if uuid, _, ok := c.portByName(ovsPortPrefix + "abcde"); !ok || uuid != "port2" {
+		t.Fatalf("expected port2, got %q", uuid)
+	}
+	if got := c.portsOfBridge("ovsbr-test"); len(got) != 2 {
+		t.Fatalf("expected 2 ports on the bridge, got %d", len(got))
+	}
+	if got := c.bridgeOfPort("port2"); got != "ovsbr-test" {
+		t.Fatalf("expected port2 on ovsbr-test, got %q", got)
+	}
+
+	// Renaming a row moves it in the name index
+	c.populate(tableUpdate("Port", "port2", namedRow(ovsPortPrefix+"abcde"), namedRow(ovsPortPrefix+"fghij")))
+	if _, _, ok := c.portByName(ovsPortPrefix + "abcde"); ok {
+		t.Fatal("old port name still indexed after rename")
+	}
+	if _, _, ok := c.portByName(ovsPortPrefix + "fghij"); !ok {
+		t.Fatal("new port name not indexed after rename")
+	}
+
+	c.populate(tableUpdate("Bridge", "bridge1", bridge, libovsdb.Row{}))
+	if _, _, ok := c.bridgeByName("ovsbr-test"); ok {
+		t.Fatal("deleted bridge still indexed")
+	}
+	if got := c.bridgeOfPort("port2"); got != "" {
+		t.Fatalf("port still mapped to deleted bridge %q", got)
+	}
+}
+
+func TestCacheSubscribe(t *testing.T) {
+	c := newOvsCache()
+	bridges := c.subscribe("Bridge")
+
+	c.populate(tableUpdate("Port", "port1", libovsdb.Row{}, namedRow("port")))
+	c.populate(tableUpdate("Bridge", "bridge1", libovsdb.Row{}, namedRow("bridge")))
+	c.populate(tableUpdate("Bridge", "bridge1", namedRow("bridge"), libovsdb.Row{}))
+
+	update := <-bridges
+	if update.UUID != "bridge1" || update.deleted() {
+		t.Fatalf("expected bridge1 to be inserted, got %+v", update)
+	}
+	update = <-bridges
+	if update.UUID != "bridge1" || !update.deleted() {
+		t.Fatalf("expected bridge1 to be deleted, got %+v", update)
+	}
+	select {
+	case update := <-bridges:
+		t.Fatalf("unexpected update %+v", update)
+	default:
+	}
+}
+
+// Run with -race: the cache is populated on the libovsdb notifier goroutine
+// while requests read it.
+func TestConcurrentCacheUpdates(t *testing.T) {
+	c := newOvsCache()
+	o := &ovsdber{cache: c}
+
+	const workers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			uuid := fmt.Sprintf("%08d-0000-0000-0000-000000000000", i)
+			row := namedRow(fmt.Sprintf("%s%05d", ovsPortPrefix, i))
+			c.populate(tableUpdate("Port", uuid, libovsdb.Row{}, row))
+			c.populate(tableUpdate("Port", uuid, row, libovsdb.Row{}))
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			c.portByName(fmt.Sprintf("%s%05d", ovsPortPrefix, i))
+			c.bridgeOfPort("")
+			o.networksFromCache()
+		}(i)
+	}
+	wg.Wait()
+
+	if ports := c.table("Port"); len(ports) != 0 {
+		t.Fatalf("expected every port to be removed from the cache, %d left", len(ports))
+	}
+}
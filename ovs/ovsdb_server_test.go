@@ -0,0 +1,790 @@
+package ovs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/rpc2"
+	"github.com/cenkalti/rpc2/jsonrpc"
+	"github.com/socketplane/libovsdb"
+)
+
+// fakeSchema is the subset of the Open_vSwitch schema the driver uses
+const fakeSchema = `{
+  "name": "Open_vSwitch",
+  "version": "7.6.2",
+  "tables": {
+    "Open_vSwitch": {
+      "columns": {
+        "bridges": {"type": {"key": {"type": "uuid", "refTable": "Bridge"}, "min": 0, "max": "unlimited"}},
+        "ovs_version": {"type": {"key": "string", "min": 0, "max": 1}},
+        "external_ids": {"type": {"key": "string", "value": "string", "min": 0, "max": "unlimited"}},
+        "other_config": {"type": {"key": "string", "value": "string", "min": 0, "max": "unlimited"}}
+      }
+    },
+    "Bridge": {
+      "columns": {
+        "name": {"type": "string", "mutable": false},
+        "ports": {"type": {"key": {"type": "uuid", "refTable": "Port"}, "min": 0, "max": "unlimited"}},
+        "stp_enable": {"type": "boolean"},
+        "fail_mode": {"type": {"key": "string", "min": 0, "max": 1}},
+        "external_ids": {"type": {"key": "string", "value": "string", "min": 0, "max": "unlimited"}},
+        "other_config": {"type": {"key": "string", "value": "string", "min": 0, "max": "unlimited"}}
+      },
+      "indexes": [["name"]]
+    },
+    "Port": {
+      "columns": {
+        "name": {"type": "string", "mutable": false},
+        "interfaces": {"type": {"key": {"type": "uuid", "refTable": "Interface"}, "min": 1, "max": "unlimited"}},
+        "tag": {"type": {"key": {"type": "integer", "minInteger": 0, "maxInteger": 4095}, "min": 0, "max": 1}},
+        "trunks": {"type": {"key": {"type": "integer", "minInteger": 0, "maxInteger": 4095}, "min": 0, "max": 4096}},
+        "vlan_mode": {"type": {"key": "string", "min": 0, "max": 1}},
+        "external_ids": {"type": {"key": "string", "value": "string", "min": 0, "max": "unlimited"}},
+        "other_config": {"type": {"key": "string", "value": "string", "min": 0, "max": "unlimited"}}
+      },
+      "indexes": [["name"]]
+    },
+    "Interface": {
+      "columns": {
+        "name": {"type": "string", "mutable": false},
+        "type": {"type": "string"},
+        "options": {"type": {"key": "string", "value": "string", "min": 0, "max": "unlimited"}},
+        "mac": {"type": {"key": "string", "min": 0, "max": 1}},
+        "mtu_request": {"type": {"key": "integer", "min": 0, "max": 1}},
+        "external_ids": {"type": {"key": "string", "value": "string", "min": 0, "max": "unlimited"}},
+        "other_config": {"type": {"key": "string", "value": "string", "min": 0, "max": "unlimited"}}
+      },
+      "indexes": [["name"]]
+    }
+  }
+}`
+
+type columnKind int
+
+const (
+	kindAtom columnKind = iota
+	kindSet
+	kindMap
+)
+
+// fakeRow maps a column to an atom, a []interface{} set or a
+// map[interface{}]interface{} map. UUIDs are stored as ["uuid", id].
+type fakeRow map[string]interface{}
+
+type fakeDB map[string]map[string]fakeRow
+
+// fakeOvsdb is an in-process OVSDB server speaking enough of RFC 7047 for
+// libovsdb.Connect, MonitorAll and Transact against the Open_vSwitch schema.
+// Rows no longer referenced from the root Open_vSwitch row are garbage
+// collected like ovsdb-server does.
+type fakeOvsdb struct {
+	t         *testing.T
+	listener  net.Listener
+	schema    libovsdb.DatabaseSchema
+	rawSchema map[string]interface{}
+
+	lock     sync.Mutex
+	db       fakeDB
+	rootUUID string
+	uuids    int
+	monitors map[*rpc2.Client]interface{}
+	// transactions records the operations of every transact request
+	transactions [][]map[string]interface{}
+}
+
+func newFakeOvsdb(t *testing.T) *fakeOvsdb {
+	s := &fakeOvsdb{
+		t:        t,
+		db:       make(fakeDB),
+		monitors: make(map[*rpc2.Client]interface{}),
+	}
+	if err := json.Unmarshal([]byte(fakeSchema), &s.schema); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(fakeSchema), &s.rawSchema); err != nil {
+		t.Fatal(err)
+	}
+	for table := range s.schema.Tables {
+		s.db[table] = make(map[string]fakeRow)
+	}
+	s.rootUUID = s.newUUID()
+	s.db["Open_vSwitch"][s.rootUUID] = fakeRow{"bridges": []interface{}{}}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.listener = l
+
+	server := rpc2.NewServer()
+	server.Handle("list_dbs", s.listDbs)
+	server.Handle("get_schema", s.getSchema)
+	server.Handle("monitor", s.monitor)
+	server.Handle("transact", s.transact)
+	server.Handle("echo", func(client *rpc2.Client, args []interface{}, reply *[]interface{}) error {
+		*reply = args
+		return nil
+	})
+	server.OnDisconnect(func(client *rpc2.Client) {
+		s.lock.Lock()
+		delete(s.monitors, client)
+		s.lock.Unlock()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeCodec(jsonrpc.NewJSONCodec(conn))
+		}
+	}()
+	return s
+}
+
+// port returns the TCP port the server listens on
+func (s *fakeOvsdb) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+var (
+	sharedOvsdbOnce sync.Once
+	sharedOvsdb     *fakeOvsdb
+	sharedOvsdber   *ovsdber
+)
+
+// newTestOvsdb returns the fake server, reset to an empty database, and an
+// ovsdber connected to it. libovsdb keeps its connections in an unguarded
+// global map and the driver reconnects whenever a connection drops, so every
+// test shares a single server and connection.
+func newTestOvsdb(t *testing.T) (*fakeOvsdb, *ovsdber) {
+	sharedOvsdbOnce.Do(func() {
+		sharedOvsdb = newFakeOvsdb(t)
+		ovs, err := libovsdb.Connect("127.0.0.1", sharedOvsdb.port())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sharedOvsdber = &ovsdber{ovsdb: ovs, cache: newOvsCache()}
+		sharedOvsdber.initDBCache()
+	})
+	if sharedOvsdber == nil {
+		t.Fatal("no fake OVSDB server")
+	}
+	sharedOvsdb.reset(t)
+	waitFor(t, "the cache to be emptied", func() bool {
+		return len(sharedOvsdber.cache.table("Bridge")) == 0 &&
+			len(sharedOvsdber.cache.table("Port")) == 0
+	})
+	return sharedOvsdb, sharedOvsdber
+}
+
+// reset removes every bridge and forgets the recorded transactions
+func (s *fakeOvsdb) reset(t *testing.T) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.t = t
+	before := copyDB(s.db)
+	s.db["Open_vSwitch"][s.rootUUID]["bridges"] = []interface{}{}
+	s.collectGarbage()
+	s.notify(before)
+	s.transactions = nil
+}
+
+// protectPorts adds the protected column of Open vSwitch 2.11 to the Port
+// table of the fake server and of the schema o's client validates against,
+// until the returned func is called
+func protectPorts(t *testing.T, o *ovsdber) func() {
+	column := libovsdb.ColumnSchema{Type: "boolean"}
+	sharedOvsdb.lock.Lock()
+	sharedOvsdb.schema.Tables["Port"].Columns["protected"] = column
+	sharedOvsdb.lock.Unlock()
+
+	// The client's schema map is read by every transaction, so a copy of
+	// the client gets a schema of its own rather than editing that one
+	var schema libovsdb.DatabaseSchema
+	if err := json.Unmarshal([]byte(fakeSchema), &schema); err != nil {
+		t.Fatal(err)
+	}
+	schema.Tables["Port"].Columns["protected"] = column
+	o.lock.Lock()
+	old := o.ovsdb
+	upgraded := *old
+	upgraded.Schema = map[string]libovsdb.DatabaseSchema{"Open_vSwitch": schema}
+	o.ovsdb = &upgraded
+	o.lock.Unlock()
+
+	return func() {
+		o.lock.Lock()
+		o.ovsdb = old
+		o.lock.Unlock()
+		sharedOvsdb.lock.Lock()
+		delete(sharedOvsdb.schema.Tables["Port"].Columns, "protected")
+		sharedOvsdb.lock.Unlock()
+	}
+}
+
+// lastTransaction returns the operations of the most recent transact request
+func (s *fakeOvsdb) lastTransaction() []map[string]interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.transactions) == 0 {
+		s.t.Fatal("no transaction was sent")
+	}
+	return s.transactions[len(s.transactions)-1]
+}
+
+// rowByName returns a copy of the row of a table with the given name
+func (s *fakeOvsdb) rowByName(table string, name string) (string, fakeRow, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for uuid, row := range s.db[table] {
+		if row["name"] == name {
+			return uuid, copyRow(row), true
+		}
+	}
+	return "", nil, false
+}
+
+// count returns the number of rows in a table
+func (s *fakeOvsdb) count(table string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.db[table])
+}
+
+func (s *fakeOvsdb) newUUID() string {
+	s.uuids++
+	return fmt.Sprintf("%08x-0000-4000-8000-%012x", s.uuids, s.uuids)
+}
+
+func (s *fakeOvsdb) listDbs(client *rpc2.Client, args []interface{}, reply *interface{}) error {
+	*reply = []string{"Open_vSwitch"}
+	return nil
+}
+
+func (s *fakeOvsdb) getSchema(client *rpc2.Client, args []interface{}, reply *interface{}) error {
+	if len(args) != 1 || args[0] != "Open_vSwitch" {
+		return fmt.Errorf("unknown database %v", args)
+	}
+	*reply = s.rawSchema
+	return nil
+}
+
+func (s *fakeOvsdb) monitor(client *rpc2.Client, args []interface{}, reply *interface{}) error {
+	if len(args) != 3 || args[0] != "Open_vSwitch" {
+		return fmt.Errorf("invalid monitor request %v", args)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.monitors[client] = args[1]
+	updates := make(map[string]interface{})
+	for table, rows := range s.db {
+		tableUpdate := make(map[string]interface{})
+		for uuid, row := range rows {
+			tableUpdate[uuid] = map[string]interface{}{"new": s.encodeRow(table, row)}
+		}
+		updates[table] = tableUpdate
+	}
+	*reply = updates
+	return nil
+}
+
+func (s *fakeOvsdb) transact(client *rpc2.Client, args []interface{}, reply *interface{}) error {
+	if len(args) < 1 || args[0] != "Open_vSwitch" {
+		return fmt.Errorf("invalid transact request %v", args)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var ops []map[string]interface{}
+	for _, arg := range args[1:] {
+		op, ok := arg.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid operation %v", arg)
+		}
+		ops = append(ops, op)
+	}
+	s.transactions = append(s.transactions, ops)
+
+	before := copyDB(s.db)
+	named := make(map[string]string)
+	var results []interface{}
+	for _, op := range ops {
+		result, err := s.apply(op, named)
+		if err != nil {
+			// A failed operation aborts the whole transaction
+			s.db = before
+			results = append(results, map[string]interface{}{"error": err.Error(), "details": fmt.Sprintf("%v", op)})
+			for len(results) < len(ops) {
+				results = append(results, nil)
+			}
+			*reply = results
+			return nil
+		}
+		results = append(results, result)
+	}
+	if err := s.checkIndexes(); err != nil {
+		// The operations succeeded, the commit failed
+		s.db = before
+		results = append(results, map[string]interface{}{"error": "constraint violation", "details": err.Error()})
+		*reply = results
+		return nil
+	}
+	s.collectGarbage()
+	s.notify(before)
+	*reply = results
+	return nil
+}
+
+func (s *fakeOvsdb) apply(op map[string]interface{}, named map[string]string) (map[string]interface{}, error) {
+	table, _ := op["table"].(string)
+	if _, ok := s.db[table]; !ok {
+		return nil, fmt.Errorf("unknown table %s", table)
+	}
+	switch op["op"] {
+	case "insert":
+		row := make(fakeRow)
+		values, _ := op["row"].(map[string]interface{})
+		for column, value := range values {
+			v, err := s.decodeValue(table, column, value, named)
+			if err != nil {
+				return nil, err
+			}
+			row[column] = v
+		}
+		uuid := s.newUUID()
+		if name, ok := op["uuid-name"].(string); ok {
+			named[name] = uuid
+		}
+		s.db[table][uuid] = row
+		return map[string]interface{}{"uuid": []interface{}{"uuid", uuid}}, nil
+
+	case "select":
+		uuids, err := s.where(table, op["where"], named)
+		if err != nil {
+			return nil, err
+		}
+		var rows []interface{}
+		for _, uuid := range uuids {
+			row := s.encodeRow(table, s.db[table][uuid])
+			row["_uuid"] = []interface{}{"uuid", uuid}
+			rows = append(rows, row)
+		}
+		if rows == nil {
+			rows = []interface{}{}
+		}
+		return map[string]interface{}{"rows": rows}, nil
+
+	case "delete":
+		uuids, err := s.where(table, op["where"], named)
+		if err != nil {
+			return nil, err
+		}
+		for _, uuid := range uuids {
+			delete(s.db[table], uuid)
+		}
+		return map[string]interface{}{"count": len(uuids)}, nil
+
+	case "update":
+		uuids, err := s.where(table, op["where"], named)
+		if err != nil {
+			return nil, err
+		}
+		values, _ := op["row"].(map[string]interface{})
+		for _, uuid := range uuids {
+			for column, value := range values {
+				v, err := s.decodeValue(table, column, value, named)
+				if err != nil {
+					return nil, err
+				}
+				s.db[table][uuid][column] = v
+			}
+		}
+		return map[string]interface{}{"count": len(uuids)}, nil
+
+	case "mutate":
+		uuids, err := s.where(table, op["where"], named)
+		if err != nil {
+			return nil, err
+		}
+		mutations, _ := op["mutations"].([]interface{})
+		for _, uuid := range uuids {
+			for _, m := range mutations {
+				if err := s.mutate(table, s.db[table][uuid], m, named); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return map[string]interface{}{"count": len(uuids)}, nil
+	}
+	return nil, fmt.Errorf("unsupported operation %v", op["op"])
+}
+
+func (s *fakeOvsdb) mutate(table string, row fakeRow, mutation interface{}, named map[string]string) error {
+	m, ok := mutation.([]interface{})
+	if !ok || len(m) != 3 {
+		return fmt.Errorf("invalid mutation %v", mutation)
+	}
+	column, _ := m[0].(string)
+	mutator, _ := m[1].(string)
+	switch s.kind(table, column) {
+	case kindSet:
+		elems, err := s.decodeValue(table, column, m[2], named)
+		if err != nil {
+			return err
+		}
+		set, _ := row[column].([]interface{})
+		for _, elem := range elems.([]interface{}) {
+			switch mutator {
+			case "insert":
+				if indexOf(set, elem) < 0 {
+					set = append(set, elem)
+				}
+			case "delete":
+				if i := indexOf(set, elem); i >= 0 {
+					set = append(set[:i], set[i+1:]...)
+				}
+			default:
+				return fmt.Errorf("unsupported mutator %s", mutator)
+			}
+		}
+		row[column] = set
+	case kindMap:
+		current, _ := row[column].(map[interface{}]interface{})
+		if current == nil {
+			current = make(map[interface{}]interface{})
+		}
+		value, _ := m[2].([]interface{})
+		if len(value) == 2 && value[0] == "map" {
+			pairs, _ := s.decodeValue(table, column, m[2], named)
+			for k, v := range pairs.(map[interface{}]interface{}) {
+				switch mutator {
+				case "insert":
+					if _, ok := current[k]; !ok {
+						current[k] = v
+					}
+				case "delete":
+					if reflect.DeepEqual(current[k], v) {
+						delete(current, k)
+					}
+				default:
+					return fmt.Errorf("unsupported mutator %s", mutator)
+				}
+			}
+		} else if mutator == "delete" {
+			// Deleting a set of keys
+			keys := []interface{}{m[2]}
+			if len(value) == 2 && value[0] == "set" {
+				keys, _ = value[1].([]interface{})
+			}
+			for _, k := range keys {
+				delete(current, k)
+			}
+		} else {
+			return fmt.Errorf("invalid map mutation %v", mutation)
+		}
+		row[column] = current
+	default:
+		return fmt.Errorf("unsupported mutation of column %s", column)
+	}
+	return nil
+}
+
+// where returns the UUIDs of the rows of a table matching every condition
+func (s *fakeOvsdb) where(table string, where interface{}, named map[string]string) ([]string, error) {
+	conditions, _ := where.([]interface{})
+	var uuids []string
+	for uuid, row := range s.db[table] {
+		match := true
+		for _, c := range conditions {
+			cond, ok := c.([]interface{})
+			if !ok || len(cond) != 3 {
+				return nil, fmt.Errorf("invalid condition %v", c)
+			}
+			column, _ := cond[0].(string)
+			var have, want interface{}
+			if column == "_uuid" {
+				have = []interface{}{"uuid", uuid}
+				want = resolveUUID(cond[2], named)
+			} else {
+				have = row[column]
+				v, err := s.decodeValue(table, column, cond[2], named)
+				if err != nil {
+					return nil, err
+				}
+				want = v
+			}
+			switch cond[1] {
+			case "==":
+				match = match && reflect.DeepEqual(have, want)
+			case "!=":
+				match = match && !reflect.DeepEqual(have, want)
+			default:
+				return nil, fmt.Errorf("unsupported function %v", cond[1])
+			}
+		}
+		if match {
+			uuids = append(uuids, uuid)
+		}
+	}
+	return uuids, nil
+}
+
+// checkIndexes verifies that no two rows share a name in an indexed table.
+// Like ovsdb-server, it runs when the transaction commits, not per insert.
+func (s *fakeOvsdb) checkIndexes() error {
+	var tables []string
+	for table, schema := range s.schema.Tables {
+		if len(schema.Indexes) > 0 {
+			tables = append(tables, table)
+		}
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		names := make(map[interface{}]bool)
+		for _, row := range s.db[table] {
+			if names[row["name"]] {
+				return fmt.Errorf("Transaction causes multiple rows in %q table to have identical values (%q) for index on column \"name\"", table, row["name"])
+			}
+			names[row["name"]] = true
+		}
+	}
+	return nil
+}
+
+// collectGarbage deletes rows that are not reachable from the root row
+func (s *fakeOvsdb) collectGarbage() {
+	for _, parent := range []struct{ table, column, child string }{
+		{"Open_vSwitch", "bridges", "Bridge"},
+		{"Bridge", "ports", "Port"},
+		{"Port", "interfaces", "Interface"},
+	} {
+		referenced := make(map[string]bool)
+		for _, row := range s.db[parent.table] {
+			set, _ := row[parent.column].([]interface{})
+			for _, elem := range set {
+				if ref, ok := elem.([]interface{}); ok && len(ref) == 2 {
+					referenced[ref[1].(string)] = true
+				}
+			}
+		}
+		for uuid := range s.db[parent.child] {
+			if !referenced[uuid] {
+				delete(s.db[parent.child], uuid)
+			}
+		}
+	}
+}
+
+// notify sends the changes since before to every monitoring client
+func (s *fakeOvsdb) notify(before fakeDB) {
+	updates := make(map[string]interface{})
+	for table, rows := range s.db {
+		tableUpdate := make(map[string]interface{})
+		for uuid, row := range rows {
+			old, ok := before[table][uuid]
+			if !ok {
+				tableUpdate[uuid] = map[string]interface{}{"new": s.encodeRow(table, row)}
+			} else if !reflect.DeepEqual(old, row) {
+				changed := make(fakeRow)
+				for column, value := range old {
+					if !reflect.DeepEqual(row[column], value) {
+						changed[column] = value
+					}
+				}
+				tableUpdate[uuid] = map[string]interface{}{
+					"new": s.encodeRow(table, row),
+					"old": s.encodeRow(table, changed),
+				}
+			}
+		}
+		for uuid, old := range before[table] {
+			if _, ok := rows[uuid]; !ok {
+				tableUpdate[uuid] = map[string]interface{}{"old": s.encodeRow(table, old)}
+			}
+		}
+		if len(tableUpdate) > 0 {
+			updates[table] = tableUpdate
+		}
+	}
+	if len(updates) == 0 {
+		return
+	}
+	for client, context := range s.monitors {
+		client.Notify("update", []interface{}{context, updates})
+	}
+}
+
+// kind returns whether a column holds an atom, a set or a map
+func (s *fakeOvsdb) kind(table string, column string) columnKind {
+	columnType, ok := s.schema.Tables[table].Columns[column].Type.(map[string]interface{})
+	if !ok {
+		return kindAtom
+	}
+	if _, ok := columnType["value"]; ok {
+		return kindMap
+	}
+	min, _ := columnType["min"].(float64)
+	max, ok := columnType["max"].(float64)
+	if ok && min == 1 && max == 1 {
+		return kindAtom
+	}
+	return kindSet
+}
+
+// decodeValue converts the wire notation of a column value to its stored form
+func (s *fakeOvsdb) decodeValue(table string, column string, value interface{}, named map[string]string) (interface{}, error) {
+	if _, ok := s.schema.Tables[table].Columns[column]; !ok {
+		return nil, fmt.Errorf("unknown column %s in table %s", column, table)
+	}
+	switch s.kind(table, column) {
+	case kindSet:
+		set := []interface{}{}
+		if v, ok := value.([]interface{}); ok && len(v) == 2 && v[0] == "set" {
+			elems, _ := v[1].([]interface{})
+			for _, elem := range elems {
+				set = append(set, resolveUUID(elem, named))
+			}
+		} else {
+			set = append(set, resolveUUID(value, named))
+		}
+		return set, nil
+	case kindMap:
+		m := make(map[interface{}]interface{})
+		v, ok := value.([]interface{})
+		if !ok || len(v) != 2 || v[0] != "map" {
+			return nil, fmt.Errorf("invalid map %v for column %s", value, column)
+		}
+		pairs, _ := v[1].([]interface{})
+		for _, p := range pairs {
+			pair, ok := p.([]interface{})
+			if !ok || len(pair) != 2 {
+				return nil, fmt.Errorf("invalid map pair %v", p)
+			}
+			m[pair[0]] = resolveUUID(pair[1], named)
+		}
+		return m, nil
+	}
+	return resolveUUID(value, named), nil
+}
+
+// encodeRow converts a stored row to its wire notation
+func (s *fakeOvsdb) encodeRow(table string, row fakeRow) map[string]interface{} {
+	out := make(map[string]interface{})
+	for column, value := range row {
+		switch v := value.(type) {
+		case []interface{}:
+			if s.kind(table, column) == kindSet {
+				if len(v) == 1 {
+					out[column] = v[0]
+				} else {
+					out[column] = []interface{}{"set", v}
+				}
+				continue
+			}
+			out[column] = v
+		case map[interface{}]interface{}:
+			pairs := []interface{}{}
+			for k, val := range v {
+				pairs = append(pairs, []interface{}{k, val})
+			}
+			out[column] = []interface{}{"map", pairs}
+		default:
+			out[column] = v
+		}
+	}
+	return out
+}
+
+// resolveUUID replaces a named-uuid reference with the UUID it was given
+func resolveUUID(value interface{}, named map[string]string) interface{} {
+	v, ok := value.([]interface{})
+	if !ok || len(v) != 2 {
+		return value
+	}
+	if v[0] == "named-uuid" {
+		if uuid, ok := named[v[1].(string)]; ok {
+			return []interface{}{"uuid", uuid}
+		}
+	}
+	return value
+}
+
+func indexOf(set []interface{}, elem interface{}) int {
+	for i, e := range set {
+		if reflect.DeepEqual(e, elem) {
+			return i
+		}
+	}
+	return -1
+}
+
+func copyRow(row fakeRow) fakeRow {
+	c := make(fakeRow, len(row))
+	for column, value := range row {
+		switch v := value.(type) {
+		case []interface{}:
+			c[column] = append([]interface{}{}, v...)
+		case map[interface{}]interface{}:
+			m := make(map[interface{}]interface{}, len(v))
+			for k, val := range v {
+				m[k] = val
+			}
+			c[column] = m
+		default:
+			c[column] = v
+		}
+	}
+	return c
+}
+
+func copyDB(db fakeDB) fakeDB {
+	c := make(fakeDB, len(db))
+	for table, rows := range db {
+		c[table] = make(map[string]fakeRow, len(rows))
+		for uuid, row := range rows {
+			c[table][uuid] = copyRow(row)
+		}
+	}
+	return c
+}
+
+// waitFor polls cond until it is true or a second has passed. Cache updates
+// are delivered asynchronously after a transaction is committed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// fakeMap returns a stored map column as a map of strings
+func fakeMap(row fakeRow, column string) map[string]string {
+	m := make(map[string]string)
+	stored, _ := row[column].(map[interface{}]interface{})
+	for k, v := range stored {
+		m[fmt.Sprint(k)] = fmt.Sprint(v)
+	}
+	return m
+}
+
+// fakeInt returns an integer stored in an optional column, or -1
+func fakeInt(row fakeRow, column string) int {
+	set, _ := row[column].([]interface{})
+	if len(set) != 1 {
+		return -1
+	}
+	n, _ := strconv.Atoi(fmt.Sprint(set[0]))
+	return n
+}
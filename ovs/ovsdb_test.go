@@ -0,0 +1,237 @@
+package ovs
+
+import (
+	"testing"
+
+	"github.com/socketplane/libovsdb"
+)
+
+// opsOf returns the operation names and tables of a transaction
+func opsOf(ops []map[string]interface{}) []string {
+	var names []string
+	for _, op := range ops {
+		names = append(names, op["op"].(string)+" "+op["table"].(string))
+	}
+	return names
+}
+
+func expectOps(t *testing.T, ops []map[string]interface{}, expected ...string) {
+	got := opsOf(ops)
+	if len(got) != len(expected) {
+		t.Fatalf("expected operations %v, got %v", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("expected operations %v, got %v", expected, got)
+		}
+	}
+}
+
+func testNetwork() (string, *NetworkState) {
+	id := "0123456789abcdef0123456789abcdef"
+	return id, &NetworkState{
+		BridgeName:  bridgePrefix + truncateID(id),
+		MTU:         defaultMTU,
+		Mode:        modeNAT,
+		Gateway:     "172.18.40.1",
+		GatewayMask: "24",
+	}
+}
+
+// CreateNetwork adds the bridge with its internal port, tagged with the network
+func TestCreateNetworkTransaction(t *testing.T) {
+	s, o := newTestOvsdb(t)
+
+	id, ns := testNetwork()
+	if err := o.addBridge(ns.BridgeName, networkExternalIDs(id, ns)); err != nil {
+		t.Fatal(err)
+	}
+
+	s.lock.Lock()
+	create := s.transactions[1]
+	s.lock.Unlock()
+	expectOps(t, create, "insert Interface", "insert Port", "insert Bridge", "mutate Open_vSwitch")
+	if create[0]["row"].(map[string]interface{})["type"] != "internal" {
+		t.Fatalf("expected an internal interface, got %v", create[0]["row"])
+	}
+
+	_, bridge, ok := s.rowByName("Bridge", ns.BridgeName)
+	if !ok {
+		t.Fatalf("bridge %s was not created", ns.BridgeName)
+	}
+	ids := fakeMap(bridge, "external_ids")
+	if ids[externalIDNetwork] != id || ids[externalIDMode] != modeNAT || ids[externalIDGateway] != "172.18.40.1/24" {
+		t.Fatalf("unexpected bridge external_ids %v", ids)
+	}
+	if _, _, ok := s.rowByName("Port", ns.BridgeName); !ok {
+		t.Fatal("bridge internal port was not created")
+	}
+
+	// The cache catches up through update notifications
+	waitFor(t, "the bridge to be cached", func() bool {
+		_, _, ok := o.cache.bridgeByName(ns.BridgeName)
+		return ok
+	})
+	networks := o.networksFromCache()
+	if restored, ok := networks[id]; !ok || restored.BridgeName != ns.BridgeName || restored.Gateway != ns.Gateway {
+		t.Fatalf("network not restored from the cache: %v", networks)
+	}
+
+	// Creating the network again re-tags the existing bridge
+	ns.Gateway = "172.18.41.1"
+	if err := o.addBridge(ns.BridgeName, networkExternalIDs(id, ns)); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, s.lastTransaction(), "mutate Bridge")
+	_, bridge, _ = s.rowByName("Bridge", ns.BridgeName)
+	if gw := fakeMap(bridge, "external_ids")[externalIDGateway]; gw != "172.18.41.1/24" {
+		t.Fatalf("expected the gateway to be updated, got %s", gw)
+	}
+	if s.count("Bridge") != 1 {
+		t.Fatalf("expected a single bridge, got %d", s.count("Bridge"))
+	}
+}
+
+// Join attaches the host end of the veth to the bridge, Leave removes it
+func TestJoinLeaveTransactions(t *testing.T) {
+	s, o := newTestOvsdb(t)
+
+	id, ns := testNetwork()
+	if err := o.addBridge(ns.BridgeName, networkExternalIDs(id, ns)); err != nil {
+		t.Fatal(err)
+	}
+
+	endpointID := "fedcba9876543210fedcba9876543210"
+	portName := ovsPortPrefix + truncateID(endpointID)
+	externalIDs := map[string]string{externalIDNetwork: id, externalIDEndpoint: endpointID}
+	if err := o.addOvsVethPort(ns.BridgeName, portName, 0, externalIDs); err != nil {
+		t.Fatal(err)
+	}
+	join := s.lastTransaction()
+	expectOps(t, join, "insert Interface", "insert Port", "mutate Bridge")
+	if join[0]["row"].(map[string]interface{})["type"] != "system" {
+		t.Fatalf("expected a system interface, got %v", join[0]["row"])
+	}
+	if _, ok := join[1]["row"].(map[string]interface{})["tag"]; ok {
+		t.Fatal("an untagged port must not set a tag")
+	}
+
+	portUUID, port, ok := s.rowByName("Port", portName)
+	if !ok {
+		t.Fatalf("port %s was not created", portName)
+	}
+	if fakeMap(port, "external_ids")[externalIDEndpoint] != endpointID {
+		t.Fatalf("port not tagged with its endpoint: %v", port)
+	}
+	_, intf, ok := s.rowByName("Interface", portName)
+	if !ok || fakeMap(intf, "external_ids")[externalIDNetwork] != id {
+		t.Fatalf("interface not tagged with its network: %v", intf)
+	}
+	_, bridge, _ := s.rowByName("Bridge", ns.BridgeName)
+	if indexOf(bridge["ports"].([]interface{}), []interface{}{"uuid", portUUID}) < 0 {
+		t.Fatal("port was not added to the bridge")
+	}
+
+	// Joining twice reports the clash with a typed error
+	if err := o.addOvsVethPort(ns.BridgeName, portName, 0, externalIDs); !isExists(err) {
+		t.Fatalf("expected an exists error, got %v", err)
+	}
+
+	waitFor(t, "the port to be cached", func() bool {
+		return o.cache.bridgeOfPort(portUUID) == ns.BridgeName
+	})
+	if err := o.deletePort(ns.BridgeName, portName); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, s.lastTransaction(), "delete Port", "mutate Bridge")
+	if _, _, ok := s.rowByName("Port", portName); ok {
+		t.Fatal("port was not deleted")
+	}
+	if _, _, ok := s.rowByName("Interface", portName); ok {
+		t.Fatal("interface of the deleted port was not garbage collected")
+	}
+
+	waitFor(t, "the port to leave the cache", func() bool {
+		_, _, ok := o.cache.portByName(portName)
+		return !ok
+	})
+	if err := o.deletePort(ns.BridgeName, portName); !isNotFound(err) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
+
+// A tagged port carries its VLAN on the Port row
+func TestTaggedPortTransaction(t *testing.T) {
+	s, o := newTestOvsdb(t)
+
+	_, ns := testNetwork()
+	if err := o.addBridge(ns.BridgeName, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.addInternalPort(ns.BridgeName, "vlan100", 100, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, port, ok := s.rowByName("Port", "vlan100")
+	if !ok {
+		t.Fatal("port was not created")
+	}
+	if tag := fakeInt(port, "tag"); tag != 100 {
+		t.Fatalf("expected tag 100, got %d", tag)
+	}
+
+	// Adding a port to a missing bridge fails without leaving rows behind
+	if err := o.addInternalPort("missing", "vlan200", 200, nil); !isNotFound(err) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+	if _, _, ok := s.rowByName("Port", "vlan200"); ok {
+		t.Fatal("a failed transaction left its port behind")
+	}
+}
+
+// DeleteNetwork removes the bridge and, with it, every port it holds
+func TestDeleteNetworkTransaction(t *testing.T) {
+	s, o := newTestOvsdb(t)
+
+	id, ns := testNetwork()
+	if err := o.addBridge(ns.BridgeName, networkExternalIDs(id, ns)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the bridge to be cached", func() bool {
+		_, _, ok := o.cache.bridgeByName(ns.BridgeName)
+		return ok
+	})
+	if err := o.deleteBridge(ns.BridgeName); err != nil {
+		t.Fatal(err)
+	}
+	expectOps(t, s.lastTransaction(), "delete Bridge", "mutate Open_vSwitch")
+	if s.count("Bridge") != 0 || s.count("Port") != 0 || s.count("Interface") != 0 {
+		t.Fatalf("expected an empty database, got %d bridges %d ports %d interfaces",
+			s.count("Bridge"), s.count("Port"), s.count("Interface"))
+	}
+
+	waitFor(t, "the bridge to leave the cache", func() bool {
+		_, _, ok := o.cache.bridgeByName(ns.BridgeName)
+		return !ok
+	})
+	if err := o.deleteBridge(ns.BridgeName); !isNotFound(err) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
+
+// ovsdb-server reports a duplicate name when the commit fails, in an extra
+// result after the last operation
+func TestCommitError(t *testing.T) {
+	err := commitError(libovsdb.OperationResult{
+		Error: "constraint violation",
+		Details: `Transaction causes multiple rows in "Port" table to have identical values ("vxlan-01234-0a000002") for index on column "name".  ` +
+			`First row, with UUID 7b9a3e23-6b2c-4c4a-b1a4-3c2f1d0e9a11, was inserted by this transaction.  ` +
+			`Second row, with UUID 0c5e4f2a-8d1b-4e6f-9a3c-2b1d0e9f8a77, existed in the database before this transaction and was not modified by the transaction.`,
+	})
+	if e, ok := err.(*existsError); !ok || e.Table != "Port" || e.Name != "vxlan-01234-0a000002" {
+		t.Fatalf("expected an exists error for the port, got %v", err)
+	}
+	err = commitError(libovsdb.OperationResult{Error: "referential integrity violation", Details: "cannot delete Port row"})
+	if err == nil || isExists(err) {
+		t.Fatalf("expected a generic error, got %v", err)
+	}
+}
@@ -0,0 +1,273 @@
+package ovs
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/socketplane/libovsdb"
+)
+
+// existsError is returned when an insert clashes with a row of the same name
+type existsError struct {
+	Table string
+	Name  string
+}
+
+func (e *existsError) Error() string {
+	return fmt.Sprintf("%s [ %s ] already exists", e.Table, e.Name)
+}
+
+// notFoundError is returned when a row an operation needs does not exist
+type notFoundError struct {
+	Table string
+	Name  string
+}
+
+func (e *notFoundError) Error() string {
+	return fmt.Sprintf("%s [ %s ] not found", e.Table, e.Name)
+}
+
+// opError is any other error ovsdb-server reported for an operation
+type opError struct {
+	Op      libovsdb.Operation
+	Err     string
+	Details string
+}
+
+func (e *opError) Error() string {
+	return fmt.Sprintf("Transaction Failed due to an error: %s details: %s in %s on table %s", e.Err, e.Details, e.Op.Op, e.Op.Table)
+}
+
+// indexViolation matches the details ovsdb-server gives when a commit fails
+// because two rows of a table share a value of an indexed column, e.g. name
+var indexViolation = regexp.MustCompile(`multiple rows in "([^"]+)" table to have identical values \((.*?)\) for index`)
+
+// commitError returns the error of the extra result ovsdb-server appends when
+// the commit of a transaction fails. A duplicate name is an existsError.
+func commitError(o libovsdb.OperationResult) error {
+	if o.Error == "constraint violation" {
+		if m := indexViolation.FindStringSubmatch(o.Details); m != nil {
+			name, err := strconv.Unquote(m[2])
+			if err != nil {
+				name = m[2]
+			}
+			return &existsError{Table: m[1], Name: name}
+		}
+	}
+	return fmt.Errorf("Transaction Failed due to an error: %s details: %s", o.Error, o.Details)
+}
+
+func isExists(err error) bool {
+	_, ok := err.(*existsError)
+	return ok
+}
+
+func isNotFound(err error) bool {
+	_, ok := err.(*notFoundError)
+	return ok
+}
+
+// transaction composes OVSDB operations that are committed atomically
+type transaction struct {
+	ops []libovsdb.Operation
+	// names holds the name of the row each operation targets, for errors
+	names []string
+	// mustMatch marks mutations that fail if their where clause matched no row
+	mustMatch []bool
+	uuids     int
+}
+
+func newTransaction() *transaction {
+	return &transaction{}
+}
+
+func (t *transaction) add(op libovsdb.Operation, name string, mustMatch bool) {
+	t.ops = append(t.ops, op)
+	t.names = append(t.names, name)
+	t.mustMatch = append(t.mustMatch, mustMatch)
+}
+
+// namedUUID returns a new uuid-name for a row inserted by the transaction
+func (t *transaction) namedUUID(prefix string) string {
+	t.uuids++
+	return fmt.Sprintf("%s%d", prefix, t.uuids)
+}
+
+// insertInterface inserts an Interface row and returns its uuid-name
+func (t *transaction) insertInterface(name string, ifaceType string, options map[string]string, externalIDs map[string]string) string {
+	uuid := t.namedUUID("intf")
+	intf := make(map[string]interface{})
+	intf["name"] = name
+	intf["type"] = ifaceType
+	if len(options) > 0 {
+		intf["options"], _ = libovsdb.NewOvsMap(options)
+	}
+	if len(externalIDs) > 0 {
+		intf["external_ids"], _ = libovsdb.NewOvsMap(externalIDs)
+	}
+	t.add(libovsdb.Operation{
+		Op:       "insert",
+		Table:    "Interface",
+		Row:      intf,
+		UUIDName: uuid,
+	}, name, false)
+	return uuid
+}
+
+// insertPort inserts a Port row holding a single interface and returns its
+// uuid-name. A zero tag leaves the port untagged.
+func (t *transaction) insertPort(name string, intfUUID string, tag uint, externalIDs map[string]string) string {
+	uuid := t.namedUUID("port")
+	port := make(map[string]interface{})
+	port["name"] = name
+	port["interfaces"] = libovsdb.UUID{GoUuid: intfUUID}
+	if tag != 0 {
+		port["tag"] = tag
+	}
+	if len(externalIDs) > 0 {
+		port["external_ids"], _ = libovsdb.NewOvsMap(externalIDs)
+	}
+	t.add(libovsdb.Operation{
+		Op:       "insert",
+		Table:    "Port",
+		Row:      port,
+		UUIDName: uuid,
+	}, name, false)
+	return uuid
+}
+
+// insertBridge inserts a Bridge row holding a single port and returns its uuid-name
+func (t *transaction) insertBridge(name string, portUUID string, externalIDs map[string]string) string {
+	uuid := t.namedUUID("bridge")
+	bridge := make(map[string]interface{})
+	bridge["name"] = name
+	bridge["stp_enable"] = false
+	bridge["ports"] = libovsdb.UUID{GoUuid: portUUID}
+	if len(externalIDs) > 0 {
+		bridge["external_ids"], _ = libovsdb.NewOvsMap(externalIDs)
+	}
+	t.add(libovsdb.Operation{
+		Op:       "insert",
+		Table:    "Bridge",
+		Row:      bridge,
+		UUIDName: uuid,
+	}, name, false)
+	return uuid
+}
+
+// mutateSet inserts or deletes a UUID in a set column of the rows matching where
+func (t *transaction) mutateSet(table string, name string, column string, mutator string, uuid string, where []interface{}) {
+	set, _ := libovsdb.NewOvsSet([]libovsdb.UUID{{GoUuid: uuid}})
+	t.add(libovsdb.Operation{
+		Op:        "mutate",
+		Table:     table,
+		Mutations: []interface{}{libovsdb.NewMutation(column, mutator, set)},
+		Where:     where,
+	}, name, true)
+}
+
+// attachPort adds a port to a bridge
+func (t *transaction) attachPort(bridgeName string, portUUID string) {
+	t.mutateSet("Bridge", bridgeName, "ports", "insert", portUUID, []interface{}{libovsdb.NewCondition("name", "==", bridgeName)})
+}
+
+// detachPort removes a port from a bridge
+func (t *transaction) detachPort(bridgeName string, portUUID string) {
+	t.mutateSet("Bridge", bridgeName, "ports", "delete", portUUID, []interface{}{libovsdb.NewCondition("name", "==", bridgeName)})
+}
+
+// attachBridge adds a bridge to the root Open_vSwitch row
+func (t *transaction) attachBridge(rootUUID string, bridgeUUID string) {
+	t.mutateSet("Open_vSwitch", rootUUID, "bridges", "insert", bridgeUUID, []interface{}{libovsdb.NewCondition("_uuid", "==", libovsdb.UUID{GoUuid: rootUUID})})
+}
+
+// detachBridge removes a bridge from the root Open_vSwitch row
+func (t *transaction) detachBridge(rootUUID string, bridgeUUID string) {
+	t.mutateSet("Open_vSwitch", rootUUID, "bridges", "delete", bridgeUUID, []interface{}{libovsdb.NewCondition("_uuid", "==", libovsdb.UUID{GoUuid: rootUUID})})
+}
+
+// deleteByName deletes the rows of a table with the given name
+func (t *transaction) deleteByName(table string, name string) {
+	t.add(libovsdb.Operation{
+		Op:    "delete",
+		Table: table,
+		Where: []interface{}{libovsdb.NewCondition("name", "==", name)},
+	}, name, false)
+}
+
+// updateByName sets columns of the row of a table with the given name
+func (t *transaction) updateByName(table string, name string, row map[string]interface{}) {
+	t.add(libovsdb.Operation{
+		Op:    "update",
+		Table: table,
+		Row:   row,
+		Where: []interface{}{libovsdb.NewCondition("name", "==", name)},
+	}, name, true)
+}
+
+// selectByName selects the rows of a table with the given name
+func (t *transaction) selectByName(table string, name string) {
+	t.add(libovsdb.Operation{
+		Op:    "select",
+		Table: table,
+		Where: []interface{}{libovsdb.NewCondition("name", "==", name)},
+	}, name, false)
+}
+
+// setExternalIDs replaces the given external_ids keys on the named row,
+// leaving any other keys in place
+func (t *transaction) setExternalIDs(table string, name string, externalIDs map[string]string) {
+	var keys []string
+	for key := range externalIDs {
+		keys = append(keys, key)
+	}
+	keySet, _ := libovsdb.NewOvsSet(keys)
+	idMap, _ := libovsdb.NewOvsMap(externalIDs)
+	t.add(libovsdb.Operation{
+		Op:    "mutate",
+		Table: table,
+		Mutations: []interface{}{
+			libovsdb.NewMutation("external_ids", "delete", keySet),
+			libovsdb.NewMutation("external_ids", "insert", idMap),
+		},
+		Where: []interface{}{libovsdb.NewCondition("name", "==", name)},
+	}, name, true)
+}
+
+// commit runs the transaction, returning a notFoundError or opError for the
+// first operation that failed, or an existsError if the commit failed on a
+// duplicate name
+func (ovsdber *ovsdber) commit(t *transaction) ([]libovsdb.OperationResult, error) {
+	ovs := ovsdber.client()
+	if ovs == nil {
+		return nil, errors.New("OVS not connected")
+	}
+	reply, err := ovs.Transact("Open_vSwitch", t.ops...)
+	if err != nil {
+		return nil, fmt.Errorf("OVSDB transaction failed: %s", err)
+	}
+	if len(reply) < len(t.ops) {
+		return nil, errors.New("Number of Replies should be atleast equal to number of Operations")
+	}
+	for i, o := range reply {
+		if i >= len(t.ops) {
+			// ovsdb-server appends an extra result when the commit itself fails
+			if o.Error != "" {
+				return nil, commitError(o)
+			}
+			continue
+		}
+		op := t.ops[i]
+		switch {
+		case o.Error != "":
+			log.Debugf("OVSDB operation %+v failed: %s %s", op, o.Error, o.Details)
+			return nil, &opError{Op: op, Err: o.Error, Details: o.Details}
+		case t.mustMatch[i] && o.Count == 0:
+			return nil, &notFoundError{Table: op.Table, Name: t.names[i]}
+		}
+	}
+	return reply, nil
+}
@@ -0,0 +1,213 @@
+package ovs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Two networks are peered by a pair of OVS patch ports between their
+// bridges. Each patch port carries the VLAN of its own network, so tagged
+// networks on shared bridges can be peered too. The pair is recorded in the
+// external_ids of the Port rows, OVSDB is the only record of a peering.
+
+const (
+	patchPortPrefix = "patch-"
+)
+
+// peering is a pair of networks connected by patch ports
+type peering struct {
+	Network string
+	Peer    string
+}
+
+// patchPortName returns the name of the patch port of a network towards a peer
+func patchPortName(id string, peerID string) string {
+	return patchPortPrefix + truncateID(id) + "-" + truncateID(peerID)
+}
+
+// resolveNetwork returns the ID of the network with the given ID or unique
+// ID prefix
+func (d *Driver) resolveNetwork(ref string) (string, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if _, ok := d.networks[ref]; ok {
+		return ref, nil
+	}
+	var matches []string
+	for id := range d.networks {
+		if ref != "" && strings.HasPrefix(id, ref) {
+			matches = append(matches, id)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("network %s not found", ref)
+	case 1:
+		return matches[0], nil
+	}
+	return "", fmt.Errorf("network %s is ambiguous, it matches %d networks", ref, len(matches))
+}
+
+// patchPorts returns the patch ports connecting two networks
+func patchPorts(id string, ns *NetworkState, peerID string, peer *NetworkState) (patchPort, patchPort) {
+	return patchPort{
+		bridge: ns.BridgeName,
+		name:   patchPortName(id, peerID),
+		tag:    ns.VLAN,
+		externalIDs: map[string]string{
+			externalIDPatchNetwork: id,
+			externalIDPatchPeer:    peerID,
+		},
+	}, patchPort{
+		bridge: peer.BridgeName,
+		name:   patchPortName(peerID, id),
+		tag:    peer.VLAN,
+		externalIDs: map[string]string{
+			externalIDPatchNetwork: peerID,
+			externalIDPatchPeer:    id,
+		},
+	}
+}
+
+// addPeering connects two networks. Both networks must be locked.
+func (d *Driver) addPeering(id string, ns *NetworkState, peerID string, peer *NetworkState) error {
+	if id == peerID {
+		return fmt.Errorf("network %s cannot be peered with itself", id)
+	}
+	if ns.BridgeName == peer.BridgeName {
+		return fmt.Errorf("networks %s and %s share bridge %s and cannot be peered", id, peerID, ns.BridgeName)
+	}
+	a, b := patchPorts(id, ns, peerID, peer)
+	if err := d.ovsdber.addPatchPorts(a, b); err != nil {
+		if isExists(err) {
+			return fmt.Errorf("networks %s and %s are already peered", id, peerID)
+		}
+		return err
+	}
+	log.Infof("Peered bridge [ %s ] of network %s with bridge [ %s ] of network %s", ns.BridgeName, id, peer.BridgeName, peerID)
+	return nil
+}
+
+// peerOnCreate peers a network being created, which the caller has locked,
+// with an existing network
+func (d *Driver) peerOnCreate(id string, ns *NetworkState, peerID string) error {
+	peer, err := d.rlockNetwork(peerID)
+	if err != nil {
+		return err
+	}
+	defer peer.lock.RUnlock()
+	return d.addPeering(id, ns, peerID, peer)
+}
+
+// connectNetworks peers two existing networks
+func (d *Driver) connectNetworks(ref string, peerRef string) error {
+	id, peerID, ns, peer, err := d.rlockPeers(ref, peerRef)
+	if err != nil {
+		return err
+	}
+	defer ns.lock.RUnlock()
+	defer peer.lock.RUnlock()
+	return d.addPeering(id, ns, peerID, peer)
+}
+
+// disconnectNetworks removes the peering of two networks
+func (d *Driver) disconnectNetworks(ref string, peerRef string) error {
+	id, peerID, ns, peer, err := d.rlockPeers(ref, peerRef)
+	if err != nil {
+		return err
+	}
+	defer ns.lock.RUnlock()
+	defer peer.lock.RUnlock()
+	a, b := patchPorts(id, ns, peerID, peer)
+	if _, _, ok := d.ovsdber.cache.portByName(a.name); !ok {
+		return fmt.Errorf("networks %s and %s are not peered", id, peerID)
+	}
+	if err := d.ovsdber.deletePatchPorts(a, b); err != nil {
+		return err
+	}
+	log.Infof("Removed the peering of networks %s and %s", id, peerID)
+	return nil
+}
+
+// rlockPeers resolves two networks and locks them for reading
+func (d *Driver) rlockPeers(ref string, peerRef string) (string, string, *NetworkState, *NetworkState, error) {
+	id, err := d.resolveNetwork(ref)
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+	peerID, err := d.resolveNetwork(peerRef)
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+	if id == peerID {
+		return "", "", nil, nil, fmt.Errorf("network %s cannot be peered with itself", id)
+	}
+	ns, err := d.rlockNetwork(id)
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+	peer, err := d.rlockNetwork(peerID)
+	if err != nil {
+		ns.lock.RUnlock()
+		return "", "", nil, nil, err
+	}
+	return id, peerID, ns, peer, nil
+}
+
+// peerings lists the peered networks, each pair once
+func (d *Driver) peerings() []peering {
+	seen := make(map[peering]bool)
+	peerings := []peering{}
+	for _, row := range d.ovsdber.cache.table("Port") {
+		externalIDs := rowExternalIDs(row)
+		p := peering{Network: externalIDs[externalIDPatchNetwork], Peer: externalIDs[externalIDPatchPeer]}
+		if p.Network == "" || p.Peer == "" {
+			continue
+		}
+		if p.Peer < p.Network {
+			p.Network, p.Peer = p.Peer, p.Network
+		}
+		if !seen[p] {
+			seen[p] = true
+			peerings = append(peerings, p)
+		}
+	}
+	sort.Sort(peeringList(peerings))
+	return peerings
+}
+
+type peeringList []peering
+
+func (l peeringList) Len() int { return len(l) }
+func (l peeringList) Less(i, j int) bool {
+	if l[i].Network != l[j].Network {
+		return l[i].Network < l[j].Network
+	}
+	return l[i].Peer < l[j].Peer
+}
+func (l peeringList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+// removePeerings deletes the patch ports on both ends of every peering of a
+// network that is being deleted
+func (d *Driver) removePeerings(id string) error {
+	var ports []patchPort
+	for uuid, row := range d.ovsdber.cache.table("Port") {
+		externalIDs := rowExternalIDs(row)
+		if externalIDs[externalIDPatchNetwork] != id && externalIDs[externalIDPatchPeer] != id {
+			continue
+		}
+		name, _ := row.Fields["name"].(string)
+		ports = append(ports, patchPort{bridge: d.ovsdber.cache.bridgeOfPort(uuid), name: name})
+	}
+	if len(ports) == 0 {
+		return nil
+	}
+	if err := d.ovsdber.deletePatchPorts(ports...); err != nil {
+		return err
+	}
+	log.Infof("Removed %d patch port(s) peering network %s", len(ports), id)
+	return nil
+}
@@ -0,0 +1,145 @@
+package ovs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gopher-net/dknet"
+)
+
+const peerNetworkID = "fedcba9876543210fedcba9876543210"
+
+// expectPatchPort checks a patch port is on a bridge and peered with another
+func expectPatchPort(t *testing.T, bridgeName string, portName string, peerName string, tag int) {
+	portUUID, port, ok := sharedOvsdb.rowByName("Port", portName)
+	if !ok {
+		t.Fatalf("patch port %s not found", portName)
+	}
+	_, bridge, _ := sharedOvsdb.rowByName("Bridge", bridgeName)
+	if indexOf(bridge["ports"].([]interface{}), []interface{}{"uuid", portUUID}) < 0 {
+		t.Fatalf("patch port %s is not on bridge %s", portName, bridgeName)
+	}
+	_, intf, _ := sharedOvsdb.rowByName("Interface", portName)
+	if intf["type"] != "patch" || fakeMap(intf, "options")["peer"] != peerName {
+		t.Fatalf("%s is not a patch port peered with %s: %v", portName, peerName, intf)
+	}
+	if got := fakeInt(port, "tag"); got != tag {
+		t.Fatalf("expected patch port %s to have tag %d, got %d", portName, tag, got)
+	}
+}
+
+func TestPeerOnCreate(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	id, _ := createTestNetwork(t, d)
+	err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+		NetworkID: peerNetworkID,
+		Options: map[string]interface{}{genericOption: map[string]interface{}{
+			peerNetworkOption: "0123",
+			vlanOption:        "30",
+			bridgeNameOption:  "ovsbr-backend",
+		}},
+		IPv4Data: []*dknet.IPAMData{{Gateway: "10.5.0.1/24"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPatchPort(t, "ovsbr-01234", "patch-01234-fedcb", "patch-fedcb-01234", -1)
+	expectPatchPort(t, "ovsbr-backend", "patch-fedcb-01234", "patch-01234-fedcb", 30)
+
+	waitFor(t, "the patch ports to be cached", func() bool {
+		return len(d.peerings()) == 1
+	})
+	if p := d.peerings()[0]; p.Network != id || p.Peer != peerNetworkID {
+		t.Fatalf("unexpected peering %+v", p)
+	}
+	// Deleting either network removes both ends
+	if err := d.DeleteNetwork(&dknet.DeleteNetworkRequest{NetworkID: peerNetworkID}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"patch-01234-fedcb", "patch-fedcb-01234"} {
+		if _, _, ok := sharedOvsdb.rowByName("Port", name); ok {
+			t.Fatalf("patch port %s was not removed", name)
+		}
+	}
+
+	err = d.CreateNetwork(&dknet.CreateNetworkRequest{
+		NetworkID: peerNetworkID,
+		Options:   map[string]interface{}{peerNetworkOption: "9999"},
+		IPv4Data:  []*dknet.IPAMData{{Gateway: "10.5.0.1/24"}},
+	})
+	if err == nil {
+		t.Fatal("expected peering with an unknown network to fail")
+	}
+}
+
+// adminRequest sends a request to the admin API and decodes the reply
+func adminRequest(t *testing.T, server *httptest.Server, method string, body string, reply interface{}) int {
+	req, err := http.NewRequest(method, server.URL+"/peerings", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(reply); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func TestAdminPeerings(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	server := httptest.NewServer(d.adminHandler())
+	defer server.Close()
+
+	id, _ := createTestNetwork(t, d)
+	err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+		NetworkID: peerNetworkID,
+		Options:   map[string]interface{}{modeOption: modeInternal},
+		IPv4Data:  []*dknet.IPAMData{{Gateway: "10.5.0.1/24"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reply map[string]string
+	if status := adminRequest(t, server, "POST", `{"Network": "01234", "Peer": "fedcb"}`, &reply); status != http.StatusOK {
+		t.Fatalf("peering failed with %d: %v", status, reply)
+	}
+	expectPatchPort(t, "ovsbr-fedcb", "patch-fedcb-01234", "patch-01234-fedcb", -1)
+	waitFor(t, "the patch ports to be cached", func() bool {
+		return len(d.peerings()) == 1
+	})
+	var peerings []peering
+	adminRequest(t, server, "GET", "", &peerings)
+	if len(peerings) != 1 || peerings[0].Network != id || peerings[0].Peer != peerNetworkID {
+		t.Fatalf("unexpected peerings %+v", peerings)
+	}
+
+	for _, body := range []string{
+		`{"Network": "01234", "Peer": "fedcb"}`,
+		`{"Network": "01234", "Peer": "01234"}`,
+		`{"Network": "01234", "Peer": "none"}`,
+		`not json`,
+	} {
+		reply = nil
+		if status := adminRequest(t, server, "POST", body, &reply); status != http.StatusBadRequest || reply["Err"] == "" {
+			t.Fatalf("expected %s to fail, got %d: %v", body, status, reply)
+		}
+	}
+
+	if status := adminRequest(t, server, "DELETE", `{"Network": "fedcb", "Peer": "01234"}`, &reply); status != http.StatusOK {
+		t.Fatalf("removing the peering failed with %d: %v", status, reply)
+	}
+	if _, _, ok := sharedOvsdb.rowByName("Port", "patch-01234-fedcb"); ok {
+		t.Fatal("patch port was not removed")
+	}
+}
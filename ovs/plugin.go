@@ -0,0 +1,194 @@
+package ovs
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/sockets"
+	"github.com/gopher-net/dknet"
+)
+
+// The plugin API docker calls is served by the driver rather than by dknet's
+// handler, which answers GetCapabilities with a fixed local scope, has no
+// IPv6 gateway in its JoinResponse and knows none of the IpamDriver calls in
+// the dknet revision pinned in Godeps. The request types dknet has are used
+// as they are, the others are below and in ipam.go.
+
+const (
+	pluginSocketDir   = "/run/docker/plugins"
+	pluginContentType = "application/vnd.docker.plugins.v1.1+json"
+)
+
+// CapabilitiesResponse answers NetworkDriver.GetCapabilities
+type CapabilitiesResponse struct {
+	Scope string
+}
+
+// JoinResponse answers NetworkDriver.Join
+type JoinResponse struct {
+	Gateway       string
+	GatewayIPv6   string
+	InterfaceName dknet.InterfaceName
+	StaticRoutes  []*dknet.StaticRoute
+}
+
+// ServePlugin serves the plugin API on the socket docker finds the plugin
+// called name at, until it fails
+func (d *Driver) ServePlugin(name string, group string) error {
+	if err := os.MkdirAll(pluginSocketDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(pluginSocketDir, name+".sock")
+	start := make(chan struct{})
+	l, err := sockets.NewUnixSocket(path, group, start)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	close(start)
+	log.Infof("Serving the plugin API on %s", path)
+	return http.Serve(l, d.pluginHandler())
+}
+
+// pluginCall handles a plugin API call. decode reads the request into its
+// argument, a nil response is answered with an empty object.
+type pluginCall func(decode func(interface{}) error) (interface{}, error)
+
+// decodeError is a request that could not be decoded
+type decodeError struct {
+	err error
+}
+
+func (e *decodeError) Error() string {
+	return "Failed to decode request: " + e.err.Error()
+}
+
+func (d *Driver) pluginHandler() http.Handler {
+	calls := map[string]pluginCall{
+		"/NetworkDriver.GetCapabilities": func(decode func(interface{}) error) (interface{}, error) {
+			return d.GetCapabilities()
+		},
+		"/NetworkDriver.CreateNetwork": func(decode func(interface{}) error) (interface{}, error) {
+			r := &dknet.CreateNetworkRequest{}
+			if err := decode(r); err != nil {
+				return nil, err
+			}
+			return nil, d.CreateNetwork(r)
+		},
+		"/NetworkDriver.DeleteNetwork": func(decode func(interface{}) error) (interface{}, error) {
+			r := &dknet.DeleteNetworkRequest{}
+			if err := decode(r); err != nil {
+				return nil, err
+			}
+			return nil, d.DeleteNetwork(r)
+		},
+		"/NetworkDriver.CreateEndpoint": func(decode func(interface{}) error) (interface{}, error) {
+			r := &dknet.CreateEndpointRequest{}
+			if err := decode(r); err != nil {
+				return nil, err
+			}
+			return nil, d.CreateEndpoint(r)
+		},
+		"/NetworkDriver.DeleteEndpoint": func(decode func(interface{}) error) (interface{}, error) {
+			r := &dknet.DeleteEndpointRequest{}
+			if err := decode(r); err != nil {
+				return nil, err
+			}
+			return nil, d.DeleteEndpoint(r)
+		},
+		"/NetworkDriver.EndpointOperInfo": func(decode func(interface{}) error) (interface{}, error) {
+			r := &dknet.InfoRequest{}
+			if err := decode(r); err != nil {
+				return nil, err
+			}
+			return d.EndpointInfo(r)
+		},
+		"/NetworkDriver.Join": func(decode func(interface{}) error) (interface{}, error) {
+			r := &dknet.JoinRequest{}
+			if err := decode(r); err != nil {
+				return nil, err
+			}
+			return d.Join(r)
+		},
+		"/NetworkDriver.Leave": func(decode func(interface{}) error) (interface{}, error) {
+			r := &dknet.LeaveRequest{}
+			if err := decode(r); err != nil {
+				return nil, err
+			}
+			return nil, d.Leave(r)
+		},
+		"/IpamDriver.GetCapabilities": func(decode func(interface{}) error) (interface{}, error) {
+			return &IpamCapabilitiesResponse{}, nil
+		},
+		"/IpamDriver.GetDefaultAddressSpaces": func(decode func(interface{}) error) (interface{}, error) {
+			return d.GetDefaultAddressSpaces()
+		},
+		"/IpamDriver.RequestPool": func(decode func(interface{}) error) (interface{}, error) {
+			r := &RequestPoolRequest{}
+			if err := decode(r); err != nil {
+				return nil, err
+			}
+			return d.RequestPool(r)
+		},
+		"/IpamDriver.ReleasePool": func(decode func(interface{}) error) (interface{}, error) {
+			r := &ReleasePoolRequest{}
+			if err := decode(r); err != nil {
+				return nil, err
+			}
+			return nil, d.ReleasePool(r)
+		},
+		"/IpamDriver.RequestAddress": func(decode func(interface{}) error) (interface{}, error) {
+			r := &RequestAddressRequest{}
+			if err := decode(r); err != nil {
+				return nil, err
+			}
+			return d.RequestAddress(r)
+		},
+		"/IpamDriver.ReleaseAddress": func(decode func(interface{}) error) (interface{}, error) {
+			r := &ReleaseAddressRequest{}
+			if err := decode(r); err != nil {
+				return nil, err
+			}
+			return nil, d.ReleaseAddress(r)
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Plugin.Activate", func(w http.ResponseWriter, r *http.Request) {
+		writePluginJSON(w, http.StatusOK, map[string][]string{"Implements": {"NetworkDriver", "IpamDriver"}})
+	})
+	for path, call := range calls {
+		path, call := path, call
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			res, err := call(func(v interface{}) error {
+				if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+					return &decodeError{err}
+				}
+				return nil
+			})
+			if err != nil {
+				status := http.StatusInternalServerError
+				if _, ok := err.(*decodeError); ok {
+					log.Debugf("Error decoding %s request: %s", path, err)
+					status = http.StatusBadRequest
+				}
+				writePluginJSON(w, status, map[string]string{"Err": err.Error()})
+				return
+			}
+			if res == nil {
+				res = map[string]string{}
+			}
+			writePluginJSON(w, http.StatusOK, res)
+		})
+	}
+	return mux
+}
+
+func writePluginJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", pluginContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,80 @@
+package ovs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// pluginRequest calls the plugin API like docker does and decodes the reply
+func pluginRequest(t *testing.T, server *httptest.Server, path string, body string, reply interface{}) int {
+	resp, err := http.Post(server.URL+path, pluginContentType, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(reply); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func TestPluginAPI(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	d.scope = ScopeGlobal
+	server := httptest.NewServer(d.pluginHandler())
+	defer server.Close()
+
+	var manifest map[string][]string
+	pluginRequest(t, server, "/Plugin.Activate", "", &manifest)
+	if strings.Join(manifest["Implements"], ",") != "NetworkDriver,IpamDriver" {
+		t.Fatalf("unexpected manifest %v", manifest)
+	}
+	var capabilities CapabilitiesResponse
+	pluginRequest(t, server, "/NetworkDriver.GetCapabilities", "", &capabilities)
+	if capabilities.Scope != ScopeGlobal {
+		t.Fatalf("expected scope %s, got %+v", ScopeGlobal, capabilities)
+	}
+
+	var pool RequestPoolResponse
+	if status := pluginRequest(t, server, "/IpamDriver.RequestPool", `{"AddressSpace": "ovs-local", "Pool": "10.1.0.0/24"}`, &pool); status != http.StatusOK || pool.Pool != "10.1.0.0/24" {
+		t.Fatalf("requesting a pool failed with %d: %+v", status, pool)
+	}
+	// The global default address space is empty
+	if status := pluginRequest(t, server, "/IpamDriver.RequestPool", `{"Pool": "10.2.0.0/24"}`, &pool); status == http.StatusOK {
+		t.Fatalf("expected a pool without an address space to be refused, got %+v", pool)
+	}
+
+	var reply map[string]string
+	id, _ := testNetwork()
+	body := `{"NetworkID": "` + id + `", "IPv4Data": [{"Pool": "10.1.0.0/24", "Gateway": "10.1.0.1/24"}],
+		"IPv6Data": [{"Pool": "fd00:1::/64", "Gateway": "fd00:1::1/64"}]}`
+	if status := pluginRequest(t, server, "/NetworkDriver.CreateNetwork", body, &reply); status != http.StatusOK || len(reply) != 0 {
+		t.Fatalf("creating the network failed with %d: %v", status, reply)
+	}
+	body = `{"NetworkID": "` + id + `", "EndpointID": "abcdef0123456789",
+		"Interface": {"Address": "10.1.0.7/24", "AddressIPv6": "fd00:1::7/64"}}`
+	if status := pluginRequest(t, server, "/NetworkDriver.CreateEndpoint", body, &reply); status != http.StatusOK {
+		t.Fatalf("creating the endpoint failed with %d: %v", status, reply)
+	}
+	var join JoinResponse
+	body = `{"NetworkID": "` + id + `", "EndpointID": "abcdef0123456789"}`
+	if status := pluginRequest(t, server, "/NetworkDriver.Join", body, &join); status != http.StatusOK {
+		t.Fatalf("join failed with %d", status)
+	}
+	if join.Gateway != "10.1.0.1" || join.GatewayIPv6 != "fd00:1::1" || join.InterfaceName.DstPrefix != containerEthName {
+		t.Fatalf("unexpected join response %+v", join)
+	}
+
+	reply = nil
+	if status := pluginRequest(t, server, "/NetworkDriver.CreateNetwork", "not json", &reply); status != http.StatusBadRequest || reply["Err"] == "" {
+		t.Fatalf("expected a malformed request to be rejected, got %d: %v", status, reply)
+	}
+	reply = nil
+	if status := pluginRequest(t, server, "/NetworkDriver.Join", `{"NetworkID": "none"}`, &reply); status != http.StatusInternalServerError || reply["Err"] == "" {
+		t.Fatalf("expected joining an unknown network to fail, got %d: %v", status, reply)
+	}
+}
@@ -0,0 +1,55 @@
+package ovs
+
+import (
+	"path"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// enableRouting lets the host forward the traffic of a routed network and,
+// if the network has a proxy ARP interface, answer ARP requests for its
+// addresses there
+func (d *Driver) enableRouting(ns *NetworkState) error {
+	if ns.Gateway != "" {
+		if err := d.sysctl.setSysctl("net/ipv4/ip_forward", "1"); err != nil {
+			return err
+		}
+	}
+	if ns.GatewayIPv6 != "" {
+		if err := d.sysctl.setSysctl("net/ipv6/conf/all/forwarding", "1"); err != nil {
+			return err
+		}
+	}
+	if ns.ProxyARPInterface == "" {
+		return nil
+	}
+	if err := d.sysctl.setSysctl(proxyARPSysctl(ns.ProxyARPInterface), "1"); err != nil {
+		return err
+	}
+	log.Infof("Enabled proxy ARP on [ %s ] for bridge [ %s ]", ns.ProxyARPInterface, ns.BridgeName)
+	return nil
+}
+
+// disableProxyARP turns proxy ARP off again on an interface once no other
+// routed network uses it. IP forwarding is left on, other users of the host
+// may rely on it.
+func (d *Driver) disableProxyARP(id string, iface string) {
+	d.lock.RLock()
+	for other, ns := range d.networks {
+		if other != id && ns.Mode == modeRouted && ns.ProxyARPInterface == iface {
+			d.lock.RUnlock()
+			return
+		}
+	}
+	d.lock.RUnlock()
+	if err := d.sysctl.setSysctl(proxyARPSysctl(iface), "0"); err != nil {
+		log.Errorf("Could not disable proxy ARP on [ %s ]: %s", iface, err)
+		return
+	}
+	log.Infof("Disabled proxy ARP on [ %s ]", iface)
+}
+
+// proxyARPSysctl returns the kernel parameter enabling proxy ARP on an interface
+func proxyARPSysctl(iface string) string {
+	return path.Join("net/ipv4/conf", iface, "proxy_arp")
+}
@@ -0,0 +1,122 @@
+package ovs
+
+import (
+	"testing"
+
+	"github.com/gopher-net/dknet"
+)
+
+func TestRoutedNetwork(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	links := d.links.(*fakeLinker)
+	firewall := d.firewall.(*fakeFirewall)
+	sysctl := d.sysctl.(*fakeSysctl)
+
+	id := createModeNetwork(t, d, modeRouted, "10.3.0.1/24", map[string]interface{}{})
+	expectRecorded(t, &links.recorder,
+		"addr add ovsbr-01234 10.3.0.1/24",
+		"up ovsbr-01234")
+	// No MASQUERADE, the upstream router sees the container addresses
+	expectRecorded(t, &firewall.recorder)
+	expectRecorded(t, &sysctl.recorder, "sysctl net/ipv4/ip_forward=1")
+
+	waitFor(t, "the bridge to be cached", func() bool {
+		_, _, ok := d.cache.bridgeByName("ovsbr-01234")
+		return ok
+	})
+	if err := d.DeleteNetwork(&dknet.DeleteNetworkRequest{NetworkID: id}); err != nil {
+		t.Fatal(err)
+	}
+	expectRecorded(t, &sysctl.recorder)
+}
+
+func TestRoutedNetworkProxyARP(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	sysctl := d.sysctl.(*fakeSysctl)
+
+	id := createModeNetwork(t, d, modeRouted, "10.3.0.1/24", map[string]interface{}{proxyARPOption: "eth1.100"})
+	expectRecorded(t, &sysctl.recorder,
+		"sysctl net/ipv4/ip_forward=1",
+		"sysctl net/ipv4/conf/eth1.100/proxy_arp=1")
+
+	waitFor(t, "the bridge to be cached", func() bool {
+		_, _, ok := d.cache.bridgeByName("ovsbr-01234")
+		return ok
+	})
+	if ns := d.ovsdber.networksFromCache()[id]; ns == nil || ns.ProxyARPInterface != "eth1.100" {
+		t.Fatalf("proxy ARP interface not restored from OVSDB: %+v", ns)
+	}
+	if err := d.DeleteNetwork(&dknet.DeleteNetworkRequest{NetworkID: id}); err != nil {
+		t.Fatal(err)
+	}
+	expectRecorded(t, &sysctl.recorder, "sysctl net/ipv4/conf/eth1.100/proxy_arp=0")
+
+	if err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+		NetworkID: id,
+		Options:   map[string]interface{}{modeOption: modeRouted, proxyARPOption: "../all"},
+		IPv4Data:  []*dknet.IPAMData{{Gateway: "10.3.0.1/24"}},
+	}); err == nil {
+		t.Fatal("expected an invalid interface name to be rejected")
+	}
+}
+
+func TestInternalNetwork(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	links := d.links.(*fakeLinker)
+	firewall := d.firewall.(*fakeFirewall)
+
+	// docker network create --internal
+	id, _ := testNetwork()
+	err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+		NetworkID: id,
+		Options:   map[string]interface{}{internalOption: true},
+		IPv4Data:  []*dknet.IPAMData{{Pool: "10.4.0.0/24", Gateway: "10.4.0.1/24"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns, _ := d.getNetwork(id); ns.Mode != modeInternal {
+		t.Fatalf("expected an internal network, got %s mode", ns.Mode)
+	}
+	expectRecorded(t, &links.recorder,
+		"addr add ovsbr-01234 10.4.0.1/24",
+		"up ovsbr-01234")
+	expectRecorded(t, &firewall.recorder,
+		"insert filter FORWARD -i ovsbr-01234 ! -o ovsbr-01234 -j DROP",
+		"insert filter FORWARD ! -i ovsbr-01234 -o ovsbr-01234 -j DROP")
+
+	waitFor(t, "the bridge to be cached", func() bool {
+		_, _, ok := d.cache.bridgeByName("ovsbr-01234")
+		return ok
+	})
+	if err := d.DeleteNetwork(&dknet.DeleteNetworkRequest{NetworkID: id}); err != nil {
+		t.Fatal(err)
+	}
+	expectRecorded(t, &firewall.recorder,
+		"delete filter FORWARD -i ovsbr-01234 ! -o ovsbr-01234 -j DROP",
+		"delete filter FORWARD ! -i ovsbr-01234 -o ovsbr-01234 -j DROP")
+}
+
+func TestInternalNetworkValidation(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	id, _ := testNetwork()
+	for _, options := range []map[string]interface{}{
+		{internalOption: true, modeOption: modeNAT},
+		{internalOption: "yes"},
+		{modeOption: modeInternal, bindInterfaceOption: "eth1"},
+	} {
+		err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+			NetworkID: id,
+			Options:   options,
+			IPv4Data:  []*dknet.IPAMData{{Gateway: "10.4.0.1/24"}},
+		})
+		if err == nil {
+			t.Fatalf("expected %v to be rejected", options)
+		}
+	}
+}
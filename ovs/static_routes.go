@@ -0,0 +1,115 @@
+package ovs
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gopher-net/dknet"
+)
+
+// Route types of dknet.StaticRoute, as libnetwork defines them
+const (
+	routeTypeNextHop   = 0
+	routeTypeConnected = 1
+)
+
+// Route is a static route of a network's containers. Routes without a
+// NextHop are connected, their destination is on the container's link.
+type Route struct {
+	Destination string
+	NextHop     string
+}
+
+// getStaticRoutes returns the routes of the static routes option, a comma
+// separated list of destination=next-hop pairs and next-hop-less
+// destinations. Next hops must be in one of the network's subnets.
+func getStaticRoutes(r *dknet.CreateNetworkRequest, subnets []Subnet) ([]Route, error) {
+	value, ok := getOption(r, staticRoutesOption)
+	if !ok {
+		return nil, nil
+	}
+	s, _ := value.(string)
+	routes, err := parseRoutes(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %v: %s", staticRoutesOption, value, err)
+	}
+	for _, route := range routes {
+		if route.NextHop == "" || len(subnets) == 0 {
+			continue
+		}
+		if !inSubnets(net.ParseIP(route.NextHop), subnets) {
+			return nil, fmt.Errorf("invalid %s: next hop %s is not in a subnet of the network", staticRoutesOption, route.NextHop)
+		}
+	}
+	return routes, nil
+}
+
+func inSubnets(ip net.IP, subnets []Subnet) bool {
+	for _, subnet := range subnets {
+		if _, pool, err := net.ParseCIDR(subnet.Pool); err == nil && pool.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatRoutes(routes []Route) string {
+	entries := make([]string, len(routes))
+	for i, route := range routes {
+		entries[i] = route.Destination
+		if route.NextHop != "" {
+			entries[i] += "=" + route.NextHop
+		}
+	}
+	return strings.Join(entries, ",")
+}
+
+// parseRoutes is the reverse of formatRoutes. Destinations are normalized to
+// their network address.
+func parseRoutes(value string) ([]Route, error) {
+	var routes []Route
+	for _, entry := range splitList(value) {
+		parts := strings.Split(entry, "=")
+		if len(parts) > 2 {
+			return nil, fmt.Errorf("invalid route %s", entry)
+		}
+		_, dst, err := net.ParseCIDR(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid route destination %s", parts[0])
+		}
+		route := Route{Destination: dst.String()}
+		if len(parts) == 2 {
+			nextHop := net.ParseIP(parts[1])
+			if nextHop == nil || (nextHop.To4() == nil) != (dst.IP.To4() == nil) {
+				return nil, fmt.Errorf("invalid next hop %s for %s", parts[1], dst)
+			}
+			route.NextHop = nextHop.String()
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// staticRoutes returns the routes Join hands to Docker for an endpoint,
+// leaving out those of an address family it has no address of. All of them
+// if its addresses are not known, e.g. after a restart of the plugin.
+func (ns *NetworkState) staticRoutes(ep endpoint) []*dknet.StaticRoute {
+	known := ep.Address != "" || ep.AddressIPv6 != ""
+	var routes []*dknet.StaticRoute
+	for _, route := range ns.StaticRoutes {
+		ip, _, err := net.ParseCIDR(route.Destination)
+		if err != nil {
+			continue
+		}
+		if known && ((ip.To4() != nil && ep.Address == "") || (ip.To4() == nil && ep.AddressIPv6 == "")) {
+			continue
+		}
+		staticRoute := &dknet.StaticRoute{Destination: route.Destination, RouteType: routeTypeConnected}
+		if route.NextHop != "" {
+			staticRoute.RouteType, staticRoute.NextHop = routeTypeNextHop, route.NextHop
+		}
+		routes = append(routes, staticRoute)
+	}
+	return routes
+}
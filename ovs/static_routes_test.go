@@ -0,0 +1,90 @@
+package ovs
+
+import (
+	"testing"
+
+	"github.com/gopher-net/dknet"
+)
+
+func TestStaticRoutes(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	id, _ := testNetwork()
+	err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+		NetworkID: id,
+		Options: map[string]interface{}{
+			modeOption:         modeFlat,
+			staticRoutesOption: "10.20.1.7/16=10.1.0.254,192.168.5.0/24,fd00:20::/64=fd00:1::fe",
+		},
+		IPv4Data: []*dknet.IPAMData{{Pool: "10.1.0.0/24", Gateway: "10.1.0.1/24"}},
+		IPv6Data: []*dknet.IPAMData{{Pool: "fd00:1::/64", Gateway: "fd00:1::1/64"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpointID := "fedcba9876543210fedcba9876543210"
+	err = d.CreateEndpoint(&dknet.CreateEndpointRequest{
+		NetworkID:  id,
+		EndpointID: endpointID,
+		Interface:  &dknet.EndpointInterface{Address: "10.1.0.7/24"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := d.Join(&dknet.JoinRequest{NetworkID: id, EndpointID: endpointID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The endpoint has no IPv6 address, so no IPv6 route
+	expected := []dknet.StaticRoute{
+		{Destination: "10.20.0.0/16", RouteType: routeTypeNextHop, NextHop: "10.1.0.254"},
+		{Destination: "192.168.5.0/24", RouteType: routeTypeConnected},
+	}
+	if len(res.StaticRoutes) != len(expected) {
+		t.Fatalf("expected routes %+v, got %+v", expected, res.StaticRoutes)
+	}
+	for i, route := range res.StaticRoutes {
+		if *route != expected[i] {
+			t.Fatalf("expected routes %+v, got %+v", expected, res.StaticRoutes)
+		}
+	}
+
+	ns, err := d.getNetwork(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the bridge to be cached", func() bool {
+		_, _, ok := d.cache.bridgeByName(ns.BridgeName)
+		return ok
+	})
+	restored := d.networksFromCache()[id]
+	if restored == nil || formatRoutes(restored.StaticRoutes) != formatRoutes(ns.StaticRoutes) {
+		t.Fatalf("static routes not restored from the cache: %+v", restored)
+	}
+}
+
+func TestStaticRouteValidation(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	for _, routes := range []string{
+		"10.20.0.0",
+		"10.20.0.0/16=",
+		"10.20.0.0/16=fd00:1::fe",
+		"10.20.0.0/16=10.1.0.254=10.1.0.253",
+		// Not on the network
+		"10.20.0.0/16=10.2.0.254",
+	} {
+		id, _ := testNetwork()
+		err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+			NetworkID: id,
+			Options:   map[string]interface{}{staticRoutesOption: routes},
+			IPv4Data:  []*dknet.IPAMData{{Pool: "10.1.0.0/24", Gateway: "10.1.0.1/24"}},
+		})
+		if err == nil {
+			t.Fatalf("expected static routes %s to be rejected", routes)
+		}
+	}
+}
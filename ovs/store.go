@@ -0,0 +1,73 @@
+package ovs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultStateFile = "/var/lib/docker-ovs-plugin/networks.json"
+)
+
+// networkStore keeps a copy of every NetworkState on disk. The docker daemon
+// outlives plugin restarts and will keep sending Join/Leave/DeleteNetwork
+// requests for networks it created through a previous plugin process.
+type networkStore struct {
+	path string
+	// lock serializes writers of the state file
+	lock sync.Mutex
+}
+
+// load returns the networks saved by a previous run. A missing state file
+// is not an error, it simply means no networks have been created yet.
+func (s *networkStore) load() (map[string]*NetworkState, error) {
+	networks := make(map[string]*NetworkState)
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return networks, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &networks); err != nil {
+		return nil, err
+	}
+	return networks, nil
+}
+
+// save writes the networks, marshalled by the caller, to the state file
+func (s *networkStore) save(networks map[string]json.RawMessage) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := writeJSON(s.path, networks); err != nil {
+		return err
+	}
+	log.Debugf("Saved state for %d network(s) to %s", len(networks), s.path)
+	return nil
+}
+
+// writeJSON writes a value to a temp file and renames it over path so a
+// crash mid-write never leaves a truncated file behind.
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package ovs
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gopher-net/dknet"
+)
+
+// Subnet is an IPAM pool of a network. Gateway is the address IPAM gave the
+// bridge in the pool, in CIDR notation.
+type Subnet struct {
+	Pool    string
+	Gateway string
+}
+
+// getSubnets returns the IPv4 and then the IPv6 pools of a network
+func getSubnets(r *dknet.CreateNetworkRequest) ([]Subnet, error) {
+	var subnets []Subnet
+	for _, data := range append(append([]*dknet.IPAMData{}, r.IPv4Data...), r.IPv6Data...) {
+		if data == nil || (data.Pool == "" && data.Gateway == "") {
+			continue
+		}
+		if data.Pool != "" {
+			if _, _, err := net.ParseCIDR(data.Pool); err != nil {
+				return nil, fmt.Errorf("invalid pool %s: %s", data.Pool, err)
+			}
+		}
+		if data.Gateway != "" {
+			if _, _, err := net.ParseCIDR(data.Gateway); err != nil {
+				return nil, fmt.Errorf("invalid gateway %s: %s", data.Gateway, err)
+			}
+		}
+		subnets = append(subnets, Subnet{Pool: data.Pool, Gateway: data.Gateway})
+	}
+	return subnets, nil
+}
+
+// formatSubnets encodes subnets for external_ids as a comma separated list
+// of pool=gateway pairs
+func formatSubnets(subnets []Subnet) string {
+	pairs := make([]string, len(subnets))
+	for i, s := range subnets {
+		pairs[i] = s.Pool + "=" + s.Gateway
+	}
+	return strings.Join(pairs, ",")
+}
+
+// parseSubnets is the reverse of formatSubnets
+func parseSubnets(value string) ([]Subnet, error) {
+	var subnets []Subnet
+	for _, pair := range strings.Split(value, ",") {
+		if pair == "" {
+			continue
+		}
+		parts := strings.Split(pair, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid subnet %s", pair)
+		}
+		subnets = append(subnets, Subnet{Pool: parts[0], Gateway: parts[1]})
+	}
+	return subnets, nil
+}
+
+func sameSubnets(a []Subnet, b []Subnet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// gatewayCIDRs returns the gateways of a network in CIDR notation, IPv4 first
+func (ns *NetworkState) gatewayCIDRs() []string {
+	var cidrs []string
+	for _, s := range ns.Subnets {
+		if s.Gateway != "" {
+			cidrs = append(cidrs, s.Gateway)
+		}
+	}
+	if len(ns.Subnets) > 0 {
+		return cidrs
+	}
+	// Networks saved before every subnet was kept only have their gateways
+	if ns.Gateway != "" {
+		cidrs = append(cidrs, ns.Gateway+"/"+ns.GatewayMask)
+	}
+	if ns.GatewayIPv6 != "" {
+		cidrs = append(cidrs, ns.GatewayIPv6+"/"+ns.GatewayIPv6Mask)
+	}
+	return cidrs
+}
+
+// gatewayFor returns the gateway of the subnet an endpoint address is in,
+// or def if the address is empty or in none of the subnets of the network
+func (ns *NetworkState) gatewayFor(address string, def string) string {
+	if address == "" {
+		return def
+	}
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil {
+		if ip = net.ParseIP(address); ip == nil {
+			return def
+		}
+	}
+	for _, s := range ns.Subnets {
+		if s.Pool == "" || s.Gateway == "" {
+			continue
+		}
+		_, pool, err := net.ParseCIDR(s.Pool)
+		if err != nil || !pool.Contains(ip) {
+			continue
+		}
+		gateway, _, _ := net.ParseCIDR(s.Gateway)
+		return gateway.String()
+	}
+	return def
+}
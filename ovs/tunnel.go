@@ -0,0 +1,296 @@
+package ovs
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	tunnelVXLAN  = "vxlan"
+	tunnelGRE    = "gre"
+	tunnelGeneve = "geneve"
+
+	maxVNI = 1<<24 - 1
+	// ipv6Overhead is how much larger an IPv6 outer header is than an IPv4 one
+	ipv6Overhead = 20
+)
+
+var (
+	// tunnelOverheads is the number of bytes each encapsulation adds around
+	// a container's Ethernet frame over an IPv4 underlay
+	tunnelOverheads = map[string]int{
+		// outer IPv4, UDP, VXLAN and inner Ethernet headers
+		tunnelVXLAN: 20 + 8 + 8 + 14,
+		// outer IPv4, GRE with a key and inner Ethernet headers
+		tunnelGRE: 20 + 8 + 14,
+		// outer IPv4, UDP, Geneve without options and inner Ethernet headers
+		tunnelGeneve: 20 + 8 + 8 + 14,
+	}
+	defaultDstPorts = map[string]int{
+		tunnelVXLAN:  4789,
+		tunnelGeneve: 6081,
+	}
+)
+
+// containerMTU returns the MTU of the container interfaces of a network,
+// leaving room for the tunnel headers of an overlay network
+func (ns *NetworkState) containerMTU() int {
+	if ns.Mode != modeOverlay {
+		return ns.MTU
+	}
+	mtu := ns.MTU - tunnelOverheads[ns.TunnelType]
+	if ns.TunnelType == tunnelGRE && ns.TunnelCsum {
+		// The GRE checksum field
+		mtu -= 4
+	}
+	for _, peer := range ns.OverlayPeers {
+		if net.ParseIP(peer).To4() == nil {
+			mtu -= ipv6Overhead
+			break
+		}
+	}
+	return mtu
+}
+
+// parsePeers parses a comma separated list of VTEP addresses, returning them
+// sorted and without duplicates
+func parsePeers(list string) ([]string, error) {
+	seen := make(map[string]bool)
+	var peers []string
+	for _, peer := range strings.Split(list, ",") {
+		peer = strings.TrimSpace(peer)
+		if peer == "" {
+			continue
+		}
+		ip := net.ParseIP(peer)
+		if ip == nil {
+			return nil, fmt.Errorf("%s is not an IP address", peer)
+		}
+		if !seen[ip.String()] {
+			seen[ip.String()] = true
+			peers = append(peers, ip.String())
+		}
+	}
+	sort.Strings(peers)
+	return peers, nil
+}
+
+// tunnelPortName returns the name of the tunnel port of a network to a peer.
+// Tunnel ports have no kernel link, so the name is not limited to IFNAMSIZ.
+func tunnelPortName(id string, ns *NetworkState, peer string) string {
+	ip := net.ParseIP(peer)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return ns.TunnelType + "-" + truncateID(id) + "-" + hex.EncodeToString(ip)
+}
+
+// tunnelOptions returns the Interface options of the tunnel of a network to a peer
+func tunnelOptions(ns *NetworkState, peer string) map[string]string {
+	options := map[string]string{
+		"remote_ip": peer,
+		"key":       strconv.Itoa(int(ns.VNI)),
+	}
+	if ns.DstPort != 0 {
+		options["dst_port"] = strconv.Itoa(ns.DstPort)
+	}
+	if ns.TunnelTOS != "" {
+		options["tos"] = ns.TunnelTOS
+	}
+	if ns.TunnelTTL != "" {
+		options["ttl"] = ns.TunnelTTL
+	}
+	if ns.TunnelCsum {
+		options["csum"] = "true"
+	}
+	return options
+}
+
+// tunnelPorts returns the names of the tunnel ports of a network on its bridge
+func (d *Driver) tunnelPorts(id string, ns *NetworkState) map[string]bool {
+	prefix := ns.TunnelType + "-" + truncateID(id) + "-"
+	ports := make(map[string]bool)
+	for _, row := range d.ovsdber.cache.portsOfBridge(ns.BridgeName) {
+		if name, ok := row.Fields["name"].(string); ok && strings.HasPrefix(name, prefix) {
+			ports[name] = true
+		}
+	}
+	return ports
+}
+
+// addTunnels adds a tunnel port to every peer of an overlay network and
+// removes the tunnels to peers that are no longer listed
+func (d *Driver) addTunnels(id string, ns *NetworkState) error {
+	var remote []string
+	local := d.localAddresses()
+	for _, peer := range ns.OverlayPeers {
+		// Every host of a global network is given the same peer list
+		if local[peer] {
+			log.Debugf("Skipping peer %s of network %s, it is an address of this host", peer, id)
+			continue
+		}
+		remote = append(remote, peer)
+	}
+	// Without protected ports the mesh floods frames from one peer to the next
+	if len(remote) > 1 && !d.ovsdber.hasColumn("Port", "protected") {
+		return fmt.Errorf("tunnels to more than one peer need protected ports, which ovsdb-server only has as of Open vSwitch 2.11")
+	}
+
+	for _, peer := range remote {
+		if other := d.tunnelConflict(tunnelPortName(id, ns, peer), ns.TunnelType, tunnelOptions(ns, peer)); other != "" {
+			return fmt.Errorf("tunnel [ %s ] already uses VNI %d to peer %s", other, ns.VNI, peer)
+		}
+	}
+
+	wanted := make(map[string]bool)
+	for _, peer := range remote {
+		portName := tunnelPortName(id, ns, peer)
+		wanted[portName] = true
+		err := d.ovsdber.addTunnelPort(ns.BridgeName, portName, ns.TunnelType, tunnelOptions(ns, peer), ns.VLAN)
+		if isExists(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not add a tunnel to %s: %s", peer, err)
+		}
+		log.Infof("Added tunnel [ %s ] to peer %s on bridge [ %s ]", portName, peer, ns.BridgeName)
+	}
+	for portName := range d.tunnelPorts(id, ns) {
+		if wanted[portName] {
+			continue
+		}
+		if err := d.ovsdber.deletePort(ns.BridgeName, portName); err != nil && !isNotFound(err) {
+			return err
+		}
+		log.Infof("Removed tunnel [ %s ] from bridge [ %s ]", portName, ns.BridgeName)
+	}
+	return nil
+}
+
+// tunnelConflict returns the name of a tunnel other than portName with the
+// same type, key, UDP port and peer, empty if there is none. OVS cannot tell
+// the traffic of two such tunnels apart.
+func (d *Driver) tunnelConflict(portName string, tunnelType string, options map[string]string) string {
+	for _, row := range d.ovsdber.cache.table("Interface") {
+		name, _ := row.Fields["name"].(string)
+		if name == portName || row.Fields["type"] != tunnelType {
+			continue
+		}
+		other := rowMap(row, "options")
+		if other["remote_ip"] == options["remote_ip"] && other["key"] == options["key"] && other["dst_port"] == options["dst_port"] {
+			return name
+		}
+	}
+	return ""
+}
+
+// removeTunnels deletes every tunnel port of a network
+func (d *Driver) removeTunnels(id string, ns *NetworkState) error {
+	for portName := range d.tunnelPorts(id, ns) {
+		if err := d.ovsdber.deletePort(ns.BridgeName, portName); err != nil && !isNotFound(err) {
+			return err
+		}
+		log.Infof("Removed tunnel [ %s ] from bridge [ %s ]", portName, ns.BridgeName)
+	}
+	return nil
+}
+
+// watchPeers follows edits of the peer list of overlay networks, e.g.
+// ovs-vsctl set bridge ovsbr-xxxxx external_ids:docker-ovs-peers=10.0.0.2,10.0.0.3
+// The list is kept in the external_ids of the network's bridge, or of its
+// gateway port if it is tagged.
+func (d *Driver) watchPeers(bridges <-chan rowUpdate, ports <-chan rowUpdate) {
+	for {
+		var update rowUpdate
+		select {
+		case update = <-bridges:
+		case update = <-ports:
+		}
+		// Old only holds the columns that changed
+		if update.deleted() {
+			continue
+		}
+		if _, ok := update.Old.Fields["external_ids"]; !ok {
+			continue
+		}
+		old, externalIDs := rowExternalIDs(update.Old), rowExternalIDs(update.New)
+		id := externalIDs[externalIDNetwork]
+		if id == "" || externalIDs[externalIDMode] != modeOverlay || old[externalIDPeers] == externalIDs[externalIDPeers] {
+			continue
+		}
+		// Updating the tunnels waits on the network and commits transactions,
+		// neither may block the delivery of OVSDB updates
+		go func() {
+			if err := d.updatePeers(id, externalIDs[externalIDPeers]); err != nil {
+				log.Errorf("Could not update the peers of network %s: %s", id, err)
+			}
+		}()
+	}
+}
+
+// updatePeers replaces the peer list of an overlay network and adds or
+// removes its tunnel ports to match
+func (d *Driver) updatePeers(id string, list string) error {
+	peers, err := parsePeers(list)
+	if err != nil {
+		return err
+	}
+	if err := d.setPeers(id, peers); err != nil {
+		return err
+	}
+	d.saveNetworks()
+	log.Infof("Network %s now tunnels to %v", id, peers)
+	return nil
+}
+
+// setPeers sets the peers of an overlay network and its tunnels to match
+func (d *Driver) setPeers(id string, peers []string) error {
+	ns, err := d.lockNetwork(id)
+	if err != nil {
+		return err
+	}
+	defer ns.lock.Unlock()
+	if ns.Mode != modeOverlay {
+		return fmt.Errorf("network %s is not an overlay network", id)
+	}
+	ns.OverlayPeers = peers
+	if err := d.addTunnels(id, ns); err != nil {
+		return err
+	}
+	// Unchanged when the edit came from OVSDB, so it is not seen as another one
+	table, name := "Bridge", ns.BridgeName
+	if ns.VLAN != 0 {
+		table, name = "Port", gatewayPortName(id)
+	}
+	if err := d.ovsdber.setExternalIDs(table, name, map[string]string{externalIDPeers: strings.Join(peers, ",")}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// localAddresses returns the addresses assigned to the links of this host
+func (d *Driver) localAddresses() map[string]bool {
+	local := make(map[string]bool)
+	links, err := d.links.LinkList()
+	if err != nil {
+		log.Errorf("Could not list links: %s", err)
+		return local
+	}
+	for _, link := range links {
+		addrs, err := d.addrs.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			local[addr.IP.String()] = true
+		}
+	}
+	return local
+}
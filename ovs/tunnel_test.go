@@ -0,0 +1,261 @@
+package ovs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gopher-net/dknet"
+	"github.com/socketplane/libovsdb"
+)
+
+// tunnelInterface returns the options of the interface of a tunnel port
+func tunnelInterface(t *testing.T, portName string, tunnelType string) map[string]string {
+	_, intf, ok := sharedOvsdb.rowByName("Interface", portName)
+	if !ok {
+		t.Fatalf("tunnel %s not found", portName)
+	}
+	if intf["type"] != tunnelType {
+		t.Fatalf("expected a %s interface, got %v", tunnelType, intf["type"])
+	}
+	return fakeMap(intf, "options")
+}
+
+func TestOverlayNetworkTunnels(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	defer protectPorts(t, d.ovsdber)()
+
+	id := createModeNetwork(t, d, modeOverlay, "10.2.0.1/24", map[string]interface{}{
+		peersOption:   "10.0.0.3, 10.0.0.2",
+		vniOption:     "5001",
+		dstPortOption: "8472",
+	})
+	options := tunnelInterface(t, "vxlan-01234-0a000002", "vxlan")
+	if options["remote_ip"] != "10.0.0.2" || options["key"] != "5001" || options["dst_port"] != "8472" {
+		t.Fatalf("unexpected tunnel options %v", options)
+	}
+	tunnelInterface(t, "vxlan-01234-0a000003", "vxlan")
+
+	// The overlay settings are restored from OVSDB after a restart
+	waitFor(t, "the bridge to be cached", func() bool {
+		_, _, ok := d.cache.bridgeByName("ovsbr-01234")
+		return ok
+	})
+	ns := d.ovsdber.networksFromCache()[id]
+	if ns == nil || ns.VNI != 5001 || ns.DstPort != 8472 || len(ns.OverlayPeers) != 2 {
+		t.Fatalf("overlay settings not restored from OVSDB: %+v", ns)
+	}
+
+	waitFor(t, "the tunnels to be cached", func() bool {
+		_, _, ok := d.cache.portByName("vxlan-01234-0a000003")
+		return ok
+	})
+	if err := d.DeleteNetwork(&dknet.DeleteNetworkRequest{NetworkID: id}); err != nil {
+		t.Fatal(err)
+	}
+	if n := sharedOvsdb.count("Port"); n != 0 {
+		t.Fatalf("expected every port to be deleted, %d left", n)
+	}
+}
+
+func TestOverlayPeersChange(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	defer protectPorts(t, d.ovsdber)()
+
+	id := createModeNetwork(t, d, modeOverlay, "10.2.0.1/24", map[string]interface{}{peersOption: "10.0.0.2,10.0.0.3", vniOption: "10"})
+	if options := tunnelInterface(t, "vxlan-01234-0a000002", "vxlan"); options["dst_port"] != "4789" || options["key"] != "10" {
+		t.Fatalf("unexpected tunnel options %v", options)
+	}
+	waitFor(t, "the tunnels to be cached", func() bool {
+		return len(d.tunnelPorts(id, d.networks[id])) == 2
+	})
+
+	// An edit of the peer list in OVSDB is followed by the driver
+	bridges, ports := make(chan rowUpdate, 1), make(chan rowUpdate)
+	go d.watchPeers(bridges, ports)
+	bridges <- rowUpdate{
+		Old: libovsdb.Row{Fields: map[string]interface{}{"external_ids": libovsdb.OvsMap{GoMap: map[interface{}]interface{}{
+			externalIDNetwork: id, externalIDMode: modeOverlay, externalIDPeers: "10.0.0.2,10.0.0.3",
+		}}}},
+		New: libovsdb.Row{Fields: map[string]interface{}{"external_ids": libovsdb.OvsMap{GoMap: map[interface{}]interface{}{
+			externalIDNetwork: id, externalIDMode: modeOverlay, externalIDPeers: "10.0.0.3,10.0.0.4",
+		}}}},
+	}
+	waitFor(t, "the tunnel to the new peer", func() bool {
+		_, _, ok := sharedOvsdb.rowByName("Port", "vxlan-01234-0a000004")
+		return ok
+	})
+	waitFor(t, "the tunnel to the old peer to be removed", func() bool {
+		_, _, ok := sharedOvsdb.rowByName("Port", "vxlan-01234-0a000002")
+		return !ok
+	})
+	waitFor(t, "the peer list to be recorded on the bridge", func() bool {
+		_, bridge, _ := sharedOvsdb.rowByName("Bridge", "ovsbr-01234")
+		return fakeMap(bridge, "external_ids")[externalIDPeers] == "10.0.0.3,10.0.0.4"
+	})
+	// and reaches the cache before the bridge is deleted, or a late update
+	// would bring it back for the next test
+	waitFor(t, "the peer list to be cached", func() bool {
+		_, bridge, _ := d.cache.bridgeByName("ovsbr-01234")
+		return rowExternalIDs(bridge)[externalIDPeers] == "10.0.0.3,10.0.0.4"
+	})
+
+	if err := d.updatePeers(id, "10.0.0.300"); err == nil {
+		t.Fatal("expected an invalid peer to be rejected")
+	}
+}
+
+func TestOverlayTunnelsSplitHorizon(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	defer protectPorts(t, d.ovsdber)()
+
+	id := createModeNetwork(t, d, modeOverlay, "10.2.0.1/24", map[string]interface{}{peersOption: "10.0.0.2,10.0.0.3,10.0.0.4", vniOption: "10"})
+	if _, err := d.Join(&dknet.JoinRequest{NetworkID: id, EndpointID: "abcdef0123456789"}); err != nil {
+		t.Fatal(err)
+	}
+	// A frame from one peer is never sent on to another, only to the
+	// containers of the network
+	for _, name := range []string{"vxlan-01234-0a000002", "vxlan-01234-0a000003", "vxlan-01234-0a000004"} {
+		if _, port, ok := sharedOvsdb.rowByName("Port", name); !ok || port["protected"] != true {
+			t.Fatalf("expected tunnel %s to be a protected port, got %v", name, port)
+		}
+	}
+	if _, port, _ := sharedOvsdb.rowByName("Port", "ovs-veth0-abcde"); port["protected"] == true {
+		t.Fatal("expected the container port not to be protected")
+	}
+}
+
+func TestOverlayWithoutProtectedPorts(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	// Open vSwitch before 2.11 tunnels to a single peer with a plain port
+	id := createModeNetwork(t, d, modeOverlay, "10.2.0.1/24", map[string]interface{}{peersOption: "10.0.0.2", vniOption: "10"})
+	if _, port, ok := sharedOvsdb.rowByName("Port", "vxlan-01234-0a000002"); !ok || port["protected"] != nil {
+		t.Fatalf("expected an unprotected tunnel port, got %v", port)
+	}
+	// but cannot keep a mesh of more than two hosts from looping
+	if err := d.updatePeers(id, "10.0.0.2,10.0.0.3"); err == nil {
+		t.Fatal("expected a second peer to be refused without protected ports")
+	}
+	if _, _, ok := sharedOvsdb.rowByName("Port", "vxlan-01234-0a000003"); ok {
+		t.Fatal("expected no tunnel to the second peer")
+	}
+}
+
+func TestOverlayDuplicateTunnels(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	createModeNetwork(t, d, modeOverlay, "10.2.0.1/24", map[string]interface{}{peersOption: "10.0.0.2", vniOption: "10"})
+	waitFor(t, "the tunnel to be cached", func() bool {
+		_, _, ok := d.cache.interfaceByName("vxlan-01234-0a000002")
+		return ok
+	})
+
+	other := "fedcba9876543210fedcba9876543210"
+	request := func(options map[string]interface{}) *dknet.CreateNetworkRequest {
+		options[modeOption] = modeOverlay
+		return &dknet.CreateNetworkRequest{
+			NetworkID: other,
+			Options:   map[string]interface{}{genericOption: options},
+			IPv4Data:  []*dknet.IPAMData{{Pool: "10.3.0.0/24", Gateway: "10.3.0.1/24"}},
+		}
+	}
+	// The same VNI to the same peer would receive the first network's frames
+	if err := d.CreateNetwork(request(map[string]interface{}{peersOption: "10.0.0.3,10.0.0.2", vniOption: "10"})); err == nil {
+		t.Fatal("expected a second tunnel with VNI 10 to 10.0.0.2 to be refused")
+	}
+	if _, _, ok := sharedOvsdb.rowByName("Port", "vxlan-fedcb-0a000003"); ok {
+		t.Fatal("expected no tunnel of the refused network")
+	}
+	// Any of the type, VNI or UDP port tells them apart
+	for _, options := range []map[string]interface{}{
+		{peersOption: "10.0.0.2", vniOption: "11"},
+		{peersOption: "10.0.0.2", vniOption: "10", dstPortOption: "8472"},
+		{peersOption: "10.0.0.2", vniOption: "10", tunnelTypeOption: tunnelGeneve},
+	} {
+		if err := d.CreateNetwork(request(options)); err != nil {
+			t.Fatalf("expected %v to be accepted: %s", options, err)
+		}
+		if err := d.DeleteNetwork(&dknet.DeleteNetworkRequest{NetworkID: other}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOverlayValidation(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	id, _ := testNetwork()
+	for _, options := range []map[string]interface{}{
+		{peersOption: "10.0.0.2"},
+		{peersOption: "10.0.0.2,peer", vniOption: "10"},
+		{vniOption: "16777216"},
+		{dstPortOption: "0", vniOption: "10"},
+		{tunnelTypeOption: "ipip", vniOption: "10"},
+		{tunnelTypeOption: "gre", dstPortOption: "4789", vniOption: "10"},
+		{ttlOption: "256", vniOption: "10"},
+		{csumOption: "maybe", vniOption: "10"},
+		{mtuOption: "100", vniOption: "10"},
+	} {
+		options[modeOption] = modeOverlay
+		err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+			NetworkID: id,
+			Options:   options,
+			IPv4Data:  []*dknet.IPAMData{{Gateway: "10.2.0.1/24"}},
+		})
+		if err == nil {
+			t.Fatalf("expected %v to be rejected", options)
+		}
+	}
+}
+
+func TestOverlayTunnelTypes(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	id := createModeNetwork(t, d, modeOverlay, "10.2.0.1/24", map[string]interface{}{
+		peersOption:      "10.0.0.2",
+		tunnelTypeOption: "gre",
+		vniOption:        "42",
+		tosOption:        "inherit",
+		ttlOption:        "64",
+		csumOption:       "true",
+	})
+	options := tunnelInterface(t, "gre-01234-0a000002", "gre")
+	expected := map[string]string{"remote_ip": "10.0.0.2", "key": "42", "tos": "inherit", "ttl": "64", "csum": "true"}
+	if fmt.Sprint(options) != fmt.Sprint(expected) {
+		t.Fatalf("expected tunnel options %v, got %v", expected, options)
+	}
+
+	// Container interfaces leave room for the GRE, key and checksum headers
+	links := d.links.(*fakeLinker)
+	if _, err := d.Join(&dknet.JoinRequest{NetworkID: id, EndpointID: "abcdef0123456789"}); err != nil {
+		t.Fatal(err)
+	}
+	veth, _ := links.LinkByName("ovs-veth0-abcde")
+	if mtu := veth.Attrs().MTU; mtu != 1500-46 {
+		t.Fatalf("expected a container MTU of %d, got %d", 1500-46, mtu)
+	}
+}
+
+func TestContainerMTU(t *testing.T) {
+	for _, test := range []struct {
+		ns  *NetworkState
+		mtu int
+	}{
+		{&NetworkState{MTU: 1500, Mode: modeNAT}, 1500},
+		{&NetworkState{MTU: 1500, Mode: modeOverlay, TunnelType: tunnelVXLAN}, 1450},
+		{&NetworkState{MTU: 9000, Mode: modeOverlay, TunnelType: tunnelGeneve}, 8950},
+		{&NetworkState{MTU: 1500, Mode: modeOverlay, TunnelType: tunnelGRE}, 1458},
+		{&NetworkState{MTU: 1500, Mode: modeOverlay, TunnelType: tunnelVXLAN, OverlayPeers: []string{"10.0.0.2", "fd00::2"}}, 1430},
+	} {
+		if mtu := test.ns.containerMTU(); mtu != test.mtu {
+			t.Errorf("expected an MTU of %d for %+v, got %d", test.mtu, test.ns, mtu)
+		}
+	}
+}
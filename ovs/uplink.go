@@ -0,0 +1,246 @@
+package ovs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// uplinkBinding records which NIC is bound to a bridge, the network that
+// bound it and whether its addresses moved to the bridge. It outlives that
+// network when other networks share the bridge.
+type uplinkBinding struct {
+	Interface string
+	Network   string
+	Migrated  bool
+}
+
+func (b uplinkBinding) externalIDs() map[string]string {
+	return map[string]string{
+		externalIDUplinkNetwork:  b.Network,
+		externalIDUplinkMigrated: strconv.FormatBool(b.Migrated),
+	}
+}
+
+// getUplink returns the uplink binding of a bridge
+func (d *Driver) getUplink(bridgeName string) (uplinkBinding, bool) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	binding, ok := d.uplinks[bridgeName]
+	return binding, ok
+}
+
+func (d *Driver) setUplink(bridgeName string, binding uplinkBinding) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.uplinks[bridgeName] = binding
+}
+
+func (d *Driver) removeUplink(bridgeName string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.uplinks, bridgeName)
+}
+
+// bindUplink attaches the bind interface of a flat network to its bridge as
+// a system port. If the network migrates addresses, the addresses and
+// default routes of the NIC move to the bridge internal port so the host
+// stays reachable through the bridge. A bridge has a single uplink, bound
+// again without moving addresses twice when the bridge is rebuilt.
+func (d *Driver) bindUplink(id string, ns *NetworkState) error {
+	binding, bound := d.getUplink(ns.BridgeName)
+	if bound && binding.Interface != ns.FlatBindInterface {
+		return fmt.Errorf("bridge %s is already bound to %s", ns.BridgeName, binding.Interface)
+	}
+	if !bound {
+		binding = uplinkBinding{Interface: ns.FlatBindInterface, Network: id}
+	}
+	migrate := ns.FlatMigrate && !binding.Migrated
+	binding.Migrated = binding.Migrated || ns.FlatMigrate
+
+	nic, err := d.links.LinkByName(ns.FlatBindInterface)
+	if err != nil {
+		return fmt.Errorf("bind interface %s not found: %s", ns.FlatBindInterface, err)
+	}
+	// Recorded before any address moves, so that a failed migration is
+	// still unbound
+	err = d.ovsdber.addUplinkPort(ns.BridgeName, ns.FlatBindInterface, binding.externalIDs())
+	if isExists(err) {
+		err = d.ovsdber.setExternalIDs("Port", ns.FlatBindInterface, binding.externalIDs())
+	}
+	if err != nil {
+		log.Errorf("error attaching [ %s ] to bridge [ %s ]: %s", ns.FlatBindInterface, ns.BridgeName, err)
+		return err
+	}
+	d.setUplink(ns.BridgeName, binding)
+	if err := d.links.LinkSetUp(nic); err != nil {
+		return err
+	}
+	log.Infof("Attached uplink [ %s ] to bridge [ %s ]", ns.FlatBindInterface, ns.BridgeName)
+	if !migrate {
+		return nil
+	}
+
+	bridge, err := d.links.LinkByName(ns.BridgeName)
+	if err != nil {
+		return err
+	}
+	// Routes can only be added through a link that is up
+	if err := d.links.LinkSetUp(bridge); err != nil {
+		return err
+	}
+	return d.moveAddresses(nic, bridge)
+}
+
+// unbindUplink reverses bindUplink for whichever network bound the uplink of
+// a bridge, moving migrated addresses back to the NIC before it is detached
+func (d *Driver) unbindUplink(bridgeName string) error {
+	binding, ok := d.getUplink(bridgeName)
+	if !ok {
+		return nil
+	}
+	if binding.Migrated {
+		bridge, err := d.links.LinkByName(bridgeName)
+		if err != nil {
+			return err
+		}
+		nic, err := d.links.LinkByName(binding.Interface)
+		if err != nil {
+			return fmt.Errorf("bind interface %s not found: %s", binding.Interface, err)
+		}
+		if err := d.moveAddresses(bridge, nic); err != nil {
+			return err
+		}
+	}
+	if err := d.ovsdber.deletePort(bridgeName, binding.Interface); err != nil && !isNotFound(err) {
+		return err
+	}
+	d.removeUplink(bridgeName)
+	log.Infof("Detached uplink [ %s ] of network %s from bridge [ %s ]", binding.Interface, binding.Network, bridgeName)
+	return nil
+}
+
+// moveAddresses moves the IPv4 and IPv6 addresses and default routes of a
+// link to another. IPv6 link-local addresses stay, every link has its own.
+// The addresses are on both links until the routes have moved, and every
+// step is undone if one fails, so the host never loses its addresses.
+func (d *Driver) moveAddresses(from netlink.Link, to netlink.Link) (err error) {
+	routes, err := d.addrs.RouteList(from, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	var defaults []netlink.Route
+	for _, route := range routes {
+		if route.Dst == nil && route.Gw != nil {
+			defaults = append(defaults, route)
+		}
+	}
+	all, err := d.addrs.AddrList(from, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	var addrs []netlink.Addr
+	for _, addr := range all {
+		if !addr.IP.IsLinkLocalUnicast() {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	var undo []func() error
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(undo) - 1; i >= 0; i-- {
+			if undoErr := undo[i](); undoErr != nil {
+				log.Errorf("Could not roll back moving addresses from [ %s ] to [ %s ]: %s", from.Attrs().Name, to.Attrs().Name, undoErr)
+			}
+		}
+	}()
+	for i := range addrs {
+		// A label has to start with the name of the link it is on
+		addr := addrs[i]
+		addr.Label = ""
+		if err := d.addrs.AddrAdd(to, &addr); err != nil {
+			return fmt.Errorf("could not add %s to %s: %s", addr.IPNet, to.Attrs().Name, err)
+		}
+		undo = append(undo, func() error { return d.addrs.AddrDel(to, &addr) })
+	}
+	for i := range defaults {
+		route, moved := defaults[i], defaults[i]
+		moved.LinkIndex = to.Attrs().Index
+		if err := d.addrs.RouteDel(&route); err != nil {
+			return fmt.Errorf("could not remove the default route via %s from %s: %s", route.Gw, from.Attrs().Name, err)
+		}
+		undo = append(undo, func() error { return d.addrs.RouteAdd(&route) })
+		if err := d.addrs.RouteAdd(&moved); err != nil {
+			return fmt.Errorf("could not move the default route via %s to %s: %s", route.Gw, to.Attrs().Name, err)
+		}
+		undo = append(undo, func() error { return d.addrs.RouteDel(&moved) })
+		log.Infof("Moved default route via %s from [ %s ] to [ %s ]", route.Gw, from.Attrs().Name, to.Attrs().Name)
+	}
+	for i := range addrs {
+		addr := addrs[i]
+		if err := d.addrs.AddrDel(from, &addr); err != nil {
+			return fmt.Errorf("could not remove %s from %s: %s", addr.IPNet, from.Attrs().Name, err)
+		}
+		undo = append(undo, func() error { return d.addrs.AddrAdd(from, &addr) })
+		log.Infof("Moved address %s from [ %s ] to [ %s ]", addr.IPNet, from.Attrs().Name, to.Attrs().Name)
+	}
+	return nil
+}
+
+// bridgeUplink returns the NIC bound to a bridge
+func (d *Driver) bridgeUplink(bridgeName string) string {
+	binding, _ := d.getUplink(bridgeName)
+	return binding.Interface
+}
+
+// bridgeVLANs returns the sorted VLANs of the networks using a bridge, with
+// VLAN 0 standing for untagged networks. Internal networks never reach the
+// uplink.
+func (d *Driver) bridgeVLANs(bridgeName string) []uint {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	seen := make(map[uint]bool)
+	var vlans []uint
+	for _, ns := range d.networks {
+		if ns.BridgeName == bridgeName && ns.Mode != modeInternal && !seen[ns.VLAN] {
+			seen[ns.VLAN] = true
+			vlans = append(vlans, ns.VLAN)
+		}
+	}
+	sort.Sort(vlanList(vlans))
+	return vlans
+}
+
+type vlanList []uint
+
+func (l vlanList) Len() int           { return len(l) }
+func (l vlanList) Less(i, j int) bool { return l[i] < l[j] }
+func (l vlanList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// updateTrunks makes the uplink of a bridge an 802.1Q trunk carrying only the
+// VLANs of the networks using the bridge
+func (d *Driver) updateTrunks(bridgeName string, uplink string) error {
+	if uplink == "" {
+		return nil
+	}
+	// Serialized so that an update computed from an older set of networks
+	// never lands after a newer one
+	d.trunkLock.Lock()
+	defer d.trunkLock.Unlock()
+	vlans := d.bridgeVLANs(bridgeName)
+	if len(vlans) == 0 {
+		return nil
+	}
+	if err := d.ovsdber.setTrunks(uplink, vlans); err != nil {
+		log.Errorf("Could not set the trunks of uplink [ %s ] to %v: %s", uplink, vlans, err)
+		return err
+	}
+	log.Debugf("Uplink [ %s ] of bridge [ %s ] trunks VLANs %v", uplink, bridgeName, vlans)
+	return nil
+}
@@ -0,0 +1,376 @@
+package ovs
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/gopher-net/dknet"
+	"github.com/vishvananda/netlink"
+)
+
+// addTestNIC adds a host NIC with an address and a default route
+func addTestNIC(t *testing.T, links *fakeLinker, name string) {
+	nic := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: name}}
+	if err := links.LinkAdd(nic); err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := netlink.ParseAddr("10.1.0.5/24")
+	if err := links.AddrAdd(nic, addr); err != nil {
+		t.Fatal(err)
+	}
+	route := &netlink.Route{LinkIndex: nic.Index, Gw: net.ParseIP("10.1.0.1")}
+	if err := links.RouteAdd(route); err != nil {
+		t.Fatal(err)
+	}
+	links.recorded()
+}
+
+func TestFlatNetworkBindsUplink(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	links := d.links.(*fakeLinker)
+	addTestNIC(t, links, "eth1")
+
+	id := createModeNetwork(t, d, modeFlat, "10.1.0.1/24", map[string]interface{}{bindInterfaceOption: "eth1"})
+	expectRecorded(t, &links.recorder, "up eth1", "up ovsbr-01234")
+	portUUID, _, ok := sharedOvsdb.rowByName("Port", "eth1")
+	if !ok {
+		t.Fatal("uplink was not attached to the bridge")
+	}
+	_, intf, _ := sharedOvsdb.rowByName("Interface", "eth1")
+	if intf["type"] != "system" {
+		t.Fatalf("expected a system interface, got %v", intf["type"])
+	}
+	_, bridge, _ := sharedOvsdb.rowByName("Bridge", "ovsbr-01234")
+	if indexOf(bridge["ports"].([]interface{}), []interface{}{"uuid", portUUID}) < 0 {
+		t.Fatal("uplink is not a port of the bridge")
+	}
+
+	waitFor(t, "the uplink to be cached", func() bool {
+		_, _, ok := d.cache.portByName("eth1")
+		return ok
+	})
+	if err := d.DeleteNetwork(&dknet.DeleteNetworkRequest{NetworkID: id}); err != nil {
+		t.Fatal(err)
+	}
+	expectRecorded(t, &links.recorder)
+	if _, _, ok := sharedOvsdb.rowByName("Port", "eth1"); ok {
+		t.Fatal("uplink was not detached")
+	}
+}
+
+func TestFlatNetworkMigratesAddresses(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	links := d.links.(*fakeLinker)
+	addTestNIC(t, links, "eth1")
+	// IPv6 moves as well, except for the link-local address of the NIC
+	nic, _ := links.LinkByName("eth1")
+	for _, address := range []string{"2001:db8::5/64", "fe80::5/64"} {
+		addr, _ := netlink.ParseAddr(address)
+		if err := links.AddrAdd(nic, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := links.RouteAdd(&netlink.Route{LinkIndex: nic.Attrs().Index, Gw: net.ParseIP("fe80::1")}); err != nil {
+		t.Fatal(err)
+	}
+	links.recorded()
+
+	id := createModeNetwork(t, d, modeFlat, "10.1.0.1/24", map[string]interface{}{bindInterfaceOption: "eth1", migrateOption: "true"})
+	expectRecorded(t, &links.recorder,
+		"up eth1",
+		"up ovsbr-01234",
+		"addr add ovsbr-01234 10.1.0.5/24",
+		"addr add ovsbr-01234 2001:db8::5/64",
+		"route del default via 10.1.0.1 dev eth1",
+		"route add default via 10.1.0.1 dev ovsbr-01234",
+		"route del default via fe80::1 dev eth1",
+		"route add default via fe80::1 dev ovsbr-01234",
+		"addr del eth1 10.1.0.5/24",
+		"addr del eth1 2001:db8::5/64",
+		"up ovsbr-01234")
+
+	// The migration is restored from OVSDB after a restart
+	waitFor(t, "the bridge to be cached", func() bool {
+		_, _, ok := d.cache.bridgeByName("ovsbr-01234")
+		return ok
+	})
+	if ns := d.ovsdber.networksFromCache()[id]; ns == nil || !ns.FlatMigrate || ns.FlatBindInterface != "eth1" {
+		t.Fatalf("uplink binding not restored from OVSDB: %+v", ns)
+	}
+
+	waitFor(t, "the uplink to be cached", func() bool {
+		_, _, ok := d.cache.portByName("eth1")
+		return ok
+	})
+	if err := d.DeleteNetwork(&dknet.DeleteNetworkRequest{NetworkID: id}); err != nil {
+		t.Fatal(err)
+	}
+	expectRecorded(t, &links.recorder,
+		"addr add eth1 10.1.0.5/24",
+		"addr add eth1 2001:db8::5/64",
+		"route del default via 10.1.0.1 dev ovsbr-01234",
+		"route add default via 10.1.0.1 dev eth1",
+		"route del default via fe80::1 dev ovsbr-01234",
+		"route add default via fe80::1 dev eth1",
+		"addr del ovsbr-01234 10.1.0.5/24",
+		"addr del ovsbr-01234 2001:db8::5/64")
+	if _, _, ok := sharedOvsdb.rowByName("Port", "eth1"); ok {
+		t.Fatal("uplink was not detached")
+	}
+}
+
+func TestFlatNetworkMissingUplink(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	id, _ := testNetwork()
+	err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+		NetworkID: id,
+		Options:   map[string]interface{}{modeOption: modeFlat, bindInterfaceOption: "eth9"},
+		IPv4Data:  []*dknet.IPAMData{{Pool: "10.1.0.0/24", Gateway: "10.1.0.1/24"}},
+	})
+	if err == nil {
+		t.Fatal("expected binding a missing interface to fail")
+	}
+	if _, err := d.getNetwork(id); err == nil {
+		t.Fatal("network kept after its creation failed")
+	}
+	if _, _, ok := sharedOvsdb.rowByName("Bridge", "ovsbr-01234"); ok {
+		t.Fatal("bridge kept after the network's creation failed")
+	}
+}
+
+func TestFlatNetworkMigrationRollback(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	links := d.links.(*fakeLinker)
+	addTestNIC(t, links, "eth1")
+	links.fails["route add default via 10.1.0.1 dev ovsbr-01234"] = true
+
+	id, _ := testNetwork()
+	err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+		NetworkID: id,
+		Options:   map[string]interface{}{modeOption: modeFlat, bindInterfaceOption: "eth1", migrateOption: "true"},
+		IPv4Data:  []*dknet.IPAMData{{Pool: "10.1.0.0/24", Gateway: "10.1.0.1/24"}},
+	})
+	if err == nil {
+		t.Fatal("expected the failed migration to fail the create")
+	}
+	expectRecorded(t, &links.recorder,
+		"up eth1",
+		"up ovsbr-01234",
+		"addr add ovsbr-01234 10.1.0.5/24",
+		"route del default via 10.1.0.1 dev eth1",
+		"route add default via 10.1.0.1 dev eth1",
+		"addr del ovsbr-01234 10.1.0.5/24")
+
+	nic, _ := links.LinkByName("eth1")
+	if addrs, _ := links.AddrList(nic, netlink.FAMILY_V4); len(addrs) != 1 || addrs[0].IPNet.String() != "10.1.0.5/24" {
+		t.Fatalf("expected eth1 to keep 10.1.0.5/24, got %v", addrs)
+	}
+	if routes, _ := links.RouteList(nic, netlink.FAMILY_V4); len(routes) != 1 {
+		t.Fatalf("expected eth1 to keep its default route, got %v", routes)
+	}
+	if _, _, ok := sharedOvsdb.rowByName("Port", "eth1"); ok {
+		t.Fatal("uplink still attached after the network's creation failed")
+	}
+	if _, _, ok := sharedOvsdb.rowByName("Bridge", "ovsbr-01234"); ok {
+		t.Fatal("bridge kept after the network's creation failed")
+	}
+	if _, err := d.getNetwork(id); err == nil {
+		t.Fatal("network kept after its creation failed")
+	}
+}
+
+// trunks returns the VLANs a port trunks in the fake OVSDB
+func trunks(t *testing.T, portName string) string {
+	_, port, ok := sharedOvsdb.rowByName("Port", portName)
+	if !ok {
+		t.Fatalf("port %s not found", portName)
+	}
+	set, _ := port["trunks"].([]interface{})
+	return fmt.Sprint(set)
+}
+
+func TestFlatUplinkTrunksNetworkVLANs(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	addTestNIC(t, d.links.(*fakeLinker), "eth1")
+
+	create := func(id string, options map[string]interface{}, gateway string) {
+		options[modeOption] = modeFlat
+		options[bridgeNameOption] = "ovsbr-trunk"
+		err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+			NetworkID: id,
+			Options:   map[string]interface{}{genericOption: options},
+			IPv4Data:  []*dknet.IPAMData{{Gateway: gateway}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	create("1000000000", map[string]interface{}{bindInterfaceOption: "eth1", vlanOption: "200"}, "10.200.0.1/24")
+	if got := trunks(t, "eth1"); got != "[200]" {
+		t.Fatalf("expected the uplink to trunk [200], got %s", got)
+	}
+	create("2000000000", map[string]interface{}{vlanOption: "100"}, "10.100.0.1/24")
+	if got := trunks(t, "eth1"); got != "[100 200]" {
+		t.Fatalf("expected the uplink to trunk [100 200], got %s", got)
+	}
+
+	waitFor(t, "the gateway port to be cached", func() bool {
+		_, _, ok := d.cache.portByName(gatewayPortName("2000000000"))
+		return ok
+	})
+	if err := d.DeleteNetwork(&dknet.DeleteNetworkRequest{NetworkID: "2000000000"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := trunks(t, "eth1"); got != "[200]" {
+		t.Fatalf("expected the uplink to trunk [200] after a delete, got %s", got)
+	}
+}
+
+func TestInternalNetworkWithoutUplink(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	addTestNIC(t, d.links.(*fakeLinker), "eth1")
+
+	create := func(id string, bridgeName string, options map[string]interface{}, gateway string) error {
+		options[bridgeNameOption] = bridgeName
+		return d.CreateNetwork(&dknet.CreateNetworkRequest{
+			NetworkID: id,
+			Options:   map[string]interface{}{genericOption: options},
+			IPv4Data:  []*dknet.IPAMData{{Gateway: gateway}},
+		})
+	}
+	flat := func(vlan string) map[string]interface{} {
+		return map[string]interface{}{modeOption: modeFlat, bindInterfaceOption: "eth1", vlanOption: vlan}
+	}
+	internal := func(vlan string) map[string]interface{} {
+		return map[string]interface{}{internalOption: true, vlanOption: vlan}
+	}
+
+	// An internal network next to an uplink would be trunked out of it
+	if err := create("1000000000", "ovsbr-trunk", flat("200"), "10.200.0.1/24"); err != nil {
+		t.Fatal(err)
+	}
+	if err := create("2000000000", "ovsbr-trunk", internal("100"), "10.100.0.1/24"); err == nil {
+		t.Fatal("expected an internal network on a bridge with an uplink to be rejected")
+	}
+	if got := trunks(t, "eth1"); got != "[200]" {
+		t.Fatalf("expected the uplink to trunk [200], got %s", got)
+	}
+	if err := d.DeleteNetwork(&dknet.DeleteNetworkRequest{NetworkID: "1000000000"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := create("3000000000", "ovsbr-backend", internal("100"), "10.100.0.1/24"); err != nil {
+		t.Fatal(err)
+	}
+	if err := create("4000000000", "ovsbr-backend", flat("200"), "10.200.0.1/24"); err == nil {
+		t.Fatal("expected an uplink on a bridge with an internal network to be rejected")
+	}
+
+	// Nor is one trunked by a bridge that has both from an older release
+	d.networks["5000000000"] = &NetworkState{BridgeName: "ovsbr-backend", Mode: modeFlat, VLAN: 200}
+	if vlans := d.bridgeVLANs("ovsbr-backend"); fmt.Sprint(vlans) != "[200]" {
+		t.Fatalf("expected only VLAN 200 to be trunked, got %v", vlans)
+	}
+}
+
+func TestUntaggedNetworkNeedsOwnBridge(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	if err := createVLANNetwork(d, "1000000000", "100", "10.100.0.1/24"); err != nil {
+		t.Fatal(err)
+	}
+	if err := createVLANNetwork(d, "2000000000", "0", "10.200.0.1/24"); err == nil {
+		t.Fatal("expected an untagged network on a bridge with a tagged one to be rejected")
+	}
+	if err := createVLANNetwork(d, "3000000000", "0", "10.30.0.1/24"); err == nil {
+		t.Fatal("expected a second network on the bridge of an untagged one to be rejected")
+	}
+
+	err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+		NetworkID: "4000000000",
+		Options:   map[string]interface{}{genericOption: map[string]interface{}{bridgeNameOption: "ovsbr-untagged"}},
+		IPv4Data:  []*dknet.IPAMData{{Gateway: "10.40.0.1/24"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.CreateNetwork(&dknet.CreateNetworkRequest{
+		NetworkID: "5000000000",
+		Options:   map[string]interface{}{genericOption: map[string]interface{}{bridgeNameOption: "ovsbr-untagged", vlanOption: "50"}},
+		IPv4Data:  []*dknet.IPAMData{{Gateway: "10.50.0.1/24"}},
+	})
+	if err == nil {
+		t.Fatal("expected a tagged network on the bridge of an untagged one to be rejected")
+	}
+}
+
+func TestUplinkUnboundByLastNetwork(t *testing.T) {
+	d, cleanup := newTestDriver(t)
+	defer cleanup()
+	links := d.links.(*fakeLinker)
+	addTestNIC(t, links, "eth1")
+
+	create := func(id string, options map[string]interface{}, gateway string) {
+		options[modeOption] = modeFlat
+		options[bridgeNameOption] = "ovsbr-trunk"
+		err := d.CreateNetwork(&dknet.CreateNetworkRequest{
+			NetworkID: id,
+			Options:   map[string]interface{}{genericOption: options},
+			IPv4Data:  []*dknet.IPAMData{{Gateway: gateway}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	create("1000000000", map[string]interface{}{bindInterfaceOption: "eth1", migrateOption: "true", vlanOption: "200"}, "10.200.0.1/24")
+	create("2000000000", map[string]interface{}{vlanOption: "100"}, "10.100.0.1/24")
+	links.recorded()
+
+	// The binding outlives the network that made it
+	waitFor(t, "the gateway ports to be cached", func() bool {
+		_, _, ok := d.cache.portByName(gatewayPortName("1000000000"))
+		return ok
+	})
+	if err := d.DeleteNetwork(&dknet.DeleteNetworkRequest{NetworkID: "1000000000"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := trunks(t, "eth1"); got != "[100]" {
+		t.Fatalf("expected the uplink to trunk [100], got %s", got)
+	}
+	waitFor(t, "the uplink to be cached", func() bool {
+		_, _, ok := d.cache.portByName("eth1")
+		return ok
+	})
+	expected := uplinkBinding{Interface: "eth1", Network: "1000000000", Migrated: true}
+	if restored := d.ovsdber.uplinksFromCache()["ovsbr-trunk"]; restored != expected {
+		t.Fatalf("expected uplink binding %+v to be restored from OVSDB, got %+v", expected, restored)
+	}
+
+	waitFor(t, "the gateway port to be cached", func() bool {
+		_, _, ok := d.cache.portByName(gatewayPortName("2000000000"))
+		return ok
+	})
+	if err := d.DeleteNetwork(&dknet.DeleteNetworkRequest{NetworkID: "2000000000"}); err != nil {
+		t.Fatal(err)
+	}
+	expectRecorded(t, &links.recorder,
+		"addr add eth1 10.1.0.5/24",
+		"route del default via 10.1.0.1 dev ovsbr-trunk",
+		"route add default via 10.1.0.1 dev eth1",
+		"addr del ovsbr-trunk 10.1.0.5/24")
+	if _, _, ok := sharedOvsdb.rowByName("Port", "eth1"); ok {
+		t.Fatal("uplink was not detached")
+	}
+	if _, _, ok := sharedOvsdb.rowByName("Bridge", "ovsbr-trunk"); ok {
+		t.Fatal("bridge was not deleted")
+	}
+}
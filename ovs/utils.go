@@ -3,28 +3,57 @@ package ovs
 import (
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/vishvananda/netlink"
 )
 
-// Generate a mac addr
-func makeMac(ip net.IP) string {
+// Generate a mac addr from a prefix, 7a:42 if empty, and the last bytes of
+// an IP address
+func makeMac(prefix net.HardwareAddr, ip net.IP) string {
+	if len(prefix) == 0 {
+		prefix = net.HardwareAddr{0x7a, 0x42}
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
 	hw := make(net.HardwareAddr, 6)
-	hw[0] = 0x7a
-	hw[1] = 0x42
-	copy(hw[2:], ip.To4())
+	copy(hw, prefix)
+	copy(hw[len(prefix):], ip[len(ip)-(len(hw)-len(prefix)):])
 	return hw.String()
 }
 
+// parseMACPrefix parses the first two or three bytes of a unicast MAC
+// address, e.g. 02:42 or 00:16:3e
+func parseMACPrefix(s string) (net.HardwareAddr, error) {
+	parts := strings.FieldsFunc(s, func(r rune) bool { return r == ':' || r == '-' })
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("a MAC prefix has two or three bytes")
+	}
+	prefix := make(net.HardwareAddr, len(parts))
+	for i, part := range parts {
+		b, err := strconv.ParseUint(part, 16, 8)
+		if err != nil || len(part) != 2 {
+			return nil, fmt.Errorf("%q is not a hex byte", part)
+		}
+		prefix[i] = byte(b)
+	}
+	if prefix[0]&1 != 0 {
+		return nil, fmt.Errorf("%s is a multicast prefix", prefix)
+	}
+	return prefix, nil
+}
+
 // Return the IPv4 address of a network interface
-func getIfaceAddr(name string) (*net.IPNet, error) {
-	iface, err := netlink.LinkByName(name)
+func (d *Driver) getIfaceAddr(name string) (*net.IPNet, error) {
+	iface, err := d.links.LinkByName(name)
 	if err != nil {
 		return nil, err
 	}
-	addrs, err := netlink.AddrList(iface, netlink.FAMILY_V4)
+	addrs, err := d.addrs.AddrList(iface, netlink.FAMILY_V4)
 	if err != nil {
 		return nil, err
 	}
@@ -38,12 +67,12 @@ func getIfaceAddr(name string) (*net.IPNet, error) {
 }
 
 // Set the IP addr of a netlink interface
-func setInterfaceIP(name string, rawIP string) error {
+func (d *Driver) setInterfaceIP(name string, rawIP string) error {
 	retries := 2
 	var iface netlink.Link
 	var err error
 	for i := 0; i < retries; i++ {
-		iface, err = netlink.LinkByName(name)
+		iface, err = d.links.LinkByName(name)
 		if err == nil {
 			break
 		}
@@ -59,7 +88,16 @@ func setInterfaceIP(name string, rawIP string) error {
 		return err
 	}
 	addr := &netlink.Addr{ipNet, ""}
-	return netlink.AddrAdd(iface, addr)
+	return d.addrs.AddrAdd(iface, addr)
+}
+
+// setMAC sets the MAC address of a netlink interface
+func (d *Driver) setMAC(name string, mac net.HardwareAddr) error {
+	iface, err := d.links.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	return d.links.LinkSetHardwareAddr(iface, mac)
 }
 
 // Increment an IP in a subnet
@@ -78,8 +116,8 @@ func ipIncrement(networkAddr net.IP) net.IP {
 }
 
 // Check if a netlink interface exists in the default namespace
-func validateIface(ifaceStr string) bool {
-	_, err := net.InterfaceByName(ifaceStr)
+func (d *Driver) validateIface(ifaceStr string) bool {
+	_, err := d.links.LinkByName(ifaceStr)
 	if err != nil {
 		log.Debugf("The requested interface [ %s ] was not found on the host: %s", ifaceStr, err)
 		return false